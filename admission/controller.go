@@ -0,0 +1,197 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"rrinterceptor/promutils"
+
+	"github.com/hekmon/hllogger"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Rules names, as reported in rejections
+const (
+	RuleMaxRange    = "max_range"
+	RuleRequireName = "require_name"
+	RuleEmptyRegex  = "empty_regex"
+	RuleMaxSeries   = "max_series"
+	// RuleValidMatchers is not configurable: invalid matchers are always refused
+	RuleValidMatchers = "valid_matchers"
+)
+
+// AnyRetentionPolicy is the MaxRange key applying to the retention policies without their own limit
+const AnyRetentionPolicy = "*"
+
+// CardinalityEstimator returns the number of series matching matchers within rp, as seen by the request credentials
+type CardinalityEstimator func(ctx context.Context, rp string, matchers []*labels.Matcher) (series int64, err error)
+
+// Config allow to pass values to the contructor
+type Config struct {
+	MaxRange      map[string]time.Duration // by retention policy name or AnyRetentionPolicy
+	RequireName   bool                     // an equality or prefix matcher on the metric name is required
+	BanEmptyRegex bool                     // regex matchers matching the empty string are refused
+	MaxSeries     int64                    // 0 disables the cardinality check
+	Logger        *hllogger.HlLogger
+}
+
+// New returns an initialized and ready to use admission controller
+func New(conf Config) (c *Controller, err error) {
+	if conf.Logger == nil {
+		err = errors.New("logger can't be nil")
+		return
+	}
+	c = &Controller{
+		maxRange:      conf.MaxRange,
+		requireName:   conf.RequireName,
+		banEmptyRegex: conf.BanEmptyRegex,
+		maxSeries:     conf.MaxSeries,
+		rejections:    make(map[string]uint64),
+		log:           conf.Logger,
+	}
+	return
+}
+
+// Controller checks the queries against the admission rules before they are sent to influxdb
+type Controller struct {
+	// Rules
+	maxRange      map[string]time.Duration
+	requireName   bool
+	banEmptyRegex bool
+	maxSeries     int64
+	// Stats
+	access     sync.Mutex
+	rejections map[string]uint64 // by rule
+	// Sub Controllers
+	log *hllogger.HlLogger
+}
+
+// Rejection is returned by Check when a query violates a rule
+type Rejection struct {
+	Rule   string
+	Query  int // index of the query within the request
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("query #%d rejected by the '%s' admission rule: %s", r.Query, r.Rule, r.Reason)
+}
+
+// Check returns a *Rejection if one of queries on rp violates a rule. Other errors are not returned:
+// a query whose cardinality can not be estimated is admitted.
+func (c *Controller) Check(ctx context.Context, rp string, queries []*prompb.Query, cardinality CardinalityEstimator) (rejection *Rejection) {
+	for index, query := range queries {
+		if query == nil {
+			continue
+		}
+		if rejection = c.checkQuery(ctx, rp, query, cardinality); rejection != nil {
+			rejection.Query = index
+			c.access.Lock()
+			c.rejections[rejection.Rule]++
+			c.access.Unlock()
+			return
+		}
+	}
+	return
+}
+
+func (c *Controller) checkQuery(ctx context.Context, rp string, query *prompb.Query, cardinality CardinalityEstimator) *Rejection {
+	// Time range
+	if maxRange, limited := c.rangeLimit(rp); limited {
+		if queryRange := time.Duration(query.EndTimestampMs-query.StartTimestampMs) * time.Millisecond; queryRange > maxRange {
+			return &Rejection{
+				Rule:   RuleMaxRange,
+				Reason: fmt.Sprintf("range of %v exceeds the %v allowed on '%s' retention policy", queryRange, maxRange, rp),
+			}
+		}
+	}
+	// Matchers
+	matchers, err := promutils.FromLabelMatchers(query.Matchers)
+	if err != nil {
+		return &Rejection{
+			Rule:   RuleValidMatchers,
+			Reason: fmt.Sprintf("invalid matcher: %v", err),
+		}
+	}
+	if c.requireName && !hasNameSelector(matchers) {
+		return &Rejection{
+			Rule:   RuleRequireName,
+			Reason: fmt.Sprintf("an equality or prefix matcher on %s is required", labels.MetricName),
+		}
+	}
+	if c.banEmptyRegex {
+		for _, matcher := range matchers {
+			if matcher.Type == labels.MatchRegexp && matcher.Matches("") {
+				return &Rejection{
+					Rule:   RuleEmptyRegex,
+					Reason: fmt.Sprintf("regex matcher %s matches the empty string", matcher),
+				}
+			}
+		}
+	}
+	// Cardinality
+	if c.maxSeries > 0 && cardinality != nil {
+		series, err := cardinality(ctx, rp, matchers)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.log.Warningf("[Admission] can't estimate the cardinality of a query on '%s': admitting it: %v", rp, err)
+			}
+			return nil
+		}
+		if series > c.maxSeries {
+			return &Rejection{
+				Rule:   RuleMaxSeries,
+				Reason: fmt.Sprintf("%d series selected while the limit is %d", series, c.maxSeries),
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Controller) rangeLimit(rp string) (maxRange time.Duration, limited bool) {
+	if maxRange, limited = c.maxRange[rp]; limited {
+		return
+	}
+	maxRange, limited = c.maxRange[AnyRetentionPolicy]
+	return
+}
+
+// hasNameSelector returns true if matchers contain an equality or a literal prefixed regex on the metric name
+func hasNameSelector(matchers []*labels.Matcher) bool {
+	for _, matcher := range matchers {
+		if matcher.Name != labels.MetricName {
+			continue
+		}
+		switch matcher.Type {
+		case labels.MatchEqual:
+			if matcher.Value != "" {
+				return true
+			}
+		case labels.MatchRegexp:
+			if prefix := regexPrefix(matcher.Value); prefix != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Stats contains the admission counters
+type Stats struct {
+	Rejections map[string]uint64 // by rule
+}
+
+// Stats returns the current counters of the admission controller
+func (c *Controller) Stats() (stats Stats) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	stats.Rejections = make(map[string]uint64, len(c.rejections))
+	for rule, count := range c.rejections {
+		stats.Rejections[rule] = count
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func newTestController(t *testing.T, conf Config) *Controller {
+	conf.Logger = hllogger.New(ioutil.Discard, nil)
+	c, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testQuery(rangeHours int64, matchers ...*prompb.LabelMatcher) *prompb.Query {
+	return &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   rangeHours * int64(time.Hour/time.Millisecond),
+		Matchers:         matchers,
+	}
+}
+
+func eq(name, value string) *prompb.LabelMatcher {
+	return &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: name, Value: value}
+}
+
+func re(name, value string) *prompb.LabelMatcher {
+	return &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: name, Value: value}
+}
+
+func TestCheck(t *testing.T) {
+	c := newTestController(t, Config{
+		MaxRange:      map[string]time.Duration{"autogen": 24 * time.Hour, AnyRetentionPolicy: 720 * time.Hour},
+		RequireName:   true,
+		BanEmptyRegex: true,
+		MaxSeries:     100,
+	})
+	cardinality := func(ctx context.Context, rp string, matchers []*labels.Matcher) (int64, error) {
+		for _, matcher := range matchers {
+			if matcher.Name == labels.MetricName {
+				switch matcher.Value {
+				case "huge":
+					return 1000, nil
+				case "unknown":
+					return 0, errors.New("cardinality not available")
+				}
+			}
+		}
+		return 10, nil
+	}
+	cases := []struct {
+		name    string
+		rp      string
+		queries []*prompb.Query
+		rule    string
+		query   int
+	}{
+		{"admitted", "autogen", []*prompb.Query{testQuery(1, eq("__name__", "up"))}, "", 0},
+		{"rp range", "autogen", []*prompb.Query{testQuery(25, eq("__name__", "up"))}, RuleMaxRange, 0},
+		{"default range", "month", []*prompb.Query{testQuery(25, eq("__name__", "up"))}, "", 0},
+		{"default range exceeded", "inf", []*prompb.Query{testQuery(721, eq("__name__", "up"))}, RuleMaxRange, 0},
+		{"no name", "autogen", []*prompb.Query{testQuery(1, eq("job", "node"))}, RuleRequireName, 0},
+		{"empty name", "autogen", []*prompb.Query{testQuery(1, eq("__name__", ""))}, RuleRequireName, 0},
+		{"name prefix", "autogen", []*prompb.Query{testQuery(1, re("__name__", "node_.*"))}, "", 0},
+		{"name without prefix", "autogen", []*prompb.Query{testQuery(1, re("__name__", ".*_total"))}, RuleRequireName, 0},
+		{"empty regex", "autogen", []*prompb.Query{testQuery(1, eq("__name__", "up"), re("job", ".*"))}, RuleEmptyRegex, 0},
+		{"non empty regex", "autogen", []*prompb.Query{testQuery(1, eq("__name__", "up"), re("job", ".+"))}, "", 0},
+		{"invalid regex", "autogen", []*prompb.Query{testQuery(1, eq("__name__", "up"), re("job", "("))}, RuleValidMatchers, 0},
+		{"cardinality", "autogen", []*prompb.Query{testQuery(1, eq("__name__", "up")), testQuery(1, eq("__name__", "huge"))}, RuleMaxSeries, 1},
+		{"unknown cardinality", "autogen", []*prompb.Query{testQuery(1, eq("__name__", "unknown"))}, "", 0},
+		{"nil query", "autogen", []*prompb.Query{nil, testQuery(1, eq("job", "node"))}, RuleRequireName, 1},
+	}
+	expected := make(map[string]uint64)
+	for _, tc := range cases {
+		rejection := c.Check(context.Background(), tc.rp, tc.queries, cardinality)
+		switch {
+		case tc.rule == "" && rejection != nil:
+			t.Errorf("%s: unexpected rejection: %v", tc.name, rejection)
+		case tc.rule != "" && rejection == nil:
+			t.Errorf("%s: expected a '%s' rejection, query has been admitted", tc.name, tc.rule)
+		case tc.rule != "" && (rejection.Rule != tc.rule || rejection.Query != tc.query):
+			t.Errorf("%s: expected a '%s' rejection of query #%d, got: %v", tc.name, tc.rule, tc.query, rejection)
+		}
+		if tc.rule != "" {
+			expected[tc.rule]++
+		}
+	}
+	stats := c.Stats()
+	for rule, count := range expected {
+		if stats.Rejections[rule] != count {
+			t.Errorf("expected %d '%s' rejections in stats, got %d", count, rule, stats.Rejections[rule])
+		}
+	}
+}
+
+func TestCheckDisabledRules(t *testing.T) {
+	c := newTestController(t, Config{MaxSeries: 1})
+	queries := []*prompb.Query{testQuery(10000, re("job", ".*"))}
+	if rejection := c.Check(context.Background(), "autogen", queries, nil); rejection != nil {
+		t.Errorf("no rule enabled and no estimator: unexpected rejection: %v", rejection)
+	}
+}
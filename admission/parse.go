@@ -0,0 +1,41 @@
+package admission
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseMaxRange parses a comma separated list of 'rp=hours' limits, AnyRetentionPolicy being usable as rp
+func ParseMaxRange(list string) (maxRange map[string]time.Duration, err error) {
+	maxRange = make(map[string]time.Duration)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			err = fmt.Errorf("'%s' is not a 'rp=hours' limit", item)
+			return
+		}
+		var hours int
+		if hours, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil || hours <= 0 {
+			err = fmt.Errorf("'%s' is not a positive number of hours", parts[1])
+			return
+		}
+		maxRange[strings.TrimSpace(parts[0])] = time.Duration(hours) * time.Hour
+	}
+	return
+}
+
+// regexPrefix returns the literal prefix any value matched by a prometheus (fully anchored) regex starts with
+func regexPrefix(regex string) string {
+	compiled, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return ""
+	}
+	prefix, _ := compiled.LiteralPrefix()
+	return prefix
+}
@@ -0,0 +1,39 @@
+package admission
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMaxRange(t *testing.T) {
+	maxRange, err := ParseMaxRange(" autogen=24, *=720 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(maxRange) != 2 || maxRange["autogen"] != 24*time.Hour || maxRange[AnyRetentionPolicy] != 720*time.Hour {
+		t.Errorf("unexpected limits: %v", maxRange)
+	}
+	for _, invalid := range []string{"autogen", "=24", "autogen=0", "autogen=-1", "autogen=day"} {
+		if _, err = ParseMaxRange(invalid); err == nil {
+			t.Errorf("'%s': expected an error", invalid)
+		}
+	}
+}
+
+func TestRegexPrefix(t *testing.T) {
+	cases := map[string]string{
+		"node_cpu_seconds_total": "node_cpu_seconds_total",
+		"node_.*":                "node_",
+		"node_(cpu|memory)_.+":   "node_",
+		"(node|go)_.*":           "",
+		"foo|foobar":             "foo", // factored by the regexp parser
+		".*_total":               "",
+		"(":                      "", // invalid
+		"":                       "",
+	}
+	for regex, expected := range cases {
+		if prefix := regexPrefix(regex); prefix != expected {
+			t.Errorf("'%s': got prefix '%s', expected '%s'", regex, prefix, expected)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Prometheus HTTP API error types
+const (
+	apiErrorBadData   = "bad_data"
+	apiErrorExec      = "execution"
+	apiErrorTimeout   = "timeout"
+	apiErrorCanceled  = "canceled"
+	apiErrorInternal  = "internal"
+	apiErrorUnavaible = "unavailable"
+	// Not part of the prometheus API: used to forward influxdb lookup failures
+	apiErrorUnauthorized = "unauthorized"
+	apiErrorForbidden    = "forbidden"
+	apiErrorNotFound     = "not_found"
+	apiErrorTooLarge     = "too_large"
+	apiErrorTooMany      = "too_many_requests"
+	apiErrorBadGateway   = "bad_gateway"
+)
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func respondAPI(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(apiResponse{
+		Status: "success",
+		Data:   data,
+	}); err != nil {
+		log.Errorf("[API] can't encode response: %v", err)
+	}
+}
+
+func respondAPIError(w http.ResponseWriter, errorType string, err error) {
+	var statusCode int
+	switch errorType {
+	case apiErrorBadData:
+		statusCode = http.StatusBadRequest
+	case apiErrorExec:
+		statusCode = http.StatusUnprocessableEntity
+	case apiErrorTimeout:
+		statusCode = http.StatusServiceUnavailable
+	case apiErrorCanceled:
+		statusCode = http.StatusServiceUnavailable
+	case apiErrorUnavaible:
+		statusCode = http.StatusServiceUnavailable
+	case apiErrorUnauthorized:
+		statusCode = http.StatusUnauthorized
+	case apiErrorForbidden:
+		statusCode = http.StatusForbidden
+	case apiErrorNotFound:
+		statusCode = http.StatusNotFound
+	case apiErrorTooLarge:
+		statusCode = http.StatusRequestEntityTooLarge
+	case apiErrorTooMany:
+		statusCode = http.StatusTooManyRequests
+	case apiErrorBadGateway:
+		statusCode = http.StatusBadGateway
+	default:
+		statusCode = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if encodeErr := json.NewEncoder(w).Encode(apiResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	}); encodeErr != nil {
+		log.Errorf("[API] can't encode error response: %v", encodeErr)
+	}
+}
+
+// parseTime parses a prometheus API timestamp: either an unix timestamp with optional decimals or RFC3339
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses a prometheus API duration: either a number of seconds with optional decimals or a prometheus duration
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration: it overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// parseTimeParam returns the parsed value of the name form value, or defaultValue if absent
+func parseTimeParam(r *http.Request, name string, defaultValue time.Time) (time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	t, err := parseTime(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid '%s' parameter: %v", name, err)
+	}
+	return t, nil
+}
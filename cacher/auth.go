@@ -0,0 +1,57 @@
+package cacher
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"time"
+
+	"rrinterceptor/influxquery"
+	"rrinterceptor/influxrp"
+)
+
+// authorize makes sure the credentials have been validated by influxdb for database within the
+// authorization life limit. If a validation was needed, the retention policies obtained with it are returned.
+// While influxdb is unavailable, credentials validated within the hard staleness limit are still accepted.
+func (c *Controller) authorize(ctx context.Context, endpoint *url.URL, database, user, password string) (fresh influxrp.RetentionPolicies, err error) {
+	key := cacheKey{
+		backend:  endpoint.Host,
+		database: database,
+	}
+	credKey := c.credentialKey(endpoint.Host, database, user, password)
+	c.authAccess.Lock()
+	validated, found := c.auth[credKey]
+	c.authAccess.Unlock()
+	if found && time.Since(validated) < c.authLifeLimit {
+		return
+	}
+	// Validate them with a cheap query requiring read access on the db
+	c.log.Debugf("[Cacher] credentials of user '%s' are not validated for '%s/%s': validating them", user, endpoint.Host, database)
+	if fresh, err = c.lookup(ctx, endpoint, key, credKey, user, password); err != nil {
+		if found && time.Since(validated) < c.lifeLimit && influxquery.KindOf(err) == influxquery.KindUnavailable {
+			c.log.Warningf("[Cacher] can't validate credentials of user '%s' for '%s/%s': accepting their %v old validation: %v",
+				user, endpoint.Host, database, time.Since(validated), err)
+			return nil, nil
+		}
+		err = fmt.Errorf("can't validate credentials of user '%s' for '%s': %w", user, database, err)
+		return
+	}
+	c.authAccess.Lock()
+	c.auth[credKey] = time.Now()
+	c.authAccess.Unlock()
+	return
+}
+
+// credentialKey avoids keeping clear text passwords as map keys. Keyed by the controller secret,
+// the snapshotted keys can't be checked against guessed passwords without it.
+func (c *Controller) credentialKey(backend, database, user, password string) string {
+	mac := hmac.New(sha256.New, c.credentialSecret)
+	for _, part := range []string{backend, database, user, password} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
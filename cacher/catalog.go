@@ -0,0 +1,54 @@
+package cacher
+
+import (
+	"sort"
+	"time"
+
+	"rrinterceptor/influxrp"
+)
+
+// CatalogEntry describes the retention policies cached for a database
+type CatalogEntry struct {
+	Database    string
+	Backend     string
+	RPs         influxrp.RetentionPolicies
+	Created     time.Time
+	NextRefresh time.Time
+	Expires     time.Time // hard staleness limit: the entry is dropped if not refreshed by then
+	Stale       bool
+	Pinned      bool
+	RefreshErr  error // last background refresh error, if any
+}
+
+// Catalog returns the currently cached retention policies, sorted by database and backend
+func (c *Controller) Catalog() (catalog []CatalogEntry) {
+	pinnedKeys := c.pinnedKeys()
+	entries := c.entries()
+	catalog = make([]CatalogEntry, 0, len(entries))
+	for _, entry := range entries {
+		key, cache := entry.key, entry.cache
+		_, pinned := pinnedKeys[key]
+		cache.access.Lock()
+		if cache.rps != nil {
+			catalog = append(catalog, CatalogEntry{
+				Database:    key.database,
+				Backend:     key.backend,
+				RPs:         cache.rps,
+				Created:     cache.created,
+				NextRefresh: cache.refreshAt,
+				Expires:     cache.expiresAt,
+				Stale:       !time.Now().Before(cache.refreshAt),
+				RefreshErr:  cache.refreshErr,
+				Pinned:      pinned,
+			})
+		}
+		cache.access.Unlock()
+	}
+	sort.Slice(catalog, func(i, j int) bool {
+		if catalog[i].Database != catalog[j].Database {
+			return catalog[i].Database < catalog[j].Database
+		}
+		return catalog[i].Backend < catalog[j].Backend
+	})
+	return
+}
@@ -2,7 +2,7 @@ package cacher
 
 import "time"
 
-func (c *Controller) cleaner(frequency, controllerLifeLimit time.Duration) {
+func (c *Controller) cleaner(frequency time.Duration) {
 	defer c.workers.Done()
 	ticker := time.NewTicker(frequency)
 	defer ticker.Stop()
@@ -10,7 +10,7 @@ func (c *Controller) cleaner(frequency, controllerLifeLimit time.Duration) {
 		select {
 		case <-ticker.C:
 			c.log.Debug("[Cacher] Cleaner: new ticker received, launching batch")
-			c.cleanerBatch(controllerLifeLimit)
+			c.cleanerBatch()
 		case <-c.ctx.Done():
 			c.log.Debug("[Cacher] Cleaner: cancel signal received")
 			return
@@ -18,16 +18,59 @@ func (c *Controller) cleaner(frequency, controllerLifeLimit time.Duration) {
 	}
 }
 
-func (c *Controller) cleanerBatch(controllerLifeLimit time.Duration) {
+func (c *Controller) cleanerBatch() {
 	now := time.Now()
-	c.access.Lock()
-	for key, cache := range c.cache {
+	// Inspect the entries without holding the controller: readers keep being served meanwhile
+	var expired []keyedEntry
+	for _, entry := range c.entries() {
+		entry.cache.access.Lock()
+		// entries never filled are being looked up: their caller removes them on failure
+		if entry.cache.rps != nil && !now.Before(entry.cache.expiresAt) {
+			expired = append(expired, entry)
+		}
+		entry.cache.access.Unlock()
+	}
+	var expiredMeta []string
+	for key, cache := range c.metaEntries() {
 		cache.access.Lock()
-		if now.Sub(cache.created) >= controllerLifeLimit {
-			c.log.Infof("[Cacher] Cleaner: controller '%s' has reached is expiration date: deleting", key)
-			delete(c.cache, key)
+		if now.Sub(cache.created) >= c.metaLifeLimit {
+			expiredMeta = append(expiredMeta, key)
 		}
 		cache.access.Unlock()
 	}
+	// Then remove the expired ones which have not been replaced or refreshed meanwhile (entries are never
+	// held during a lookup: checking them again is cheap)
+	c.access.Lock()
+	for _, entry := range expired {
+		if _, pinned := c.pinned[entry.key]; pinned || c.cache[entry.key] != entry.cache {
+			continue
+		}
+		entry.cache.access.Lock()
+		stillExpired := !now.Before(entry.cache.expiresAt)
+		entry.cache.access.Unlock()
+		if stillExpired {
+			c.log.Infof("[Cacher] Cleaner: controller '%s' has reached is expiration date: deleting", entry.key)
+			c.remove(entry.key)
+		}
+	}
+	for _, key := range expiredMeta {
+		c.log.Debugf("[Cacher] Cleaner: meta results for '%s' have reached their expiration date: deleting", key)
+		c.removeMeta(key)
+	}
 	c.access.Unlock()
+	c.authAccess.Lock()
+	for credKey, validated := range c.auth {
+		if now.Sub(validated) >= c.lifeLimit { // kept as a fallback while influxdb is unavailable
+			delete(c.auth, credKey)
+		}
+	}
+	c.authAccess.Unlock()
+	// Forget failures once their backoff is over for long enough: next failure will start a new backoff
+	c.failuresAccess.Lock()
+	for failureKey, record := range c.failures {
+		if now.Sub(record.retryAt) >= c.backoffMax {
+			delete(c.failures, failureKey)
+		}
+	}
+	c.failuresAccess.Unlock()
 }
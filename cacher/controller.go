@@ -1,19 +1,41 @@
 package cacher
 
 import (
+	"container/list"
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"rrinterceptor/coalescer"
+	"rrinterceptor/influxquery"
+
 	"github.com/hekmon/hllogger"
 )
 
 // Config allow to pass values to the contructor
 type Config struct {
-	CheckFrequency  time.Duration
-	ExpirationLimit time.Duration
-	Logger          *hllogger.HlLogger
+	CheckFrequency      time.Duration
+	RefreshFrequency    time.Duration
+	RefreshAfter        time.Duration
+	PollFrequency       time.Duration // 0 disables the rp changes poller
+	ExpirationLimit     time.Duration // hard staleness limit
+	MetaExpirationLimit time.Duration
+	MaxMetaEntries      int // 0 for unlimited
+	AuthExpirationLimit time.Duration
+	FailureBackoff      time.Duration // initial delay before retrying a failed lookup (0 disables negative caching)
+	FailureBackoffMax   time.Duration
+	MaxFailures         int     // remembered failures, 0 for unlimited
+	SnapshotFile        string  // empty disables snapshots
+	CredentialSecret    []byte  // keys the credentials hashes, random if empty (authorizations are then not snapshotted)
+	MaxEntries          int     // 0 for unlimited
+	MaxEntriesPerUser   int     // 0 for unlimited
+	ExpirationJitter    float64 // ratio (0 to 1) of the refresh and expiration delays randomly removed for each entry
+	SnapshotFrequency   time.Duration
+	Logger              *hllogger.HlLogger
 }
 
 // New returns an initialized and ready to use cache controller
@@ -24,14 +46,61 @@ func New(ctx context.Context, conf Config) (c *Controller, err error) {
 	}
 	// Init controller
 	c = &Controller{
-		cache:   make(map[string]*cached, 1), // most usage will use 1 db
-		log:     conf.Logger,
-		ctx:     ctx,
-		stopped: make(chan struct{}),
+		cache:             make(map[cacheKey]*cached, 1), // most usage will use 1 db
+		pinned:            make(map[cacheKey]pin),
+		lru:               list.New(),
+		owned:             make(map[string]int),
+		maxEntries:        conf.MaxEntries,
+		maxEntriesPerUser: conf.MaxEntriesPerUser,
+		jitter:            conf.ExpirationJitter,
+		meta:              make(map[string]*cachedMeta),
+		metaLRU:           list.New(),
+		maxMetaEntries:    conf.MaxMetaEntries,
+		refreshAfter:      conf.RefreshAfter,
+		lifeLimit:         conf.ExpirationLimit,
+		metaLifeLimit:     conf.MetaExpirationLimit, // also checked at access time as meta results are short lived
+		lookups:           coalescer.New(),
+		auth:              make(map[string]time.Time),
+		authLifeLimit:     conf.AuthExpirationLimit, // also checked at access time as authorizations are short lived
+		failures:          make(map[string]*failure),
+		backoff:           conf.FailureBackoff,
+		backoffMax:        conf.FailureBackoffMax,
+		maxFailures:       conf.MaxFailures,
+		lookupFailures:    make(map[influxquery.Kind]uint64),
+		log:               conf.Logger,
+		ctx:               ctx,
+		stopped:           make(chan struct{}),
+	}
+	// Credentials hashes are only worth snapshotting if their key survives restarts
+	if len(conf.CredentialSecret) > 0 {
+		c.credentialSecret = conf.CredentialSecret
+		c.persistAuth = true
+	} else {
+		c.credentialSecret = make([]byte, 32)
+		if _, err = rand.Read(c.credentialSecret); err != nil {
+			err = fmt.Errorf("can't generate credentials secret: %v", err)
+			return
+		}
+	}
+	// Restore the previous snapshot
+	if conf.SnapshotFile != "" {
+		c.snapshotFile = conf.SnapshotFile
+		if err := c.loadSnapshot(); err != nil {
+			c.log.Warningf("[Cacher] can't load snapshot from '%s': starting empty: %v", conf.SnapshotFile, err)
+		}
 	}
 	// Start workers
-	c.workers.Add(1)
-	go c.cleaner(conf.CheckFrequency, conf.ExpirationLimit)
+	c.workers.Add(2)
+	go c.cleaner(conf.CheckFrequency)
+	go c.refresher(conf.RefreshFrequency)
+	if conf.PollFrequency > 0 {
+		c.workers.Add(1)
+		go c.poller(conf.PollFrequency)
+	}
+	if conf.SnapshotFile != "" {
+		c.workers.Add(1)
+		go c.snapshotter(conf.SnapshotFrequency)
+	}
 	// Launch the stop watcher
 	go c.stopWatcher()
 	// All good
@@ -41,8 +110,46 @@ func New(ctx context.Context, conf Config) (c *Controller, err error) {
 // Controller allows to manage a cache instance
 type Controller struct {
 	// Cache
-	access sync.Mutex
-	cache  map[string]*cached
+	access            sync.Mutex
+	cache             map[cacheKey]*cached
+	pinned            map[cacheKey]pin
+	lru               *list.List     // of cacheKey, most recently used first
+	owned             map[string]int // entries count by user
+	maxEntries        int
+	maxEntriesPerUser int
+	jitter            float64
+	refreshAfter      time.Duration
+	lifeLimit         time.Duration
+	meta              map[string]*cachedMeta
+	metaLRU           *list.List // of meta keys, most recently used first
+	maxMetaEntries    int
+	metaLifeLimit     time.Duration
+	lookups           *coalescer.Group // cold lookups in flight, by cache or meta key
+	// Authorizations
+	authAccess       sync.Mutex
+	auth             map[string]time.Time // validation date by credential key
+	authLifeLimit    time.Duration
+	credentialSecret []byte
+	persistAuth      bool
+	// Failed lookups
+	failuresAccess sync.Mutex
+	failures       map[string]*failure // by cache key or credential key
+	maxFailures    int
+	backoff        time.Duration
+	backoffMax     time.Duration
+	lookupFailures map[influxquery.Kind]uint64
+	negativeHits   uint64
+	// Snapshot
+	snapshotFile string
+	// Stats
+	refreshSuccesses uint64
+	refreshFailures  uint64
+	rpsAdded         uint64
+	rpsRemoved       uint64
+	rpsChanged       uint64
+	invalidations    uint64
+	evictions        uint64
+	metaEvictions    uint64
 	// Sub Controllers
 	log *hllogger.HlLogger
 	// Workers
@@ -51,6 +158,48 @@ type Controller struct {
 	stopped chan struct{}
 }
 
+// Stats contains the cache counters
+type Stats struct {
+	RefreshSuccesses uint64
+	RefreshFailures  uint64
+	RPsAdded         uint64
+	RPsRemoved       uint64
+	RPsChanged       uint64
+	Invalidations    uint64
+	Evictions        uint64
+	Entries          int
+	MetaEvictions    uint64
+	MetaEntries      int
+	LookupFailures   map[influxquery.Kind]uint64
+	NegativeHits     uint64 // lookups answered by a remembered failure
+}
+
+// Stats returns the current counters of the cache
+func (c *Controller) Stats() (stats Stats) {
+	stats = Stats{
+		RefreshSuccesses: atomic.LoadUint64(&c.refreshSuccesses),
+		RefreshFailures:  atomic.LoadUint64(&c.refreshFailures),
+		RPsAdded:         atomic.LoadUint64(&c.rpsAdded),
+		RPsRemoved:       atomic.LoadUint64(&c.rpsRemoved),
+		RPsChanged:       atomic.LoadUint64(&c.rpsChanged),
+		Invalidations:    atomic.LoadUint64(&c.invalidations),
+		Evictions:        atomic.LoadUint64(&c.evictions),
+		MetaEvictions:    atomic.LoadUint64(&c.metaEvictions),
+		LookupFailures:   make(map[influxquery.Kind]uint64, len(c.lookupFailures)),
+	}
+	c.access.Lock()
+	stats.Entries = len(c.cache)
+	stats.MetaEntries = len(c.meta)
+	c.access.Unlock()
+	c.failuresAccess.Lock()
+	for kind, count := range c.lookupFailures {
+		stats.LookupFailures[kind] = count
+	}
+	stats.NegativeHits = c.negativeHits
+	c.failuresAccess.Unlock()
+	return
+}
+
 func (c *Controller) stopWatcher() {
 	<-c.ctx.Done()
 	c.log.Debugf("[Cacher] Stop signal received: waiting for workers to stop")
@@ -1,51 +1,185 @@
 package cacher
 
 import (
+	"container/list"
 	"context"
 	"fmt"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"rrinterceptor/influxrp"
 )
 
-// GetRPs allows to get a cached
+// GetRPs allows to get the cached retention policies of database on endpoint.
+// Credentials must have been validated by influxdb before any cached value is returned.
 func (c *Controller) GetRPs(ctx context.Context, endpoint *url.URL, database, user, password string) (rps influxrp.RetentionPolicies, err error) {
+	key := cacheKey{
+		backend:  endpoint.Host,
+		database: database,
+	}
+	// Make sure these credentials are allowed to read this db
+	fresh, err := c.authorize(ctx, endpoint, database, user, password)
+	if err != nil {
+		return
+	}
 	// First try to get cached rps
-	cache := c.getOrCreate(database)
-	defer cache.access.Unlock()
-	cache.access.Lock()
-	if cache.rps != nil {
-		c.log.Debugf("[Cacher] rps found for '%s': using cache", database)
-		rps = cache.rps
+	cache := c.getOrCreate(key, user)
+	rps, err = c.fill(ctx, key, cache, fresh, endpoint, user, password)
+	if err != nil {
+		// Do not leave empty entries behind
+		c.removeIfEmpty(key, cache)
+	}
+	return
+}
+
+func (c *Controller) fill(ctx context.Context, key cacheKey, cache *cached, fresh influxrp.RetentionPolicies,
+	endpoint *url.URL, user, password string) (rps influxrp.RetentionPolicies, err error) {
+	if fresh != nil {
+		c.log.Debugf("[Cacher] rps for '%s' have been refreshed by the credentials validation: using them", key)
+		cache.access.Lock()
+		c.store(key, cache, endpoint, fresh, user, password)
+		cache.access.Unlock()
+		rps = fresh
 		return
 	}
-	// Else get them
-	c.log.Debugf("[Cacher] no rps found for '%s': generating a new one", database)
-	if rps, err = influxrp.GetRetentionPolicies(ctx, endpoint, database, user, password); err != nil {
-		err = fmt.Errorf("previous rps did not exist and getting currents failed: %v", err)
+	if rps = c.serve(key, cache, endpoint, user, password); rps != nil {
 		return
 	}
-	// And save it for others
-	cache.rps = rps
-	cache.created = time.Now()
+	// Else get them, without holding the entry: the cleaner, the refresher or the snapshotter must never wait
+	// for influxdb. Concurrent cold lookups of key share the same request (credentials have all been validated).
+	c.log.Debugf("[Cacher] no valid rps found for '%s': generating a new one", key)
+	value, _, err := c.lookups.Do(ctx, "rps "+key.String(), func(lookupCtx context.Context) (interface{}, error) {
+		if rps := c.serve(key, cache, endpoint, user, password); rps != nil {
+			return rps, nil // filled by a call which has just ended
+		}
+		rps, err := c.lookup(lookupCtx, endpoint, key, c.credentialKey(endpoint.Host, key.database, user, password), user, password)
+		if err != nil {
+			return nil, err
+		}
+		// And save it for others
+		cache.access.Lock()
+		c.store(key, cache, endpoint, rps, user, password)
+		cache.access.Unlock()
+		return rps, nil
+	})
+	if err != nil {
+		err = fmt.Errorf("previous rps did not exist and getting currents failed: %w", err)
+		return
+	}
+	rps = value.(influxrp.RetentionPolicies)
 	return
 }
 
+// serve returns the cached rps of cache if they have not reached the hard staleness limit
+// (the refresher updates stale entries in the background), nil otherwise
+func (c *Controller) serve(key cacheKey, cache *cached, endpoint *url.URL, user, password string) (rps influxrp.RetentionPolicies) {
+	cache.access.Lock()
+	defer cache.access.Unlock()
+	if cache.rps == nil || !time.Now().Before(cache.expiresAt) {
+		return
+	}
+	c.log.Debugf("[Cacher] rps found for '%s': using cache", key)
+	if cache.endpoint == nil {
+		// Restored from a snapshot: these validated credentials allow the refresher to catch up right away
+		c.log.Debugf("[Cacher] '%s' has been restored from the snapshot: scheduling its refresh", key)
+		cache.endpoint = endpoint
+		cache.user = user
+		cache.password = password
+		cache.refreshAt = time.Now()
+	}
+	return cache.rps
+}
+
+// cacheKey identifies a database on a backend
+type cacheKey struct {
+	backend  string
+	database string
+}
+
+func (ck cacheKey) String() string {
+	return ck.backend + "/" + ck.database
+}
+
 type cached struct {
-	access  sync.Mutex
-	rps     influxrp.RetentionPolicies
-	created time.Time
+	access    sync.Mutex
+	rps       influxrp.RetentionPolicies
+	created   time.Time
+	refreshAt time.Time
+	expiresAt time.Time // hard staleness limit
+	// Eviction, protected by the controller access
+	element *list.Element
+	owner   string
+	// Kept for background refreshes: these credentials have been validated by influxdb
+	endpoint *url.URL
+	user     string
+	password string
+	// Last background refresh error, if any
+	refreshErr error
+}
+
+// store swaps in a fresh value obtained with user & password and reports the rp changes. Caller must hold cache.access.
+func (c *Controller) store(key cacheKey, cache *cached, endpoint *url.URL, rps influxrp.RetentionPolicies, user, password string) {
+	if cache.rps != nil {
+		c.reportChanges(key, cache.rps.Diff(rps))
+	}
+	cache.rps = rps
+	cache.created = time.Now()
+	cache.refreshAt = cache.created.Add(c.jittered(c.refreshAfter))
+	cache.expiresAt = cache.created.Add(c.jittered(c.lifeLimit))
+	cache.endpoint = endpoint
+	cache.user = user
+	cache.password = password
+	cache.refreshErr = nil
+}
+
+// keyedEntry is a cache entry listed by entries
+type keyedEntry struct {
+	key   cacheKey
+	cache *cached
+}
+
+// entries lists the cache entries under c.access only: they must then be inspected without holding it
+func (c *Controller) entries() (list []keyedEntry) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	list = make([]keyedEntry, 0, len(c.cache))
+	for key, cache := range c.cache {
+		list = append(list, keyedEntry{key: key, cache: cache})
+	}
+	return
 }
 
-func (c *Controller) getOrCreate(key string) (cache *cached) {
+func (c *Controller) getOrCreate(key cacheKey, owner string) (cache *cached) {
 	var ok bool
 	c.access.Lock()
-	if cache, ok = c.cache[key]; !ok {
+	if cache, ok = c.cache[key]; ok {
+		c.touch(cache)
+	} else {
 		cache = new(cached)
-		c.cache[key] = cache
+		c.insert(key, cache, owner)
 	}
 	c.access.Unlock()
 	return
 }
+
+func (c *Controller) reportChanges(key cacheKey, diff influxrp.Diff) {
+	if diff.Empty() {
+		return
+	}
+	for _, name := range diff.Added {
+		c.log.Infof("[Cacher] '%s': retention policy '%s' has been added", key, name)
+	}
+	for _, name := range diff.Removed {
+		c.log.Infof("[Cacher] '%s': retention policy '%s' has been removed", key, name)
+	}
+	for _, change := range diff.Changed {
+		c.log.Infof("[Cacher] '%s': retention policy '%s' has changed: duration %v -> %v, shard group duration %v -> %v, replicaN %d -> %d, default %v -> %v",
+			key, change.Name, change.Old.Duration, change.New.Duration, change.Old.ShardGroupDuration, change.New.ShardGroupDuration,
+			change.Old.ReplicaN, change.New.ReplicaN, change.Old.Default, change.New.Default)
+	}
+	atomic.AddUint64(&c.rpsAdded, uint64(len(diff.Added)))
+	atomic.AddUint64(&c.rpsRemoved, uint64(len(diff.Removed)))
+	atomic.AddUint64(&c.rpsChanged, uint64(len(diff.Changed)))
+}
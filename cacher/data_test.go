@@ -0,0 +1,141 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+const showRPAnswer = `{"results":[{"statement_id":0,"series":[{"columns":["name","duration","shardGroupDuration","replicaN","default"],"values":[["autogen","168h0m0s","24h0m0s",1,true]]}]}]}`
+
+// fakeInflux answers SHOW RETENTION POLICIES, blocking the lookups of the "slow" database until release is closed
+type fakeInflux struct {
+	*httptest.Server
+	release chan struct{}
+	lookups map[string]*int32
+}
+
+func newFakeInflux(t *testing.T) (fake *fakeInflux, endpoint *url.URL) {
+	fake = &fakeInflux{
+		release: make(chan struct{}),
+		lookups: map[string]*int32{"fast": new(int32), "slow": new(int32)},
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		database := r.URL.Query().Get("db")
+		counter, found := fake.lookups[database]
+		if !found {
+			http.Error(w, `{"error":"database not found"}`, http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(counter, 1)
+		if database == "slow" {
+			select {
+			case <-fake.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprint(w, showRPAnswer)
+	}))
+	endpoint, err := url.Parse(fake.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func newTestController(t *testing.T, ctx context.Context) *Controller {
+	c, err := New(ctx, Config{
+		CheckFrequency:      time.Hour,
+		RefreshFrequency:    time.Hour,
+		RefreshAfter:        time.Hour,
+		ExpirationLimit:     24 * time.Hour,
+		MetaExpirationLimit: time.Minute,
+		AuthExpirationLimit: time.Hour,
+		Logger:              hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// within fails the test if fn does not return within a second
+func within(t *testing.T, what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("%s is blocked by a lookup in flight", what)
+	}
+}
+
+func TestColdLookupDoesNotBlockWorkers(t *testing.T) {
+	fake, endpoint := newFakeInflux(t)
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestController(t, ctx)
+	if _, err := c.GetRPs(ctx, endpoint, "fast", "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	// Credentials already validated: the rps of slow are looked up by fill
+	c.auth[c.credentialKey(endpoint.Host, "slow", "user", "pass")] = time.Now()
+	const readers = 3
+	var (
+		wg     sync.WaitGroup
+		filled int32
+	)
+	for index := 0; index < readers; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rps, err := c.GetRPs(ctx, endpoint, "slow", "user", "pass"); err != nil || !rps["autogen"].Default {
+				t.Errorf("slow lookup: got (%v, %v)", rps, err)
+			} else {
+				atomic.AddInt32(&filled, 1)
+			}
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.lookups.Stats().Followers != readers-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// Workers and other databases must not wait for the slow lookup
+	within(t, "the cleaner", c.cleanerBatch)
+	within(t, "the refresher", c.refreshBatch)
+	within(t, "the catalog", func() { c.Catalog() })
+	within(t, "a read of another database", func() {
+		if _, err := c.GetRPs(ctx, endpoint, "fast", "user", "pass"); err != nil {
+			t.Errorf("fast lookup: %v", err)
+		}
+	})
+	close(fake.release)
+	wg.Wait()
+	if filled != readers {
+		t.Fatalf("%d reader(s) got the rps of slow, expected %d", filled, readers)
+	}
+	if lookups := atomic.LoadInt32(fake.lookups["slow"]); lookups != 1 {
+		t.Errorf("concurrent cold lookups sent %d requests, expected 1", lookups)
+	}
+	// Now cached
+	if _, err := c.GetRPs(ctx, endpoint, "slow", "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if lookups := atomic.LoadInt32(fake.lookups["slow"]); lookups != 1 {
+		t.Errorf("cached rps have been looked up again (%d requests)", lookups)
+	}
+}
@@ -0,0 +1,145 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"rrinterceptor/influxquery"
+	"rrinterceptor/influxrp"
+)
+
+// LookupError is returned when the retention policies of a database could not be obtained
+type LookupError struct {
+	Kind       influxquery.Kind
+	RetryAfter time.Duration // no lookup will be tried again for this database (or credentials) before it
+	Err        error
+}
+
+func (le *LookupError) Error() string {
+	if le.RetryAfter > 0 {
+		return fmt.Sprintf("%v (%s, next try in %v)", le.Err, le.Kind, le.RetryAfter.Round(time.Millisecond))
+	}
+	return le.Err.Error()
+}
+
+// Unwrap allows to use errors.Is and errors.As on the original error
+func (le *LookupError) Unwrap() error {
+	return le.Err
+}
+
+// failure is a remembered lookup failure
+type failure struct {
+	err     error
+	kind    influxquery.Kind
+	count   int
+	retryAt time.Time
+}
+
+// lookup fetches the retention policies of key, unless a previous failure for the same database or
+// credentials is still backing off: the remembered failure is then returned without contacting influxdb.
+func (c *Controller) lookup(ctx context.Context, endpoint *url.URL, key cacheKey, credKey, user, password string) (rps influxrp.RetentionPolicies, err error) {
+	if err = c.checkFailures(key.String(), credKey); err != nil {
+		return
+	}
+	if rps, err = influxrp.GetRetentionPolicies(ctx, endpoint, key.database, user, password); err != nil {
+		err = c.recordFailure(key, credKey, err)
+		return
+	}
+	c.clearFailures(key.String(), credKey)
+	return
+}
+
+func (c *Controller) checkFailures(failureKeys ...string) error {
+	now := time.Now()
+	c.failuresAccess.Lock()
+	defer c.failuresAccess.Unlock()
+	for _, failureKey := range failureKeys {
+		if record, found := c.failures[failureKey]; found && now.Before(record.retryAt) {
+			c.negativeHits++
+			return &LookupError{
+				Kind:       record.kind,
+				RetryAfter: record.retryAt.Sub(now),
+				Err:        record.err,
+			}
+		}
+	}
+	return nil
+}
+
+// recordFailure remembers err with an exponential backoff. Authentication failures are remembered
+// for the credentials only in order not to penalize the other clients of the database.
+func (c *Controller) recordFailure(key cacheKey, credKey string, err error) error {
+	kind := influxquery.KindOf(err)
+	c.failuresAccess.Lock()
+	defer c.failuresAccess.Unlock()
+	c.lookupFailures[kind]++
+	if kind == influxquery.KindCanceled || c.backoff <= 0 {
+		return &LookupError{
+			Kind: kind,
+			Err:  err,
+		}
+	}
+	failureKey := key.String()
+	if kind == influxquery.KindUnauthorized || kind == influxquery.KindForbidden {
+		failureKey = credKey
+	}
+	record, found := c.failures[failureKey]
+	if !found {
+		if c.maxFailures > 0 && len(c.failures) >= c.maxFailures {
+			c.evictFailures()
+		}
+		record = new(failure)
+		c.failures[failureKey] = record
+	}
+	record.err = err
+	record.kind = kind
+	record.count++
+	backoff := c.backoff
+	for i := 1; i < record.count && backoff < c.backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > c.backoffMax {
+		backoff = c.backoffMax
+	}
+	record.retryAt = time.Now().Add(backoff)
+	c.log.Warningf("[Cacher] lookup #%d of '%s' failed (%s): backing off for %v: %v", record.count, key, kind, backoff, err)
+	return &LookupError{
+		Kind:       kind,
+		RetryAfter: backoff,
+		Err:        err,
+	}
+}
+
+// evictFailures makes room for a new failure: failures whose backoff is over are forgotten first,
+// then the one retried the soonest. Caller must hold c.failuresAccess.
+func (c *Controller) evictFailures() {
+	var (
+		now       = time.Now()
+		soonest   string
+		soonestAt time.Time
+	)
+	for failureKey, record := range c.failures {
+		if !now.Before(record.retryAt) {
+			delete(c.failures, failureKey)
+			continue
+		}
+		if soonest == "" || record.retryAt.Before(soonestAt) {
+			soonest = failureKey
+			soonestAt = record.retryAt
+		}
+	}
+	if len(c.failures) >= c.maxFailures && soonest != "" {
+		c.log.Debugf("[Cacher] too many failures remembered: forgetting '%s' before the end of its backoff", soonest)
+		delete(c.failures, soonest)
+	}
+}
+
+func (c *Controller) clearFailures(failureKeys ...string) {
+	c.failuresAccess.Lock()
+	for _, failureKey := range failureKeys {
+		delete(c.failures, failureKey)
+	}
+	c.failuresAccess.Unlock()
+}
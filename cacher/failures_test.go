@@ -0,0 +1,65 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+func TestFailuresBounded(t *testing.T) {
+	fake, endpoint := newFakeInflux(t)
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, Config{
+		CheckFrequency:      time.Hour,
+		RefreshFrequency:    time.Hour,
+		RefreshAfter:        time.Hour,
+		ExpirationLimit:     24 * time.Hour,
+		MetaExpirationLimit: time.Minute,
+		AuthExpirationLimit: time.Hour,
+		FailureBackoff:      time.Minute,
+		FailureBackoffMax:   time.Hour,
+		MaxFailures:         2,
+		Logger:              hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Credentials already validated: lookups fail on the unknown databases only
+	lookup := func(database string) error {
+		c.auth[c.credentialKey(endpoint.Host, database, "user", "pass")] = time.Now()
+		_, err := c.GetRPs(ctx, endpoint, database, "user", "pass")
+		return err
+	}
+	for index := 0; index < 5; index++ {
+		var lookupErr *LookupError
+		if err = lookup(fmt.Sprintf("random%d", index)); !errors.As(err, &lookupErr) {
+			t.Fatalf("expected a lookup error, got %v", err)
+		}
+		if len(c.failures) > 2 {
+			t.Fatalf("%d failures remembered, expected at most 2", len(c.failures))
+		}
+	}
+	// The latest failure is still backing off
+	if err = c.checkFailures(cacheKey{endpoint.Host, "random4"}.String()); err == nil {
+		t.Error("latest failure has been forgotten")
+	}
+	// Failures whose backoff is over make room first
+	c.failuresAccess.Lock()
+	c.failures[cacheKey{endpoint.Host, "random4"}.String()].retryAt = time.Now().Add(-time.Second)
+	c.failuresAccess.Unlock()
+	if err = lookup("random5"); err == nil {
+		t.Fatal("expected a lookup error")
+	}
+	for _, database := range []string{"random3", "random5"} {
+		if err = c.checkFailures(cacheKey{endpoint.Host, database}.String()); err == nil {
+			t.Errorf("'%s' failure has been forgotten", database)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package cacher
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Invalidate drops the cached retention policies of database on every backend (or of all databases
+// if database is empty) so that the next request fetches them again. Returns the number of dropped entries.
+// Pinned entries are loaded again by the refresher.
+func (c *Controller) Invalidate(database string) (count int) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	for key := range c.cache {
+		if database == "" || key.database == database {
+			c.remove(key)
+			count++
+		}
+	}
+	atomic.AddUint64(&c.invalidations, uint64(count))
+	if database == "" {
+		c.log.Infof("[Cacher] Invalidated all entries (%d)", count)
+	} else {
+		c.log.Infof("[Cacher] Invalidated %d entry(ies) for database '%s'", count, database)
+	}
+	return
+}
+
+func (c *Controller) poller(frequency time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.log.Debug("[Cacher] Poller: new ticker received, launching batch")
+			c.pollerBatch()
+		case <-c.ctx.Done():
+			c.log.Debug("[Cacher] Poller: cancel signal received")
+			return
+		}
+	}
+}
+
+// pollerBatch refreshes every entry regardless of its age in order to detect rp changes early
+func (c *Controller) pollerBatch() {
+	c.access.Lock()
+	keys := make([]cacheKey, 0, len(c.cache))
+	for key := range c.cache {
+		keys = append(keys, key)
+	}
+	c.access.Unlock()
+	for _, key := range keys {
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.refresh(key)
+	}
+}
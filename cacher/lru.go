@@ -0,0 +1,102 @@
+package cacher
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// insert adds cache as key on behalf of owner (the user whose request created it), evicting the least
+// recently used entries first if the global or the owner limit is reached. Caller must hold c.access.
+func (c *Controller) insert(key cacheKey, cache *cached, owner string) {
+	if c.maxEntriesPerUser > 0 && owner != "" {
+		for c.owned[owner] >= c.maxEntriesPerUser {
+			if !c.evict(owner) {
+				break
+			}
+		}
+	}
+	if c.maxEntries > 0 {
+		for len(c.cache) >= c.maxEntries {
+			if !c.evict("") {
+				break // only pinned entries left
+			}
+		}
+	}
+	cache.owner = owner
+	cache.element = c.lru.PushFront(key)
+	c.cache[key] = cache
+	if owner != "" {
+		c.owned[owner]++
+	}
+}
+
+// touch marks cache as the most recently used entry. Caller must hold c.access.
+func (c *Controller) touch(cache *cached) {
+	if cache.element != nil {
+		c.lru.MoveToFront(cache.element)
+	}
+}
+
+// remove deletes key from the cache. Caller must hold c.access.
+func (c *Controller) remove(key cacheKey) {
+	cache, found := c.cache[key]
+	if !found {
+		return
+	}
+	delete(c.cache, key)
+	if cache.element != nil {
+		c.lru.Remove(cache.element)
+	}
+	if cache.owner != "" {
+		if c.owned[cache.owner]--; c.owned[cache.owner] <= 0 {
+			delete(c.owned, cache.owner)
+		}
+	}
+}
+
+// evict removes the least recently used entry which is not pinned (and owned by owner if not empty).
+// Returns false if no entry could be evicted. Caller must hold c.access.
+func (c *Controller) evict(owner string) bool {
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		key := element.Value.(cacheKey)
+		if _, pinned := c.pinned[key]; pinned {
+			continue
+		}
+		if owner != "" && c.cache[key].owner != owner {
+			continue
+		}
+		c.log.Debugf("[Cacher] evicting least recently used entry '%s'", key)
+		c.remove(key)
+		atomic.AddUint64(&c.evictions, 1)
+		return true
+	}
+	return false
+}
+
+// removeIfEmpty cleans up the entry of key if it is still cache and has never been filled
+func (c *Controller) removeIfEmpty(key cacheKey, cache *cached) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if current, found := c.cache[key]; !found || current != cache {
+		return
+	}
+	if _, pinned := c.pinned[key]; pinned {
+		return
+	}
+	cache.access.Lock()
+	empty := cache.rps == nil
+	cache.access.Unlock()
+	if empty {
+		c.remove(key)
+	}
+}
+
+// jittered returns d reduced by a random part of up to the jitter ratio, so that entries
+// created at the same time do not all expire (and get refreshed) at the same time
+func (c *Controller) jittered(d time.Duration) time.Duration {
+	if c.jitter <= 0 {
+		return d
+	}
+	return d - time.Duration(rand.Float64()*c.jitter*float64(d))
+}
@@ -0,0 +1,113 @@
+package cacher
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rrinterceptor/influxquery"
+
+	influxcliv2 "github.com/influxdata/influxdb/client/v2"
+)
+
+// GetMeta allows to get the cached results of a meta query statement
+func (c *Controller) GetMeta(ctx context.Context, endpoint *url.URL, database, user, password, statement string) (results []influxcliv2.Result, err error) {
+	// Make sure these credentials are allowed to read this db
+	if _, err = c.authorize(ctx, endpoint, database, user, password); err != nil {
+		return
+	}
+	// First try to get cached results
+	key := endpoint.Host + " " + statement // statements embed the database
+	cache := c.getOrCreateMeta(key)
+	if results = cache.valid(c.metaLifeLimit); results != nil {
+		c.log.Debugf("[Cacher] meta results found for '%s' on '%s': using cache", statement, database)
+		return
+	}
+	// Else get them, without holding the entry (see fill)
+	c.log.Debugf("[Cacher] no meta results found for '%s' on '%s': executing it", statement, database)
+	value, _, err := c.lookups.Do(ctx, "meta "+key, func(queryCtx context.Context) (interface{}, error) {
+		if results := cache.valid(c.metaLifeLimit); results != nil {
+			return results, nil
+		}
+		results, err := influxquery.Query(queryCtx, endpoint, database, user, password, statement)
+		if err != nil {
+			return nil, err
+		}
+		if results == nil {
+			results = []influxcliv2.Result{}
+		}
+		// And save it for others
+		cache.access.Lock()
+		cache.results = results
+		cache.created = time.Now()
+		cache.access.Unlock()
+		return results, nil
+	})
+	if err != nil {
+		err = fmt.Errorf("previous meta results did not exist and getting currents failed: %w", err)
+		return
+	}
+	results = value.([]influxcliv2.Result)
+	return
+}
+
+type cachedMeta struct {
+	access  sync.Mutex
+	results []influxcliv2.Result
+	created time.Time
+	element *list.Element // within metaLRU
+}
+
+// valid returns the results of cache if they have not expired, nil otherwise
+func (cache *cachedMeta) valid(lifeLimit time.Duration) []influxcliv2.Result {
+	cache.access.Lock()
+	defer cache.access.Unlock()
+	if cache.results != nil && time.Since(cache.created) < lifeLimit {
+		return cache.results
+	}
+	return nil
+}
+
+// metaEntries returns a copy of the meta entries map: they must then be inspected without holding c.access
+func (c *Controller) metaEntries() (entries map[string]*cachedMeta) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	entries = make(map[string]*cachedMeta, len(c.meta))
+	for key, cache := range c.meta {
+		entries[key] = cache
+	}
+	return
+}
+
+// getOrCreateMeta returns the entry of key, evicting the least recently used entries first
+// if the meta entries limit is reached: statements are built from client matchers
+func (c *Controller) getOrCreateMeta(key string) (cache *cachedMeta) {
+	var ok bool
+	c.access.Lock()
+	defer c.access.Unlock()
+	if cache, ok = c.meta[key]; ok {
+		c.metaLRU.MoveToFront(cache.element)
+		return
+	}
+	if c.maxMetaEntries > 0 {
+		for len(c.meta) >= c.maxMetaEntries {
+			c.removeMeta(c.metaLRU.Back().Value.(string))
+			atomic.AddUint64(&c.metaEvictions, 1)
+		}
+	}
+	cache = &cachedMeta{element: c.metaLRU.PushFront(key)}
+	c.meta[key] = cache
+	return
+}
+
+// removeMeta deletes the meta results of key. Caller must hold c.access.
+func (c *Controller) removeMeta(key string) {
+	if cache, found := c.meta[key]; found {
+		delete(c.meta, key)
+		c.metaLRU.Remove(cache.element)
+	}
+}
@@ -0,0 +1,46 @@
+package cacher
+
+import (
+	"context"
+	"net/url"
+)
+
+// pin holds the service credentials used to keep a pinned entry loaded
+type pin struct {
+	endpoint *url.URL
+	user     string
+	password string
+}
+
+// Pin loads the retention policies of database on endpoint with the provided service credentials and
+// keeps them cached: pinned entries are never removed by the cleaner (or an invalidation for good) and
+// keep being refreshed in the background with these credentials.
+func (c *Controller) Pin(ctx context.Context, endpoint *url.URL, database, user, password string) (err error) {
+	if _, err = c.GetRPs(ctx, endpoint, database, user, password); err != nil {
+		return
+	}
+	key := cacheKey{
+		backend:  endpoint.Host,
+		database: database,
+	}
+	c.access.Lock()
+	c.pinned[key] = pin{
+		endpoint: endpoint,
+		user:     user,
+		password: password,
+	}
+	c.access.Unlock()
+	c.log.Infof("[Cacher] '%s' has been loaded and pinned", key)
+	return
+}
+
+// pinnedKeys returns a copy of the pinned keys
+func (c *Controller) pinnedKeys() (keys map[cacheKey]struct{}) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	keys = make(map[cacheKey]struct{}, len(c.pinned))
+	for key := range c.pinned {
+		keys[key] = struct{}{}
+	}
+	return
+}
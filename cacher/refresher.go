@@ -0,0 +1,100 @@
+package cacher
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"rrinterceptor/influxrp"
+)
+
+const refreshTimeout = 30 * time.Second
+
+func (c *Controller) refresher(frequency time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.log.Debug("[Cacher] Refresher: new ticker received, launching batch")
+			c.refreshBatch()
+		case <-c.ctx.Done():
+			c.log.Debug("[Cacher] Refresher: cancel signal received")
+			return
+		}
+	}
+}
+
+func (c *Controller) refreshBatch() {
+	// Select the entries old enough to be refreshed and the pinned ones which are missing
+	now := time.Now()
+	var keys []cacheKey
+	pinned := c.pinnedKeys()
+	for _, entry := range c.entries() {
+		entry.cache.access.Lock()
+		if entry.cache.rps != nil && !now.Before(entry.cache.refreshAt) {
+			keys = append(keys, entry.key)
+		} else if _, isPinned := pinned[entry.key]; isPinned && entry.cache.rps == nil {
+			keys = append(keys, entry.key)
+		}
+		entry.cache.access.Unlock()
+	}
+	c.access.Lock()
+	for key := range pinned {
+		if _, found := c.cache[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	c.access.Unlock()
+	// Refresh them one by one to spare influxdb
+	for _, key := range keys {
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.refresh(key)
+	}
+}
+
+// refresh fetches the current rps of key without blocking readers and swaps them in on success.
+// On failure, the last good value is kept until the cleaner removes it at the hard staleness limit.
+// Pinned entries are always refreshed with their service credentials.
+func (c *Controller) refresh(key cacheKey) {
+	c.access.Lock()
+	cache, found := c.cache[key]
+	servicePin, pinned := c.pinned[key]
+	if !found && pinned {
+		cache = new(cached)
+		c.insert(key, cache, "")
+		found = true
+	}
+	c.access.Unlock()
+	if !found {
+		return
+	}
+	cache.access.Lock()
+	endpoint, user, password := cache.endpoint, cache.user, cache.password
+	cache.access.Unlock()
+	if pinned {
+		endpoint, user, password = servicePin.endpoint, servicePin.user, servicePin.password
+	}
+	if endpoint == nil {
+		return
+	}
+	// Fetch without holding the entry
+	ctx, cancel := context.WithTimeout(c.ctx, refreshTimeout)
+	defer cancel()
+	rps, err := influxrp.GetRetentionPolicies(ctx, endpoint, key.database, user, password)
+	cache.access.Lock()
+	defer cache.access.Unlock()
+	if err != nil {
+		atomic.AddUint64(&c.refreshFailures, 1)
+		cache.refreshErr = err
+		c.log.Warningf("[Cacher] Refresher: can't refresh rps of '%s' (keeping the %v old ones): %v",
+			key, time.Since(cache.created), err)
+		return
+	}
+	atomic.AddUint64(&c.refreshSuccesses, 1)
+	c.log.Debugf("[Cacher] Refresher: rps of '%s' refreshed", key)
+	c.store(key, cache, endpoint, rps, user, password)
+}
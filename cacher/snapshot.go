@@ -0,0 +1,168 @@
+package cacher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"rrinterceptor/influxrp"
+)
+
+// snapshotVersion 2 keys the credentials hashes with the credentials secret: unkeyed ones from version 1 are ignored
+const (
+	snapshotVersion        = 2
+	snapshotVersionUnkeyed = 1
+)
+
+// snapshot is the on disk format of the cache. Credentials are never written: only their keyed
+// hashes (if the secret is configured), in order to accept them again while influxdb is unavailable.
+type snapshot struct {
+	Version        int                  `json:"version"`
+	Created        time.Time            `json:"created"`
+	Entries        []snapshotEntry      `json:"entries"`
+	Authorizations map[string]time.Time `json:"authorizations"`
+}
+
+type snapshotEntry struct {
+	Backend  string                     `json:"backend"`
+	Database string                     `json:"database"`
+	Created  time.Time                  `json:"created"`
+	RPs      influxrp.RetentionPolicies `json:"rps"`
+}
+
+func (c *Controller) snapshotter(frequency time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.log.Debug("[Cacher] Snapshotter: new ticker received, writing snapshot")
+			c.writeSnapshot()
+		case <-c.ctx.Done():
+			c.log.Debug("[Cacher] Snapshotter: cancel signal received, writing last snapshot")
+			c.writeSnapshot()
+			return
+		}
+	}
+}
+
+func (c *Controller) writeSnapshot() {
+	start := time.Now()
+	snap := snapshot{
+		Version:        snapshotVersion,
+		Created:        start,
+		Authorizations: make(map[string]time.Time),
+	}
+	// Copy the entries
+	for _, entry := range c.entries() {
+		entry.cache.access.Lock()
+		if entry.cache.rps != nil {
+			snap.Entries = append(snap.Entries, snapshotEntry{
+				Backend:  entry.key.backend,
+				Database: entry.key.database,
+				Created:  entry.cache.created,
+				RPs:      entry.cache.rps,
+			})
+		}
+		entry.cache.access.Unlock()
+	}
+	if c.persistAuth {
+		c.authAccess.Lock()
+		for credKey, validated := range c.auth {
+			snap.Authorizations[credKey] = validated
+		}
+		c.authAccess.Unlock()
+	}
+	// Write it
+	if err := writeFileAtomic(c.snapshotFile, snap); err != nil {
+		c.log.Errorf("[Cacher] Snapshotter: can't write snapshot: %v", err)
+		return
+	}
+	c.log.Debugf("[Cacher] Snapshotter: %d entries and %d authorizations written to '%s' in %v",
+		len(snap.Entries), len(snap.Authorizations), c.snapshotFile, time.Since(start))
+}
+
+// writeFileAtomic writes data as JSON to a temporary file before renaming it to path
+// in order to never leave a partially written snapshot behind
+func writeFileAtomic(path string, data interface{}) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = json.NewEncoder(tmp).Encode(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't encode snapshot: %v", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't sync temporary file: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("can't close temporary file: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("can't rename temporary file: %v", err)
+	}
+	return
+}
+
+// loadSnapshot restores the entries of the snapshot which have not reached the hard staleness limit.
+// As credentials are not persisted, each entry is refreshed in the background once the first
+// client with valid credentials reads it (and served as is meanwhile).
+func (c *Controller) loadSnapshot() (err error) {
+	raw, err := ioutil.ReadFile(c.snapshotFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.log.Infof("[Cacher] no snapshot found at '%s': starting empty", c.snapshotFile)
+			err = nil
+		}
+		return
+	}
+	var snap snapshot
+	if err = json.Unmarshal(raw, &snap); err != nil {
+		return fmt.Errorf("can't decode snapshot: %v", err)
+	}
+	switch snap.Version {
+	case snapshotVersion:
+	case snapshotVersionUnkeyed:
+		snap.Authorizations = nil
+	default:
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	now := time.Now()
+	var loaded int
+	for _, entry := range snap.Entries {
+		if now.Sub(entry.Created) >= c.lifeLimit || entry.RPs == nil {
+			continue
+		}
+		c.insert(cacheKey{
+			backend:  entry.Backend,
+			database: entry.Database,
+		}, &cached{
+			rps:       entry.RPs,
+			created:   entry.Created,
+			refreshAt: entry.Created.Add(c.jittered(c.refreshAfter)),
+			expiresAt: entry.Created.Add(c.jittered(c.lifeLimit)),
+		}, "")
+		loaded++
+	}
+	if c.persistAuth {
+		for credKey, validated := range snap.Authorizations {
+			if now.Sub(validated) < c.lifeLimit {
+				c.auth[credKey] = validated
+			}
+		}
+	}
+	c.log.Infof("[Cacher] %d entries (out of %d) and %d authorizations restored from the snapshot written at %v",
+		loaded, len(snap.Entries), len(c.auth), snap.Created)
+	return
+}
@@ -0,0 +1,101 @@
+package coalescer
+
+import (
+	"context"
+	"sync"
+)
+
+// Group deduplicates identical concurrent calls: the first caller of a key (the leader) triggers
+// the call while the following ones (the followers) wait for its result. Every caller waits
+// with its own context and the call itself is canceled once all of its callers have given up.
+type Group struct {
+	access    sync.Mutex
+	calls     map[string]*call
+	leaders   uint64
+	followers uint64
+	abandons  uint64
+}
+
+type call struct {
+	done    chan struct{}
+	value   interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Stats contains the group counters
+type Stats struct {
+	Leaders   uint64 // calls actually executed
+	Followers uint64 // callers which got the result of another one call
+	Abandons  uint64 // callers whose context ended before the result was available
+	InFlight  int
+}
+
+// New returns an initialized and ready to use group
+func New() *Group {
+	return &Group{
+		calls: make(map[string]*call),
+	}
+}
+
+// Stats returns the current counters of the group
+func (g *Group) Stats() Stats {
+	g.access.Lock()
+	defer g.access.Unlock()
+	return Stats{
+		Leaders:   g.leaders,
+		Followers: g.followers,
+		Abandons:  g.abandons,
+		InFlight:  len(g.calls),
+	}
+}
+
+// Do executes fn once for all the concurrent callers of key and returns its results to each of them.
+// The value is shared between callers and must not be modified. shared is true for followers.
+func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (value interface{}, shared bool, err error) {
+	g.access.Lock()
+	c, shared := g.calls[key]
+	if shared {
+		g.followers++
+	} else {
+		g.leaders++
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &call{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = c
+		go g.execute(callCtx, key, c, fn)
+	}
+	c.waiters++
+	g.access.Unlock()
+	// Wait for the result or the end of our own context
+	select {
+	case <-c.done:
+		return c.value, shared, c.err
+	case <-ctx.Done():
+		g.access.Lock()
+		g.abandons++
+		if c.waiters--; c.waiters == 0 {
+			// Nobody is waiting anymore: cancel the call and let the next caller start a new one
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.access.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+func (g *Group) execute(ctx context.Context, key string, c *call, fn func(ctx context.Context) (interface{}, error)) {
+	c.value, c.err = fn(ctx)
+	c.cancel()
+	g.access.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.access.Unlock()
+	close(c.done)
+}
@@ -0,0 +1,179 @@
+package coalescer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it is true or fails the test after a second
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDoShared(t *testing.T) {
+	g := New()
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+	const callers = 10
+	var (
+		wg     sync.WaitGroup
+		shared int32
+	)
+	for index := 0; index < callers; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, isShared, err := g.Do(context.Background(), "key", fn)
+			if err != nil || value != "value" {
+				t.Errorf("got (%v, %v), expected the leader result", value, err)
+			}
+			if isShared {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	waitFor(t, "the followers", func() bool { return g.Stats().Followers == callers-1 })
+	close(release)
+	wg.Wait()
+	if calls != 1 || shared != callers-1 {
+		t.Errorf("got %d call(s) and %d shared result(s), expected 1 and %d", calls, shared, callers-1)
+	}
+	if stats := g.Stats(); stats.Leaders != 1 || stats.InFlight != 0 || stats.Abandons != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	// completed calls are not cached
+	if _, isShared, _ := g.Do(context.Background(), "key", func(context.Context) (interface{}, error) { return nil, nil }); isShared {
+		t.Error("a call after completion must be executed again")
+	}
+}
+
+func TestDoSharedError(t *testing.T) {
+	g := New()
+	failure := errors.New("failure")
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		return nil, failure
+	}
+	errs := make(chan error, 2)
+	for index := 0; index < 2; index++ {
+		go func() {
+			_, _, err := g.Do(context.Background(), "key", fn)
+			errs <- err
+		}()
+	}
+	waitFor(t, "the follower", func() bool { return g.Stats().Followers == 1 })
+	close(release)
+	for index := 0; index < 2; index++ {
+		if err := <-errs; err != failure {
+			t.Errorf("caller #%d: got %v, expected the leader error", index, err)
+		}
+	}
+}
+
+func TestDoAbandon(t *testing.T) {
+	g := New()
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "value", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	leaderCtx, leaderCancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(leaderCtx, "key", fn)
+		leaderErr <- err
+	}()
+	waitFor(t, "the leader", func() bool { return g.Stats().InFlight == 1 })
+	followerValue := make(chan interface{}, 1)
+	go func() {
+		value, _, _ := g.Do(context.Background(), "key", fn)
+		followerValue <- value
+	}()
+	waitFor(t, "the follower", func() bool { return g.Stats().Followers == 1 })
+	// the leader giving up must not cancel the call while the follower waits for it
+	leaderCancel()
+	if err := <-leaderErr; err != context.Canceled {
+		t.Errorf("leader: got %v, expected context.Canceled", err)
+	}
+	close(release)
+	if value := <-followerValue; value != "value" {
+		t.Errorf("follower: got %v, expected the call result", value)
+	}
+	if stats := g.Stats(); stats.Abandons != 1 {
+		t.Errorf("got %d abandon(s), expected 1", stats.Abandons)
+	}
+}
+
+func TestDoAllAbandon(t *testing.T) {
+	g := New()
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		g.Do(ctx, "key", fn)
+		close(done)
+	}()
+	waitFor(t, "the call", func() bool { return g.Stats().InFlight == 1 })
+	cancel()
+	<-done
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the call has not been canceled once all of its callers gave up")
+	}
+	// the next caller starts a new call
+	value, shared, err := g.Do(context.Background(), "key", func(context.Context) (interface{}, error) { return "new", nil })
+	if value != "new" || shared || err != nil {
+		t.Errorf("got (%v, %v, %v), expected a new call", value, shared, err)
+	}
+	if stats := g.Stats(); stats.Leaders != 2 {
+		t.Errorf("got %d leader(s), expected 2", stats.Leaders)
+	}
+}
+
+func TestDoDistinctKeys(t *testing.T) {
+	g := New()
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		return nil, nil
+	}
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if _, shared, _ := g.Do(context.Background(), key, fn); shared {
+				t.Errorf("key '%s': distinct keys must not share their calls", key)
+			}
+		}(key)
+	}
+	waitFor(t, "both calls", func() bool { return g.Stats().InFlight == 2 })
+	close(release)
+	wg.Wait()
+}
@@ -13,6 +13,7 @@ require (
 	github.com/influxdata/influxdb v1.5.1-0.20190520205816-37e19677b5ff
 	github.com/miolini/datacounter v1.0.2
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/common v0.4.1
 	github.com/prometheus/prometheus v1.8.2-0.20190710134608-e5b22494857d
 	golang.org/x/net v0.0.0-20190606173856-1492cefac77f // indirect
 	golang.org/x/sys v0.0.0-20190606203320-7fc4e5ec1444 // indirect
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+)
+
+type invalidateResponse struct {
+	Database    string `json:"database,omitempty"`
+	Invalidated int    `json:"invalidated"`
+	Purged      int    `json:"purged_results"`
+}
+
+// invalidateHandler drops the cached retention policies and read results of the 'db' parameter, or of every database if not set
+func invalidateHandler(w *loggingResponseWriter, r *http.Request) {
+	log.Debugf("[InvalidateHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	database := r.URL.Query().Get("db")
+	count := cache.Invalidate(database)
+	var purged int
+	if resultCache != nil {
+		purged = resultCache.Purge(database)
+	}
+	respondAPI(w, invalidateResponse{
+		Database:    database,
+		Invalidated: count,
+		Purged:      purged,
+	})
+	log.Infof("[InvalidateHandler] '%s %s' from '%s': %d cache entry(ies) invalidated, %d result(s) purged", r.Method, r.URL, r.RemoteAddr, count, purged)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rrinterceptor/promutils"
+
+	"github.com/miolini/datacounter"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// debugReadRequest is the JSON counterpart of a prometheus remote read request.
+// Either Queries or Selectors (with Start, End and optional Step) must be used.
+type debugReadRequest struct {
+	Queries   []debugQuery `json:"queries,omitempty"`
+	Selectors []string     `json:"selectors,omitempty"`
+	Start     flexString   `json:"start,omitempty"`
+	End       flexString   `json:"end,omitempty"`
+	Step      flexString   `json:"step,omitempty"`
+}
+
+type debugQuery struct {
+	StartTimestampMs int64          `json:"start_timestamp_ms"`
+	EndTimestampMs   int64          `json:"end_timestamp_ms"`
+	Matchers         []debugMatcher `json:"matchers"`
+	Hints            *debugHints    `json:"hints,omitempty"`
+}
+
+type debugMatcher struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type debugHints struct {
+	StepMs  int64  `json:"step_ms,omitempty"`
+	Func    string `json:"func,omitempty"`
+	StartMs int64  `json:"start_ms,omitempty"`
+	EndMs   int64  `json:"end_ms,omitempty"`
+}
+
+type debugReadResponse struct {
+	Database string            `json:"database"`
+	Results  []debugReadResult `json:"results"`
+}
+
+type debugReadResult struct {
+	Query           debugQuery    `json:"query"`
+	RetentionPolicy string        `json:"retentionPolicy"`
+	Backend         string        `json:"backend"`
+	Series          []debugSeries `json:"series"`
+}
+
+type debugSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Samples [][2]interface{}  `json:"samples"` // [timestamp ms, value as string]
+}
+
+// flexString accepts both JSON strings and numbers
+type flexString string
+
+func (fs *flexString) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		*fs = flexString(str)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	*fs = flexString(number)
+	return nil
+}
+
+func debugReadHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[DebugReadHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "DebugReadHandler")
+	if !proceed {
+		return
+	}
+	// Extract the JSON request
+	body, err := readJSONBody(w, r)
+	if err != nil {
+		if err == errBodyTooLarge {
+			rejectAPIRead(w, r, rejectBodyTooLarge, apiErrorTooLarge, fmt.Errorf("%v: the limit is %d bytes", err, readMaxBody))
+		} else if r.Context().Err() == nil {
+			respondAPIError(w, apiErrorInternal, fmt.Errorf("can't extract body: %v", err))
+		}
+		return
+	}
+	var debugReq debugReadRequest
+	if err = json.Unmarshal(body, &debugReq); err != nil {
+		respondAPIError(w, apiErrorBadData, fmt.Errorf("can't unmarshal body as JSON: %v", err))
+		return
+	}
+	req, err := debugReq.toReadRequest()
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	if reason, err := checkReadLimits(&req); err != nil {
+		rejectAPIRead(w, r, reason, apiErrorBadData, err)
+		return
+	}
+	if log.IsDebugShown() {
+		log.Debugf("[DebugReadHandler] Prometheus request breakdown: \n%s", promutils.BreakdownPromReadRequest(req))
+	}
+	// Same path as the smart read
+	rp, rps, err := selectRetentionPolicy(r.Context(), ci, req.Queries)
+	if err != nil {
+		if r.Context().Err() == nil {
+			if rps == nil {
+				_, errorType := lookupErrorStatus(w, err)
+				respondAPIError(w, errorType, err)
+			} else {
+				respondAPIError(w, apiErrorBadData, err)
+			}
+		}
+		return
+	}
+	rateKey, proceed := allowAPIRead(w, r, "DebugReadHandler", ci)
+	if !proceed {
+		return
+	}
+	wCounter := datacounter.NewResponseWriterCounter(w)
+	defer func() {
+		consumeReadBytes(rateKey, int64(wCounter.Count()))
+	}()
+	if !admitAPIRead(w, r, "DebugReadHandler", ci, rp, req.Queries) {
+		return
+	}
+	resp, err := readSeries(withReadPriority(r.Context(), readPriority(r, req.Queries)), ci, rp, &req)
+	if err != nil {
+		if r.Context().Err() == nil && !respondAPILimitError(w, err) {
+			respondAPIError(w, apiErrorUnavaible, fmt.Errorf("can't fetch series from '%s' retention policy: %v", rp, err))
+		}
+		return
+	}
+	if respondAPILimitError(w, getResponseLimits(ci.database).check(resp)) {
+		return
+	}
+	// Convert the answer
+	debugResp := debugReadResponse{
+		Database: ci.database,
+		Results:  make([]debugReadResult, len(resp.Results)),
+	}
+	for index, result := range resp.Results {
+		debugResp.Results[index] = debugReadResult{
+			Query:           newDebugQuery(req.Queries[index]),
+			RetentionPolicy: rp,
+			Backend:         influxURL.Host,
+			Series:          newDebugSeries(result),
+		}
+	}
+	setRoutingHeaders(w, rp)
+	respondAPI(wCounter, debugResp)
+	log.Infof("[DebugReadHandler] '%s %s' from '%s': answered %d result(s) from '%s' in %v", r.Method, r.URL, r.RemoteAddr, len(debugResp.Results), rp, time.Since(start))
+}
+
+func (dr debugReadRequest) toReadRequest() (req prompb.ReadRequest, err error) {
+	if len(dr.Queries) == 0 && len(dr.Selectors) == 0 {
+		err = errors.New("either 'queries' or 'selectors' must be provided")
+		return
+	}
+	// Raw queries
+	for index, dq := range dr.Queries {
+		query := &prompb.Query{
+			StartTimestampMs: dq.StartTimestampMs,
+			EndTimestampMs:   dq.EndTimestampMs,
+			Matchers:         make([]*prompb.LabelMatcher, len(dq.Matchers)),
+		}
+		for matcherIndex, dm := range dq.Matchers {
+			matcherType, found := parseDebugMatcherType(dm.Type)
+			if !found {
+				err = fmt.Errorf("query #%d: matcher #%d: unknown type '%s'", index+1, matcherIndex+1, dm.Type)
+				return
+			}
+			query.Matchers[matcherIndex] = &prompb.LabelMatcher{
+				Type:  matcherType,
+				Name:  dm.Name,
+				Value: dm.Value,
+			}
+		}
+		if dq.Hints != nil {
+			query.Hints = &prompb.ReadHints{
+				StepMs:  dq.Hints.StepMs,
+				Func:    dq.Hints.Func,
+				StartMs: dq.Hints.StartMs,
+				EndMs:   dq.Hints.EndMs,
+			}
+		}
+		req.Queries = append(req.Queries, query)
+	}
+	if len(dr.Selectors) == 0 {
+		return
+	}
+	// PromQL style selectors
+	if dr.Start == "" || dr.End == "" {
+		err = errors.New("'start' and 'end' are mandatory with 'selectors'")
+		return
+	}
+	rangeStart, err := parseTime(string(dr.Start))
+	if err != nil {
+		err = fmt.Errorf("invalid 'start': %v", err)
+		return
+	}
+	rangeEnd, err := parseTime(string(dr.End))
+	if err != nil {
+		err = fmt.Errorf("invalid 'end': %v", err)
+		return
+	}
+	params := &storage.SelectParams{
+		Start: promutils.GetTSFromTime(rangeStart),
+		End:   promutils.GetTSFromTime(rangeEnd),
+	}
+	if dr.Step != "" {
+		var step time.Duration
+		if step, err = parseDuration(string(dr.Step)); err != nil {
+			err = fmt.Errorf("invalid 'step': %v", err)
+			return
+		}
+		params.Step = int64(step / time.Millisecond)
+	}
+	for _, selector := range dr.Selectors {
+		matchers, parseErr := promql.ParseMetricSelector(selector)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid selector '%s': %v", selector, parseErr)
+			return
+		}
+		query, convertErr := remote.ToQuery(params.Start, params.End, matchers, params)
+		if convertErr != nil {
+			err = fmt.Errorf("can't convert selector '%s' to remote read query: %v", selector, convertErr)
+			return
+		}
+		req.Queries = append(req.Queries, query)
+	}
+	return
+}
+
+func parseDebugMatcherType(matcherType string) (parsed prompb.LabelMatcher_Type, found bool) {
+	switch strings.ToUpper(matcherType) {
+	case "EQ", "=", "":
+		return prompb.LabelMatcher_EQ, true
+	case "NEQ", "!=":
+		return prompb.LabelMatcher_NEQ, true
+	case "RE", "=~":
+		return prompb.LabelMatcher_RE, true
+	case "NRE", "!~":
+		return prompb.LabelMatcher_NRE, true
+	default:
+		return
+	}
+}
+
+func newDebugQuery(query *prompb.Query) (dq debugQuery) {
+	dq.StartTimestampMs = query.StartTimestampMs
+	dq.EndTimestampMs = query.EndTimestampMs
+	dq.Matchers = make([]debugMatcher, len(query.Matchers))
+	for index, matcher := range query.Matchers {
+		dq.Matchers[index] = debugMatcher{
+			Type:  matcher.Type.String(),
+			Name:  matcher.Name,
+			Value: matcher.Value,
+		}
+	}
+	if query.Hints != nil {
+		dq.Hints = &debugHints{
+			StepMs:  query.Hints.StepMs,
+			Func:    query.Hints.Func,
+			StartMs: query.Hints.StartMs,
+			EndMs:   query.Hints.EndMs,
+		}
+	}
+	return
+}
+
+func newDebugSeries(result *prompb.QueryResult) (series []debugSeries) {
+	series = make([]debugSeries, len(result.Timeseries))
+	for index, ts := range result.Timeseries {
+		series[index].Labels = make(map[string]string, len(ts.Labels))
+		for _, label := range ts.Labels {
+			series[index].Labels[label.Name] = label.Value
+		}
+		series[index].Samples = make([][2]interface{}, len(ts.Samples))
+		for sampleIndex, sample := range ts.Samples {
+			series[index].Samples[sampleIndex] = [2]interface{}{
+				sample.Timestamp,
+				strconv.FormatFloat(sample.Value, 'f', -1, 64),
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"rrinterceptor/influxrp"
+	"rrinterceptor/promutils"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type explainResponse struct {
+	Database       string             `json:"database"`
+	Backend        string             `json:"backend"`
+	Queries        []explainQuery     `json:"queries"`
+	SelectionStart explainTimestamp   `json:"selectionStart"`
+	SelectionStep  string             `json:"selectionStep,omitempty"`
+	Candidates     []explainCandidate `json:"candidates"`
+	Rejected       []explainRejection `json:"rejected"`
+	Winner         string             `json:"winner"`
+}
+
+type explainQuery struct {
+	Query          debugQuery       `json:"query"`
+	EffectiveStart explainTimestamp `json:"effectiveStart"`
+	EffectiveEnd   explainTimestamp `json:"effectiveEnd"`
+}
+
+type explainTimestamp struct {
+	Ms   int64     `json:"ms"`
+	Time time.Time `json:"time"`
+}
+
+type explainRP struct {
+	Name               string `json:"name"`
+	Duration           string `json:"duration"`
+	ShardGroupDuration string `json:"shardGroupDuration"`
+	ReplicaN           int64  `json:"replicaN"`
+	Default            bool   `json:"default"`
+}
+
+type explainCandidate struct {
+	explainRP
+	Delta      string `json:"delta,omitempty"`
+	Infinite   bool   `json:"infinite"`
+	Resolution string `json:"resolution,omitempty"`
+}
+
+type explainRejection struct {
+	explainRP
+	Reason string `json:"reason"`
+}
+
+func newExplainTimestamp(ms int64) explainTimestamp {
+	return explainTimestamp{
+		Ms:   ms,
+		Time: promutils.GetTimeFromTS(ms).UTC(),
+	}
+}
+
+func newExplainRP(name string, rp influxrp.RetentionPolicy) explainRP {
+	return explainRP{
+		Name:               name,
+		Duration:           rp.Duration.String(),
+		ShardGroupDuration: rp.ShardGroupDuration.String(),
+		ReplicaN:           rp.ReplicaN,
+		Default:            rp.Default,
+	}
+}
+
+// explainHandler takes the same payload as the smart read (or its JSON counterpart
+// if Content-Type is application/json) and returns the routing decision without proxying
+func explainHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[ExplainHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	// Extract prom request
+	var (
+		req     prompb.ReadRequest
+		proceed bool
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		body, err := readJSONBody(w, r)
+		if err != nil {
+			if err == errBodyTooLarge {
+				rejectAPIRead(w, r, rejectBodyTooLarge, apiErrorTooLarge, fmt.Errorf("%v: the limit is %d bytes", err, readMaxBody))
+			} else if r.Context().Err() == nil {
+				respondAPIError(w, apiErrorInternal, fmt.Errorf("can't extract body: %v", err))
+			}
+			return
+		}
+		var debugReq debugReadRequest
+		if err = json.Unmarshal(body, &debugReq); err != nil {
+			respondAPIError(w, apiErrorBadData, fmt.Errorf("can't unmarshal body as JSON: %v", err))
+			return
+		}
+		if req, err = debugReq.toReadRequest(); err != nil {
+			respondAPIError(w, apiErrorBadData, err)
+			return
+		}
+		if reason, err := checkReadLimits(&req); err != nil {
+			rejectAPIRead(w, r, reason, apiErrorBadData, err)
+			return
+		}
+	} else {
+		var body *readBody
+		if req, body, proceed = extractPromReq(w, r); !proceed {
+			return
+		}
+		body.Close()
+	}
+	// Extract influxrp connection infos
+	ci, proceed := extractConInfo(w, r, "ExplainHandler")
+	if !proceed {
+		return
+	}
+	// Get the RPs and explain the decision
+	rps, err := cache.GetRPs(r.Context(), influxURL, ci.database, ci.user, ci.password)
+	if err != nil {
+		if r.Context().Err() == nil {
+			_, errorType := lookupErrorStatus(w, err)
+			respondAPIError(w, errorType, fmt.Errorf("can't get retention policies for '%s' db: %v", ci.database, err))
+		}
+		return
+	}
+	oldestStart, decision, err := explainRetentionPolicy(req.Queries, rps)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	// Build the answer
+	explain := explainResponse{
+		Database:       ci.database,
+		Backend:        influxURL.Host,
+		Queries:        make([]explainQuery, len(req.Queries)),
+		SelectionStart: newExplainTimestamp(oldestStart),
+		Candidates:     make([]explainCandidate, len(decision.Candidates)),
+		Rejected:       make([]explainRejection, len(decision.Rejected)),
+		Winner:         decision.Winner,
+	}
+	if decision.Step > 0 {
+		explain.SelectionStep = decision.Step.String()
+	}
+	for index, query := range req.Queries {
+		explain.Queries[index] = explainQuery{
+			Query:          newDebugQuery(query),
+			EffectiveStart: newExplainTimestamp(promutils.GetEffectiveStart(query)),
+			EffectiveEnd:   newExplainTimestamp(promutils.GetEffectiveEnd(query)),
+		}
+	}
+	for index, candidate := range decision.Candidates {
+		explain.Candidates[index] = explainCandidate{
+			explainRP: newExplainRP(candidate.Name, candidate.RetentionPolicy),
+			Infinite:  candidate.Infinite,
+		}
+		if !candidate.Infinite {
+			explain.Candidates[index].Delta = candidate.Delta.String()
+		}
+		if candidate.Resolution > 0 {
+			explain.Candidates[index].Resolution = candidate.Resolution.String()
+		}
+	}
+	for index, rejection := range decision.Rejected {
+		explain.Rejected[index] = explainRejection{
+			explainRP: newExplainRP(rejection.Name, rejection.RetentionPolicy),
+			Reason:    rejection.Reason,
+		}
+	}
+	respondAPI(w, explain)
+	log.Infof("[ExplainHandler] '%s %s' from '%s': explained '%s' selection in %v", r.Method, r.URL, r.RemoteAddr, decision.Winner, time.Since(start))
+}
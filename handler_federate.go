@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"rrinterceptor/promutils"
+
+	"github.com/miolini/datacounter"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+const federateLookback = 5 * time.Minute // same as the prometheus default lookback delta
+
+func federateHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[FederateHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "FederateHandler")
+	if !proceed {
+		return
+	}
+	// Extract parameters
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("can't parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		http.Error(w, "no match[] parameter provided", http.StatusBadRequest)
+		return
+	}
+	at, err := parseTimeParam(r, "at", start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	atMs := promutils.GetTSFromTime(at)
+	fromMs := promutils.GetTSFromTime(at.Add(-federateLookback))
+	// Build the remote read request: one query per selector
+	var (
+		matchers []*labels.Matcher
+		query    *prompb.Query
+	)
+	req := prompb.ReadRequest{Queries: make([]*prompb.Query, len(r.Form["match[]"]))}
+	for index, selector := range r.Form["match[]"] {
+		if matchers, err = promql.ParseMetricSelector(selector); err != nil {
+			http.Error(w, fmt.Sprintf("invalid match[] parameter '%s': %v", selector, err), http.StatusBadRequest)
+			return
+		}
+		if query, err = remote.ToQuery(fromMs, atMs, matchers, nil); err != nil {
+			http.Error(w, fmt.Sprintf("can't convert match[] parameter '%s' to remote read query: %v", selector, err), http.StatusBadRequest)
+			return
+		}
+		req.Queries[index] = query
+	}
+	go updateDriftStats(req)
+	// Select the RP and fetch the series
+	rp, rps, err := selectRetentionPolicy(r.Context(), ci, req.Queries)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Errorf("[FederateHandler] %v", err)
+			if rps == nil {
+				statusCode, _ := lookupErrorStatus(w, err)
+				http.Error(w, err.Error(), statusCode)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		}
+		return
+	}
+	rateKey, proceed := allowRead(w, r, "FederateHandler", ci)
+	if !proceed {
+		return
+	}
+	wCounter := datacounter.NewResponseWriterCounter(w)
+	defer func() {
+		consumeReadBytes(rateKey, int64(wCounter.Count()))
+	}()
+	if !admitRead(w, r, "FederateHandler", ci, rp, req.Queries) {
+		return
+	}
+	resp, err := readSeries(withReadPriority(r.Context(), readPriority(r, req.Queries)), ci, rp, &req)
+	if err != nil {
+		if r.Context().Err() == nil && !respondLimitError(w, err) {
+			log.Errorf("[FederateHandler] can't fetch series from '%s' retention policy: %v", rp, err)
+			http.Error(w, fmt.Sprintf("can't fetch series from '%s' retention policy: %v", rp, err), upstreamFailureStatus(w, err))
+		}
+		return
+	}
+	if respondLimitError(w, getResponseLimits(ci.database).check(resp)) {
+		return
+	}
+	// Keep the latest sample of each series at 'at'
+	unique := make(map[string]*prompb.TimeSeries)
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			sample, found := latestSample(ts.Samples, atMs)
+			if !found {
+				continue
+			}
+			unique[promutils.GetLabelsKey(ts.Labels)] = &prompb.TimeSeries{
+				Labels:  ts.Labels,
+				Samples: []prompb.Sample{sample},
+			}
+		}
+	}
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*prompb.TimeSeries, len(keys))
+	for index, key := range keys {
+		series[index] = unique[key]
+	}
+	// Render them
+	setRoutingHeaders(w, rp)
+	w.Header().Set("Content-Type", promutils.OpenMetricsContentType)
+	if err = promutils.WriteOpenMetrics(wCounter, series); err != nil {
+		log.Errorf("[FederateHandler] can't write OpenMetrics answer: %v", err)
+		return
+	}
+	log.Infof("[FederateHandler] '%s %s' from '%s': answered %d series from '%s' in %v", r.Method, r.URL, r.RemoteAddr, len(series), rp, time.Since(start))
+}
+
+func latestSample(samples []prompb.Sample, atMs int64) (latest prompb.Sample, found bool) {
+	for _, sample := range samples {
+		if sample.Timestamp > atMs {
+			continue
+		}
+		if !found || sample.Timestamp >= latest.Timestamp {
+			latest = sample
+			found = true
+		}
+	}
+	return
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"rrinterceptor/influxmeta"
+	"rrinterceptor/promutils"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func seriesHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[SeriesHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "SeriesHandler")
+	if !proceed {
+		return
+	}
+	// Extract parameters
+	if err := r.ParseForm(); err != nil {
+		respondAPIError(w, apiErrorBadData, fmt.Errorf("can't parse form: %v", err))
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		respondAPIError(w, apiErrorBadData, errors.New("no match[] parameter provided"))
+		return
+	}
+	selectors := make([][]*labels.Matcher, len(r.Form["match[]"]))
+	for index, selector := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			respondAPIError(w, apiErrorBadData, fmt.Errorf("invalid match[] parameter '%s': %v", selector, err))
+			return
+		}
+		selectors[index] = matchers
+	}
+	rangeStart, err := parseMetaRange(r)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	rp, err := metaRetentionPolicy(r.Context(), ci, rangeStart)
+	if err != nil {
+		respondMetaError(w, r, "SeriesHandler", err)
+		return
+	}
+	// Get series of each selector and merge them
+	var (
+		selectorSeries []map[string]string
+		seriesKey      string
+	)
+	unique := make(map[string]map[string]string)
+	for _, matchers := range selectors {
+		if selectorSeries, err = getSeries(r.Context(), ci, rp, matchers); err != nil {
+			respondMetaError(w, r, "SeriesHandler", err)
+			return
+		}
+		for _, labelSet := range selectorSeries {
+			seriesKey = labels.FromMap(labelSet).String()
+			unique[seriesKey] = labelSet
+		}
+	}
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]map[string]string, len(keys))
+	for index, key := range keys {
+		series[index] = unique[key]
+	}
+	respondAPI(w, series)
+	log.Infof("[SeriesHandler] '%s %s' from '%s': answered %d series from '%s' in %v", r.Method, r.URL, r.RemoteAddr, len(series), rp, time.Since(start))
+}
+
+func labelsHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[LabelsHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "LabelsHandler")
+	if !proceed {
+		return
+	}
+	// Extract parameters
+	rangeStart, err := parseMetaRange(r)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	rp, err := metaRetentionPolicy(r.Context(), ci, rangeStart)
+	if err != nil {
+		respondMetaError(w, r, "LabelsHandler", err)
+		return
+	}
+	// Get labels
+	names, err := getLabelNames(r.Context(), ci, rp)
+	if err != nil {
+		respondMetaError(w, r, "LabelsHandler", err)
+		return
+	}
+	respondAPI(w, names)
+	log.Infof("[LabelsHandler] '%s %s' from '%s': answered %d label names from '%s' in %v", r.Method, r.URL, r.RemoteAddr, len(names), rp, time.Since(start))
+}
+
+func labelValuesHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[LabelValuesHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "LabelValuesHandler")
+	if !proceed {
+		return
+	}
+	// Extract parameters
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+	if !model.LabelNameRE.MatchString(name) {
+		respondAPIError(w, apiErrorBadData, fmt.Errorf("invalid label name: '%s'", name))
+		return
+	}
+	rangeStart, err := parseMetaRange(r)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	rp, err := metaRetentionPolicy(r.Context(), ci, rangeStart)
+	if err != nil {
+		respondMetaError(w, r, "LabelValuesHandler", err)
+		return
+	}
+	// Get values
+	values, err := getLabelValues(r.Context(), ci, rp, name)
+	if err != nil {
+		respondMetaError(w, r, "LabelValuesHandler", err)
+		return
+	}
+	respondAPI(w, values)
+	log.Infof("[LabelValuesHandler] '%s %s' from '%s': answered %d values from '%s' in %v", r.Method, r.URL, r.RemoteAddr, len(values), rp, time.Since(start))
+}
+
+func respondMetaError(w *loggingResponseWriter, r *http.Request, handlerName string, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+	log.Errorf("[%s] %v", handlerName, err)
+	_, errorType := lookupErrorStatus(w, err)
+	respondAPIError(w, errorType, err)
+}
+
+// parseMetaRange returns the optional start of the request, its end being only validated:
+// influxdb metadata statements are not bounded in time
+func parseMetaRange(r *http.Request) (rangeStart time.Time, err error) {
+	if rangeStart, err = parseTimeParam(r, "start", time.Time{}); err != nil {
+		return
+	}
+	rangeEnd, err := parseTimeParam(r, "end", time.Time{})
+	if err != nil {
+		return
+	}
+	if !rangeStart.IsZero() && !rangeEnd.IsZero() && rangeEnd.Before(rangeStart) {
+		err = errors.New("end timestamp must not be before start time")
+	}
+	return
+}
+
+// metaRetentionPolicy returns the retention policy covering start, or the longest one if start is not set
+func metaRetentionPolicy(ctx context.Context, ci conInfo, start time.Time) (rp string, err error) {
+	rps, err := cache.GetRPs(ctx, influxURL, ci.database, ci.user, ci.password)
+	if err != nil {
+		err = fmt.Errorf("can't get retention policies for '%s' db: %w", ci.database, err)
+		return
+	}
+	if start.IsZero() {
+		rp = rps.GetLongest()
+	} else {
+		rp = rps.GetClosest(promutils.GetTSFromTime(start))
+	}
+	if rp == "" {
+		err = fmt.Errorf("can't get a valid retention policy for '%s' db within %d retention policies", ci.database, len(rps))
+	}
+	return
+}
+
+func getLabelNames(ctx context.Context, ci conInfo, rp string) (names []string, err error) {
+	results, err := cache.GetMeta(ctx, influxURL, ci.database, ci.user, ci.password, influxmeta.ShowTagKeys(ci.database, rp))
+	if err != nil {
+		err = fmt.Errorf("can't get tag keys: %w", err)
+		return
+	}
+	if names, err = influxmeta.ExtractTagKeys(results); err != nil {
+		err = fmt.Errorf("can't extract tag keys: %v", err)
+		return
+	}
+	names = append(names, influxmeta.MetricNameLabel)
+	sort.Strings(names)
+	return
+}
+
+func getLabelValues(ctx context.Context, ci conInfo, rp, name string) (values []string, err error) {
+	if name == influxmeta.MetricNameLabel {
+		return getMeasurements(ctx, ci)
+	}
+	results, err := cache.GetMeta(ctx, influxURL, ci.database, ci.user, ci.password, influxmeta.ShowTagValues(ci.database, rp, name))
+	if err != nil {
+		err = fmt.Errorf("can't get tag values: %w", err)
+		return
+	}
+	if values, err = influxmeta.ExtractTagValues(results); err != nil {
+		err = fmt.Errorf("can't extract tag values: %v", err)
+	}
+	return
+}
+
+func getMeasurements(ctx context.Context, ci conInfo) (measurements []string, err error) {
+	results, err := cache.GetMeta(ctx, influxURL, ci.database, ci.user, ci.password, influxmeta.ShowMeasurements(ci.database))
+	if err != nil {
+		err = fmt.Errorf("can't get measurements: %w", err)
+		return
+	}
+	if measurements, err = influxmeta.ExtractMeasurements(results); err != nil {
+		err = fmt.Errorf("can't extract measurements: %v", err)
+	}
+	return
+}
+
+// resolveMeasurements returns the measurements targeted by the metric name matchers
+func resolveMeasurements(ctx context.Context, ci conInfo, matchers []*labels.Matcher) (measurements []string, err error) {
+	for _, matcher := range matchers {
+		if matcher.Name == influxmeta.MetricNameLabel && matcher.Type == labels.MatchEqual {
+			measurements = []string{matcher.Value}
+			return
+		}
+	}
+	all, err := getMeasurements(ctx, ci)
+	if err != nil {
+		return
+	}
+	for _, measurement := range all {
+		if matchLabel(matchers, influxmeta.MetricNameLabel, measurement) {
+			measurements = append(measurements, measurement)
+		}
+	}
+	return
+}
+
+func getSeries(ctx context.Context, ci conInfo, rp string, matchers []*labels.Matcher) (series []map[string]string, err error) {
+	// Resolve the measurements targeted by the metric name matchers
+	measurements, err := resolveMeasurements(ctx, ci, matchers)
+	if err != nil || len(measurements) == 0 {
+		return
+	}
+	// Get their series
+	results, err := cache.GetMeta(ctx, influxURL, ci.database, ci.user, ci.password, influxmeta.ShowSeries(ci.database, rp, measurements, matchers))
+	if err != nil {
+		err = fmt.Errorf("can't get series: %w", err)
+		return
+	}
+	all, err := influxmeta.ExtractSeries(results)
+	if err != nil {
+		err = fmt.Errorf("can't extract series: %v", err)
+		return
+	}
+	// Enforce prometheus semantics (absent labels match empty values)
+	for _, labelSet := range all {
+		selected := true
+		for _, matcher := range matchers {
+			if !matcher.Matches(labelSet[matcher.Name]) {
+				selected = false
+				break
+			}
+		}
+		if selected {
+			series = append(series, labelSet)
+		}
+	}
+	return
+}
+
+func matchLabel(matchers []*labels.Matcher, name, value string) bool {
+	for _, matcher := range matchers {
+		if matcher.Name == name && !matcher.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
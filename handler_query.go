@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"rrinterceptor/admission"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+const maxQueryRangePoints = 11000 // same limit as prometheus
+
+type queryData struct {
+	ResultType promql.ValueType `json:"resultType"`
+	Result     promql.Value     `json:"result"`
+}
+
+func queryHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[QueryHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "QueryHandler")
+	if !proceed {
+		return
+	}
+	// Extract parameters
+	ts, err := parseTimeParam(r, "time", start)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	ctx, cancel, err := queryContext(r)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	defer cancel()
+	// Create and run the query
+	qry, err := promqlEngine.NewInstantQuery(smartQueryable{ci: ci, r: r}, r.FormValue("query"), ts)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	executeQuery(ctx, w, r, qry, "QueryHandler", start)
+}
+
+func queryRangeHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[QueryRangeHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	ci, proceed := extractConInfo(w, r, "QueryRangeHandler")
+	if !proceed {
+		return
+	}
+	// Extract parameters
+	if r.FormValue("start") == "" || r.FormValue("end") == "" || r.FormValue("step") == "" {
+		respondAPIError(w, apiErrorBadData, errors.New("'start', 'end' and 'step' parameters are mandatory"))
+		return
+	}
+	rangeStart, err := parseTimeParam(r, "start", time.Time{})
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	rangeEnd, err := parseTimeParam(r, "end", time.Time{})
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	if rangeEnd.Before(rangeStart) {
+		respondAPIError(w, apiErrorBadData, errors.New("end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, fmt.Errorf("invalid 'step' parameter: %v", err))
+		return
+	}
+	if step <= 0 {
+		respondAPIError(w, apiErrorBadData, errors.New("zero or negative query resolution step widths are not accepted: try a positive integer"))
+		return
+	}
+	if rangeEnd.Sub(rangeStart)/step > maxQueryRangePoints {
+		respondAPIError(w, apiErrorBadData, fmt.Errorf("exceeded maximum resolution of %d points per timeseries: try decreasing the query resolution (?step=XX)", maxQueryRangePoints))
+		return
+	}
+	ctx, cancel, err := queryContext(r)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	defer cancel()
+	// Create and run the query
+	qry, err := promqlEngine.NewRangeQuery(smartQueryable{ci: ci, r: r}, r.FormValue("query"), rangeStart, rangeEnd, step)
+	if err != nil {
+		respondAPIError(w, apiErrorBadData, err)
+		return
+	}
+	executeQuery(ctx, w, r, qry, "QueryRangeHandler", start)
+}
+
+// queryContext returns the request context, limited by the optional timeout parameter
+func queryContext(r *http.Request) (ctx context.Context, cancel context.CancelFunc, err error) {
+	if value := r.FormValue("timeout"); value != "" {
+		var timeout time.Duration
+		if timeout, err = parseDuration(value); err != nil {
+			err = fmt.Errorf("invalid 'timeout' parameter: %v", err)
+			return
+		}
+		ctx, cancel = context.WithTimeout(r.Context(), timeout)
+		return
+	}
+	ctx, cancel = context.WithCancel(r.Context())
+	return
+}
+
+func executeQuery(ctx context.Context, w *loggingResponseWriter, r *http.Request, qry promql.Query, handlerName string, start time.Time) {
+	defer qry.Close()
+	res := qry.Exec(ctx)
+	if res.Err != nil {
+		if r.Context().Err() != nil {
+			log.Infof("[%s] '%s %s' from '%s': client closed the connection after %v: aborting", handlerName, r.Method, r.URL, r.RemoteAddr, time.Since(start))
+			return
+		}
+		var (
+			rateErr   *rateLimitError
+			rejection *admission.Rejection
+			limitErr  *responseLimitError
+			selectErr *selectError
+		)
+		switch {
+		case errors.As(res.Err, &rateErr):
+			logRateLimited(w, r, handlerName, rateErr)
+			respondAPIError(w, apiErrorTooMany, rateErr)
+		case errors.As(res.Err, &rejection):
+			w.Header().Set("X-RRInterceptor-Rejected-By", rejection.Rule)
+			respondAPIError(w, apiErrorBadData, rejection)
+		case errors.As(res.Err, &limitErr):
+			respondAPIError(w, apiErrorExec, limitErr) // already counted by the select
+		case errors.As(res.Err, &selectErr):
+			respondSelectError(w, selectErr)
+		default:
+			respondQueryError(w, res.Err)
+		}
+		log.Infof("[%s] '%s %s' from '%s': answered '%d %s' in %v because of an error: %v", handlerName, r.Method, r.URL, r.RemoteAddr, w.statusCode, http.StatusText(w.statusCode), time.Since(start), res.Err)
+		return
+	}
+	respondAPI(w, queryData{
+		ResultType: res.Value.Type(),
+		Result:     res.Value,
+	})
+	log.Infof("[%s] '%s %s' from '%s': answered '%d %s' in %v", handlerName, r.Method, r.URL, r.RemoteAddr, w.statusCode, http.StatusText(w.statusCode), time.Since(start))
+}
+
+// respondSelectError answers a failed select with the status the other read routes use for the same failure
+func respondSelectError(w http.ResponseWriter, selectErr *selectError) {
+	switch selectErr.stage {
+	case selectLookup:
+		_, errorType := lookupErrorStatus(w, selectErr.err)
+		respondAPIError(w, errorType, selectErr)
+	case selectBadData:
+		respondAPIError(w, apiErrorBadData, selectErr)
+	default:
+		if upstreamFailureStatus(w, selectErr.err) == http.StatusServiceUnavailable {
+			respondAPIError(w, apiErrorUnavaible, selectErr)
+		} else {
+			respondAPIError(w, apiErrorBadGateway, selectErr)
+		}
+	}
+}
+
+// respondQueryError answers the errors of the promql engine itself
+func respondQueryError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case promql.ErrQueryCanceled:
+		respondAPIError(w, apiErrorCanceled, err)
+	case promql.ErrQueryTimeout:
+		respondAPIError(w, apiErrorTimeout, err)
+	case promql.ErrStorage:
+		respondAPIError(w, apiErrorInternal, err)
+	default:
+		respondAPIError(w, apiErrorExec, err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rrinterceptor/cacher"
+	"rrinterceptor/influxquery"
+	"rrinterceptor/scheduler"
+)
+
+func TestRespondSelectError(t *testing.T) {
+	cases := []struct {
+		err        *selectError
+		statusCode int
+		retryAfter string
+	}{
+		{&selectError{stage: selectLookup, err: fmt.Errorf("can't get retention policies: %w",
+			&cacher.LookupError{Kind: influxquery.KindUnauthorized, Err: errors.New("authorization failed")})}, http.StatusUnauthorized, ""},
+		{&selectError{stage: selectLookup, err: fmt.Errorf("can't get retention policies: %w",
+			&cacher.LookupError{Kind: influxquery.KindUnavailable, RetryAfter: 1500 * time.Millisecond, Err: errors.New("timeout")})}, http.StatusServiceUnavailable, "2"},
+		{&selectError{stage: selectBadData, err: errors.New("no retention policy covers the query")}, http.StatusBadRequest, ""},
+		{&selectError{stage: selectUpstream, err: fmt.Errorf("can't fetch series: %w", scheduler.ErrQueueTimeout)}, http.StatusServiceUnavailable, "1"},
+		{&selectError{stage: selectUpstream, err: errors.New("connection refused")}, http.StatusBadGateway, ""},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		respondSelectError(recorder, c.err)
+		if recorder.Code != c.statusCode || recorder.Header().Get("Retry-After") != c.retryAfter {
+			t.Errorf("'%v': got %d (Retry-After '%s'), expected %d (Retry-After '%s')", c.err,
+				recorder.Code, recorder.Header().Get("Retry-After"), c.statusCode, c.retryAfter)
+		}
+	}
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"strings"
 	"time"
 
@@ -15,7 +13,6 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
-	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hekmon/cunits"
 	"github.com/miolini/datacounter"
 	"github.com/prometheus/prometheus/prompb"
@@ -30,8 +27,10 @@ func readHandler(w *loggingResponseWriter, r *http.Request) {
 		retentionPolicy string
 		stepStart       time.Time
 		streamSize      cunits.Bits
+		rateKey         string
 	)
 	defer func() {
+		consumeReadBytes(rateKey, int64(streamSize.Byte()))
 		if r.Context().Err() != nil {
 			log.Infof("[ReadHandler] '%s %s' from '%s': client closed the connection after %v: aborting", r.Method, r.URL, r.RemoteAddr, time.Since(start))
 		} else if err != nil {
@@ -42,35 +41,44 @@ func readHandler(w *loggingResponseWriter, r *http.Request) {
 	}()
 	stepStart = time.Now()
 	// Extract prom request (first as it will close the original body)
-	req, proceed := extractPromReq(w, r)
+	req, body, proceed := extractPromReq(w, r)
 	if !proceed {
 		return
 	}
+	releaseBody := true
+	defer func() {
+		if releaseBody {
+			body.Close()
+		}
+	}()
 	go updateDriftStats(req)
 	// Extract influxrp connection infos
-	database, user, password, proceed := extractConInfo(w, r)
+	ci, proceed := extractConInfo(w, r, "ReadHandler")
 	if !proceed {
 		return
 	}
 	log.Debugf("[ReadHandler] Extracting request data took %v", time.Since(stepStart))
-	// Get the retention policies for this db
+	// Get the best RP for this db
 	stepStart = time.Now()
-	retentionPolicies, err := cache.GetRPs(r.Context(), influxURL, database, user, password)
+	retentionPolicy, retentionPolicies, err := selectRetentionPolicy(r.Context(), ci, req.Queries)
 	if err != nil {
 		if r.Context().Err() == nil {
-			log.Errorf("[ReadHandler] can't get retention policies for '%s' db: %v", database, err)
-			http.Error(w, fmt.Sprintf("can't get retention policies for '%s' db: %v", database, err), http.StatusInternalServerError)
+			log.Errorf("[ReadHandler] %v", err)
+			if retentionPolicies == nil {
+				statusCode, _ := lookupErrorStatus(w, err)
+				http.Error(w, err.Error(), statusCode)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
 		}
 		return
 	}
-	// Get the best RP
-	retentionPolicy, err = getBestRetentionPolicy(req.Queries, retentionPolicies)
-	if err != nil {
-		log.Errorf("[ReadHandler] can't select the best retention policy: %v", err)
-		http.Error(w, fmt.Sprintf("can't select the best retention policy: %v", err), http.StatusBadRequest)
+	log.Debugf("[ReadHandler] Getting retention policy took %v", time.Since(stepStart))
+	// Credentials have been validated by the retention policy selection: rate limit the client
+	if rateKey, proceed = allowRead(w, r, "ReadHandler", ci); !proceed {
+		err = errors.New("rate limited")
 		return
 	}
-	log.Debugf("[ReadHandler] Getting retention policy took %v", time.Since(stepStart))
 	// Debug the full request
 	if log.IsDebugShown() {
 		// request
@@ -82,12 +90,12 @@ func readHandler(w *loggingResponseWriter, r *http.Request) {
 			}
 		}
 		buff.WriteString(" -> influxrp infos\n")
-		buff.WriteString(fmt.Sprintf("Database: %s\n", database))
-		buff.WriteString(fmt.Sprintf("User:     %s\n", user))
-		if len(password) > 10 {
-			buff.WriteString(fmt.Sprintf("Password: %s...%s\n", password[:3], password[len(password)-3:]))
+		buff.WriteString(fmt.Sprintf("Database: %s\n", ci.database))
+		buff.WriteString(fmt.Sprintf("User:     %s\n", ci.user))
+		if len(ci.password) > 10 {
+			buff.WriteString(fmt.Sprintf("Password: %s...%s\n", ci.password[:3], ci.password[len(ci.password)-3:]))
 		} else {
-			buff.WriteString(fmt.Sprintf("Password: %s\n", password))
+			buff.WriteString(fmt.Sprintf("Password: %s\n", ci.password))
 		}
 		buff.WriteString(" -> REQUEST\n")
 		buff.WriteString(promutils.BreakdownPromReadRequest(req))
@@ -98,56 +106,126 @@ func readHandler(w *loggingResponseWriter, r *http.Request) {
 			buff.WriteString(fmt.Sprintf("\t%s: Duration(%v) ShardGroupDuration(%v) ReplicaN(%d) Default(%v)\n",
 				rpName, rp.Duration, rp.ShardGroupDuration, rp.ReplicaN, rp.Default))
 		}
-		log.Debugf("[ReadHandler] %s: '%s' database: '%s' has been selected within the following rentention policies:\n%s", *influxURL, database, retentionPolicy, buff.String())
+		log.Debugf("[ReadHandler] %s: '%s' database: '%s' has been selected within the following rentention policies:\n%s", influxURL, ci.database, retentionPolicy, buff.String())
 	}
-	httpProxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = influxURL.Scheme
-			req.URL.Host = influxURL.Host
-			req.URL.Path = "/api/v1/prom/read"
-			urlQuery := req.URL.Query()
-			urlQuery.Set("rp", retentionPolicy)
-			req.URL.RawQuery = urlQuery.Encode()
-		},
-		Transport: cleanhttp.DefaultTransport(),
+	setRoutingHeaders(w, retentionPolicy)
+	if !admitRead(w, r, "ReadHandler", ci, retentionPolicy, req.Queries) {
+		err = errors.New("rejected by admission control")
+		return
 	}
+	limits := getResponseLimits(ci.database)
+	readCtx := withReadPriority(r.Context(), readPriority(r, req.Queries))
+	// Decoded path: answer is assembled from the result cache, the upstream fresh data and the sharded sub-ranges
+	if resultCache != nil || shardedFetchThreshold > 0 {
+		var (
+			resp    *prompb.ReadResponse
+			written int
+		)
+		if resp, err = readSeries(readCtx, ci, retentionPolicy, &req); err != nil {
+			if r.Context().Err() == nil && !respondLimitError(w, err) {
+				log.Errorf("[ReadHandler] can't fetch series from '%s' retention policy: %v", retentionPolicy, err)
+				http.Error(w, fmt.Sprintf("can't fetch series from '%s' retention policy: %v", retentionPolicy, err), upstreamFailureStatus(w, err))
+			}
+			return
+		}
+		if err = limits.check(resp); err == nil {
+			written, err = respondRemoteRead(w, resp, limits.bytes)
+		}
+		respondLimitError(w, err)
+		streamSize = cunits.Bits(written) * cunits.Byte
+		return
+	}
+	// Coalesced path: identical in flight reads share the same buffered upstream answer
+	if readCoalescer != nil {
+		var (
+			answer  *upstreamRead
+			written int
+		)
+		// the upstream request may outlive this one if coalesced
+		if answer, err = fetchUpstreamRead(readCtx, ci, retentionPolicy, &req, body.Detach()); err != nil {
+			if r.Context().Err() == nil && !respondLimitError(w, err) {
+				log.Errorf("[ReadHandler] can't fetch series from '%s' retention policy: %v", retentionPolicy, err)
+				http.Error(w, fmt.Sprintf("can't fetch series from '%s' retention policy: %v", retentionPolicy, err), upstreamFailureStatus(w, err))
+			}
+			return
+		}
+		if limits.enabled() && answer.statusCode == http.StatusOK {
+			if err = limits.checkEncoded(answer.body); err != nil {
+				if !respondLimitError(w, err) {
+					log.Errorf("[ReadHandler] can't verify the answer from '%s' retention policy: %v", retentionPolicy, err)
+					http.Error(w, err.Error(), http.StatusBadGateway)
+				}
+				return
+			}
+		}
+		written, err = respondUpstreamRead(w, answer)
+		streamSize = cunits.Bits(written) * cunits.Byte
+		return
+	}
+	// Streaming path: the restored compressed body is forwarded as is
+	release, err := acquireUpstream(readCtx, retentionPolicy)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Errorf("[ReadHandler] can't stream series from '%s' retention policy: %v", retentionPolicy, err)
+			http.Error(w, fmt.Sprintf("can't stream series from '%s' retention policy: %v", retentionPolicy, err), upstreamFailureStatus(w, err))
+		}
+		return
+	}
+	defer release()
+	releaseBody = false // the transport closes it once sent, maybe after ServeHTTP returned
 	wCounter := datacounter.NewResponseWriterCounter(w)
-	httpProxy.ServeHTTP(wCounter, r)
+	proxyCtx := context.WithValue(readCtx, rpContextKey, retentionPolicy)
+	if limits.enabled() {
+		proxyCtx = context.WithValue(proxyCtx, limitsContextKey, limits)
+	}
+	httpProxy.ServeHTTP(wCounter, r.WithContext(proxyCtx))
 	streamSize = cunits.Bits(wCounter.Count()) * cunits.Byte
 }
 
-func extractConInfo(w *loggingResponseWriter, r *http.Request) (database, user, password string, proceed bool) {
+func extractConInfo(w *loggingResponseWriter, r *http.Request, handlerName string) (ci conInfo, proceed bool) {
 	if values, found := r.URL.Query()["db"]; found && len(values) != 0 {
-		database = values[0]
+		ci.database = values[0]
 	} else {
 		if r.Context().Err() == nil {
-			log.Errorf("[ReadHandler] no database found")
+			log.Errorf("[%s] no database found", handlerName)
 			http.Error(w, "can't extract database from URI parameters", http.StatusBadRequest)
 		}
 		return
 	}
-	if user, password, proceed = r.BasicAuth(); !proceed && r.Context().Err() == nil {
-		log.Errorf("[ReadHandler] can't extract auth basic")
+	if ci.user, ci.password, proceed = r.BasicAuth(); !proceed && r.Context().Err() == nil {
+		log.Errorf("[%s] can't extract auth basic", handlerName)
 		http.Error(w, fmt.Sprintf("can't extract auth from header"), http.StatusBadRequest)
 	}
 	return
 }
 
-func extractPromReq(w *loggingResponseWriter, r *http.Request) (req prompb.ReadRequest, proceed bool) {
+// extractPromReq decodes the remote read request of r and restores the compressed one as r.Body.
+// The restored body must be closed once the request is not needed anymore in order to recycle its buffer.
+func extractPromReq(w *loggingResponseWriter, r *http.Request) (req prompb.ReadRequest, body *readBody, proceed bool) {
 	// Extract body
-	rawBody, err := ioutil.ReadAll(r.Body)
+	body, err := newReadBody(r.Body, r.ContentLength, readMaxBody)
 	if err != nil {
-		if r.Context().Err() == nil {
+		if err == errBodyTooLarge {
+			rejectRead(w, r, rejectBodyTooLarge, http.StatusRequestEntityTooLarge,
+				fmt.Errorf("%v: the limit is %d bytes", err, readMaxBody))
+		} else if r.Context().Err() == nil {
 			log.Errorf("[ReadHandler] can't extract body: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
-	defer r.Body.Close()
+	defer func() {
+		// The buffer is only handed to the caller if the request goes on
+		if !proceed {
+			body.Close()
+		}
+	}()
+	r.Body.Close()
 	// Restore body
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(rawBody))
+	r.Body = body
+	r.ContentLength = int64(body.Len())
 	// Snappy decompress
-	reqBuf, err := snappy.Decode(nil, rawBody)
+	decodedLen, err := snappy.DecodedLen(body.Bytes())
 	if err != nil {
 		if r.Context().Err() == nil {
 			log.Errorf("[ReadHandler] can't decode body as snappy: %v", err)
@@ -155,7 +233,22 @@ func extractPromReq(w *loggingResponseWriter, r *http.Request) (req prompb.ReadR
 		}
 		return
 	}
-	// Protobuff unmarshall
+	if readMaxDecoded > 0 && int64(decodedLen) > readMaxDecoded {
+		rejectRead(w, r, rejectDecodedTooLarge, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("decoded request would be %d bytes while the limit is %d", decodedLen, readMaxDecoded))
+		return
+	}
+	decoded := getDecodedBuffer(decodedLen)
+	defer recycleDecoded(decoded)
+	reqBuf, err := snappy.Decode(*decoded, body.Bytes())
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Errorf("[ReadHandler] can't decode body as snappy: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	// Protobuff unmarshall (strings are copied: the decoded buffer can be recycled)
 	if err := proto.Unmarshal(reqBuf, &req); err != nil {
 		if r.Context().Err() == nil {
 			log.Errorf("[ReadHandler] can't unmarshal snappy decompressed body as protobuff: %v", err)
@@ -163,12 +256,28 @@ func extractPromReq(w *loggingResponseWriter, r *http.Request) (req prompb.ReadR
 		}
 		return
 	}
+	if reason, err := checkReadLimits(&req); err != nil {
+		rejectRead(w, r, reason, http.StatusBadRequest, err)
+		return
+	}
 	// Done
 	proceed = true
 	return
 }
 
 func getBestRetentionPolicy(queries []*prompb.Query, rps influxrp.RetentionPolicies) (rp string, err error) {
+	oldestStart, decision, err := explainRetentionPolicy(queries, rps)
+	if err != nil {
+		return
+	}
+	if rp = decision.Winner; rp == "" {
+		err = fmt.Errorf("can't get a valid retention policy for query starting at %dms in %d retention policies",
+			oldestStart, len(rps))
+	}
+	return
+}
+
+func explainRetentionPolicy(queries []*prompb.Query, rps influxrp.RetentionPolicies) (oldestStart int64, decision influxrp.Decision, err error) {
 	if len(queries) == 0 {
 		err = errors.New("there must be at least one query")
 		return
@@ -177,16 +286,17 @@ func getBestRetentionPolicy(queries []*prompb.Query, rps influxrp.RetentionPolic
 		err = errors.New("there must be at least one retention policy")
 		return
 	}
-	var oldestStart int64
+	var step int64
 	for index, query := range queries {
 		if index == 0 || query.StartTimestampMs < oldestStart {
 			oldestStart = query.StartTimestampMs
 		}
+		// The finest step drives the selection, a query without step forbids downsampled data
+		queryStep := query.GetHints().GetStepMs()
+		if index == 0 || queryStep < step {
+			step = queryStep
+		}
 	}
-	rp = rps.GetClosest(oldestStart)
-	if rp == "" {
-		err = fmt.Errorf("can't get a valid retention policy for query starting at %dms in %d retention policies",
-			oldestStart, len(rps))
-	}
+	decision = rps.ExplainWithStep(oldestStart, time.Duration(step)*time.Millisecond, rpResolutions)
 	return
 }
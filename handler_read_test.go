@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// benchReadRequest returns a compressed remote read request of nbQueries queries
+func benchReadRequest(b *testing.B, nbQueries int) []byte {
+	req := prompb.ReadRequest{Queries: make([]*prompb.Query, nbQueries)}
+	for index := range req.Queries {
+		req.Queries[index] = &prompb.Query{
+			StartTimestampMs: 1565000000000,
+			EndTimestampMs:   1565003600000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: fmt.Sprintf("node_cpu_seconds_total_%d", index)},
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"},
+				{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "server-[0-9]+.example.com:9100"},
+			},
+			Hints: &prompb.ReadHints{StepMs: 60000, StartMs: 1565000000000, EndMs: 1565003600000},
+		}
+	}
+	raw, err := proto.Marshal(&req)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return snappy.Encode(nil, raw)
+}
+
+// extractPromReqReadAll is the former extraction: the body is read with ioutil.ReadAll,
+// restored with a NopCloser and decoded within a fresh buffer
+func extractPromReqReadAll(w *loggingResponseWriter, r *http.Request) (req prompb.ReadRequest, proceed bool) {
+	rawBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(rawBody))
+	reqBuf, err := snappy.Decode(nil, rawBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = proto.Unmarshal(reqBuf, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proceed = true
+	return
+}
+
+func BenchmarkExtractPromReq(b *testing.B) {
+	for _, nbQueries := range []int{1, 10, 100} {
+		compressed := benchReadRequest(b, nbQueries)
+		b.Run(fmt.Sprintf("pooled/%d", nbQueries), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				r := httptest.NewRequest(http.MethodPost, "/smartread?db=influx", bytes.NewReader(compressed))
+				b.StartTimer()
+				_, body, proceed := extractPromReq(newLoggingResponseWriter(httptest.NewRecorder()), r)
+				if !proceed {
+					b.Fatal("request has been refused")
+				}
+				body.Close()
+			}
+		})
+		b.Run(fmt.Sprintf("readall/%d", nbQueries), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				r := httptest.NewRequest(http.MethodPost, "/smartread?db=influx", bytes.NewReader(compressed))
+				b.StartTimer()
+				if _, proceed := extractPromReqReadAll(newLoggingResponseWriter(httptest.NewRecorder()), r); !proceed {
+					b.Fatal("request has been refused")
+				}
+			}
+		})
+	}
+}
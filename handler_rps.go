@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+type rpsCatalogEntry struct {
+	Database          string       `json:"database"`
+	Backend           string       `json:"backend"`
+	CacheAge          string       `json:"cacheAge"`
+	Cached            time.Time    `json:"cached"`
+	NextRefresh       time.Time    `json:"nextRefresh"`
+	Expires           time.Time    `json:"expires"`
+	Stale             bool         `json:"stale"`
+	Pinned            bool         `json:"pinned"`
+	RefreshError      string       `json:"refreshError,omitempty"`
+	RetentionPolicies []rpsCatalog `json:"retentionPolicies"`
+}
+
+type rpsCatalog struct {
+	explainRP
+	Coverage rpsCoverage `json:"coverage"`
+}
+
+type rpsCoverage struct {
+	Start *time.Time `json:"start"` // nil for infinite retention policies
+	End   time.Time  `json:"end"`
+}
+
+// rpsHandler lists the retention policies currently held by the cacher, for every user: admin listener only
+func rpsHandler(w *loggingResponseWriter, r *http.Request) {
+	log.Debugf("[RPsHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	now := time.Now()
+	catalog := cache.Catalog()
+	entries := make([]rpsCatalogEntry, len(catalog))
+	for index, cached := range catalog {
+		entries[index] = rpsCatalogEntry{
+			Database:          cached.Database,
+			Backend:           cached.Backend,
+			CacheAge:          now.Sub(cached.Created).String(),
+			Cached:            cached.Created,
+			NextRefresh:       cached.NextRefresh,
+			Expires:           cached.Expires,
+			Stale:             cached.Stale,
+			Pinned:            cached.Pinned,
+			RetentionPolicies: make([]rpsCatalog, 0, len(cached.RPs)),
+		}
+		if cached.RefreshErr != nil {
+			entries[index].RefreshError = cached.RefreshErr.Error()
+		}
+		for name, rp := range cached.RPs {
+			policy := rpsCatalog{
+				explainRP: newExplainRP(name, rp),
+				Coverage: rpsCoverage{
+					End: now,
+				},
+			}
+			if rp.Duration != 0 {
+				coverageStart := now.Add(-rp.Duration)
+				policy.Coverage.Start = &coverageStart
+			}
+			entries[index].RetentionPolicies = append(entries[index].RetentionPolicies, policy)
+		}
+		sort.Slice(entries[index].RetentionPolicies, func(i, j int) bool {
+			return entries[index].RetentionPolicies[i].Name < entries[index].RetentionPolicies[j].Name
+		})
+	}
+	respondAPI(w, entries)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"rrinterceptor/upstream"
+	"rrinterceptor/writebuffer"
+)
+
+// writeMaxBody is the maximum size of a write request body
+var writeMaxBody int64 = writebuffer.MaxBodySize
+
+func writeHandler(w *loggingResponseWriter, r *http.Request) {
+	// Prepare
+	start := time.Now()
+	log.Debugf("[WriteHandler] Received '%s %s' from %s", r.Method, r.URL, r.RemoteAddr)
+	var outcome string
+	defer func() {
+		if r.Context().Err() != nil {
+			log.Infof("[WriteHandler] '%s %s' from '%s': client closed the connection after %v: aborting", r.Method, r.URL, r.RemoteAddr, time.Since(start))
+		} else {
+			log.Debugf("[WriteHandler] '%s %s' from '%s': %s '%d %s' in %v", r.Method, r.URL, r.RemoteAddr, outcome, w.statusCode, http.StatusText(w.statusCode), time.Since(start))
+		}
+		if outcome != "" {
+			writeMetric.WithLabelValues(outcome).Inc()
+		}
+	}()
+	// Extract record
+	if r.ContentLength > writeMaxBody {
+		outcome = "too_large"
+		http.Error(w, fmt.Sprintf("request body is bigger than %d bytes", writeMaxBody), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, writeMaxBody+1))
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Errorf("[WriteHandler] can't extract body: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if int64(len(body)) > writeMaxBody {
+		outcome = "too_large"
+		http.Error(w, fmt.Sprintf("request body is bigger than %d bytes", writeMaxBody), http.StatusRequestEntityTooLarge)
+		return
+	}
+	record := writebuffer.Record{
+		Query:         r.URL.RawQuery,
+		Authorization: r.Header.Get("Authorization"),
+		Body:          body,
+	}
+	// Keep the order: if some records are waiting to be replayed, queue this one behind them
+	if writeBuffer != nil && writeBuffer.Pending() {
+		outcome = bufferWrite(w, record)
+		return
+	}
+	// Try to forward it directly
+	statusCode, message, err := forwardWrite(r.Context(), record)
+	if err == nil && statusCode < http.StatusInternalServerError {
+		outcome = "proxied"
+		if statusCode >= http.StatusMultipleChoices {
+			http.Error(w, message, statusCode)
+		} else {
+			w.WriteHeader(statusCode)
+		}
+		return
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("backend answered '%d %s': %s", statusCode, http.StatusText(statusCode), message)
+	}
+	// Backend is unavailable
+	if writeBuffer == nil {
+		outcome = "failed"
+		log.Errorf("[WriteHandler] can't forward write request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Warningf("[WriteHandler] can't forward write request, buffering it: %v", err)
+	outcome = bufferWrite(w, record)
+}
+
+func bufferWrite(w *loggingResponseWriter, record writebuffer.Record) (outcome string) {
+	if err := writeBuffer.Append(record); err != nil {
+		log.Errorf("[WriteHandler] can't buffer write request: %v", err)
+		http.Error(w, fmt.Sprintf("backend is unavailable and write request can't be buffered: %v", err), http.StatusServiceUnavailable)
+		return "rejected"
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "buffered"
+}
+
+// forwardWrite sends record to the influxdb prometheus write endpoint. err is only set for transport errors.
+func forwardWrite(ctx context.Context, record writebuffer.Record) (statusCode int, message string, err error) {
+	upstreamURL := *influxURL
+	upstreamURL.Path = "/api/v1/prom/write"
+	upstreamURL.RawQuery = record.Query
+	req, err := http.NewRequest(http.MethodPost, upstreamURL.String(), bytes.NewReader(record.Body))
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if record.Authorization != "" {
+		req.Header.Set("Authorization", record.Authorization)
+	}
+	resp, err := upstream.For(influxURL).Client().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	statusCode = resp.StatusCode
+	if statusCode >= http.StatusMultipleChoices {
+		var body []byte
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			return
+		}
+		message = string(bytes.TrimSpace(body))
+	}
+	return
+}
+
+// replayWrite is the write buffer sender: 4xx answers can't be fixed by retrying
+func replayWrite(ctx context.Context, record writebuffer.Record) (err error) {
+	statusCode, message, err := forwardWrite(ctx, record)
+	if err != nil {
+		return
+	}
+	if statusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("backend answered '%d %s': %s", statusCode, http.StatusText(statusCode), message)
+	}
+	if statusCode >= http.StatusMultipleChoices {
+		return writebuffer.Permanent(fmt.Errorf("backend answered '%d %s': %s", statusCode, http.StatusText(statusCode), message))
+	}
+	return
+}
+
+// pingInfluxDB is the write buffer health check
+func pingInfluxDB(ctx context.Context) (healthy bool) {
+	pingURL := *influxURL
+	pingURL.Path = "/ping"
+	req, err := http.NewRequest(http.MethodGet, pingURL.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := upstream.For(influxURL).Client().Do(req.WithContext(ctx))
+	if err != nil {
+		log.Debugf("[WriteBuffer] InfluxDB ping failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent
+}
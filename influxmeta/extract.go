@@ -0,0 +1,114 @@
+package influxmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	influxcliv2 "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// ExtractMeasurements returns the sorted measurement names of a SHOW MEASUREMENTS result
+func ExtractMeasurements(results []influxcliv2.Result) (measurements []string, err error) {
+	return extractColumn(results, "name")
+}
+
+// ExtractTagKeys returns the sorted and deduplicated tag keys of a SHOW TAG KEYS result
+func ExtractTagKeys(results []influxcliv2.Result) (keys []string, err error) {
+	return extractColumn(results, "tagKey")
+}
+
+// ExtractTagValues returns the sorted and deduplicated tag values of a SHOW TAG VALUES result
+func ExtractTagValues(results []influxcliv2.Result) (values []string, err error) {
+	return extractColumn(results, "value")
+}
+
+// ExtractSeries returns the label sets (including the metric name) of a SHOW SERIES result
+func ExtractSeries(results []influxcliv2.Result) (series []map[string]string, err error) {
+	keys, err := extractColumn(results, "key")
+	if err != nil {
+		return
+	}
+	series = make([]map[string]string, len(keys))
+	for index, key := range keys {
+		name, tags := models.ParseKey([]byte(key))
+		labelSet := tags.Map()
+		labelSet[MetricNameLabel] = name
+		series[index] = labelSet
+	}
+	return
+}
+
+// ExtractCardinality returns the total of the counts of a SHOW SERIES CARDINALITY result
+func ExtractCardinality(results []influxcliv2.Result) (total int64, err error) {
+	var count int64
+	for resultIndex, result := range results {
+		for serieIndex, serie := range result.Series {
+			columnIndex := -1
+			for index, name := range serie.Columns {
+				if name == "count" {
+					columnIndex = index
+					break
+				}
+			}
+			if columnIndex == -1 {
+				err = fmt.Errorf("result #%d: serie #%d: count column not found", resultIndex, serieIndex)
+				return
+			}
+			for valueIndex, value := range serie.Values {
+				number, ok := value[columnIndex].(json.Number)
+				if !ok {
+					err = fmt.Errorf("result #%d: serie #%d: value #%d: can't cast '%v' as expected number as count",
+						resultIndex, serieIndex, valueIndex, value[columnIndex])
+					return
+				}
+				if count, err = number.Int64(); err != nil {
+					err = fmt.Errorf("result #%d: serie #%d: value #%d: %v", resultIndex, serieIndex, valueIndex, err)
+					return
+				}
+				total += count
+			}
+		}
+	}
+	return
+}
+
+func extractColumn(results []influxcliv2.Result, column string) (values []string, err error) {
+	var (
+		tmpValue string
+		ok       bool
+	)
+	unique := make(map[string]struct{})
+	for resultIndex, result := range results {
+		for serieIndex, serie := range result.Series {
+			// Get column index
+			columnIndex := -1
+			for index, name := range serie.Columns {
+				if name == column {
+					columnIndex = index
+					break
+				}
+			}
+			if columnIndex == -1 {
+				err = fmt.Errorf("result #%d: serie #%d: %s column not found", resultIndex, serieIndex, column)
+				return
+			}
+			// Extract values
+			for valueIndex, value := range serie.Values {
+				if tmpValue, ok = value[columnIndex].(string); !ok {
+					err = fmt.Errorf("result #%d: serie #%d: value #%d: can't cast '%v' as expected string as %s",
+						resultIndex, serieIndex, valueIndex, value[columnIndex], column)
+					return
+				}
+				unique[tmpValue] = struct{}{}
+			}
+		}
+	}
+	values = make([]string, 0, len(unique))
+	for value := range unique {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return
+}
@@ -0,0 +1,57 @@
+package influxmeta
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	influxcliv2 "github.com/influxdata/influxdb/client/v2"
+)
+
+// decodeResults decodes the results of an influxdb JSON answer the way the influxdb client does
+func decodeResults(t *testing.T, answer string) []influxcliv2.Result {
+	var resp influxcliv2.Response
+	decoder := json.NewDecoder(bytes.NewBufferString(answer))
+	decoder.UseNumber()
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Results
+}
+
+func TestExtractCardinality(t *testing.T) {
+	cases := []struct {
+		name   string
+		answer string
+		total  int64
+	}{
+		{"empty", `{"results":[{"statement_id":0}]}`, 0},
+		{"one measurement", `{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[42]]}]}]}`, 42},
+		{"several measurements", `{"results":[{"statement_id":0,"series":[
+			{"name":"up","columns":["count"],"values":[[2]]},
+			{"name":"node_load1","columns":["count"],"values":[[3]]}]}]}`, 5},
+		{"several statements", `{"results":[
+			{"statement_id":0,"series":[{"columns":["count"],"values":[[10]]}]},
+			{"statement_id":1,"series":[{"columns":["name","count"],"values":[["up",7]]}]}]}`, 17},
+	}
+	for _, c := range cases {
+		total, err := ExtractCardinality(decodeResults(t, c.answer))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		} else if total != c.total {
+			t.Errorf("%s: got %d series, expected %d", c.name, total, c.total)
+		}
+	}
+}
+
+func TestExtractCardinalityMalformed(t *testing.T) {
+	for name, answer := range map[string]string{
+		"no count column": `{"results":[{"statement_id":0,"series":[{"columns":["name"],"values":[["up"]]}]}]}`,
+		"not a number":    `{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[["many"]]}]}]}`,
+		"not an integer":  `{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[1.5]]}]}]}`,
+	} {
+		if _, err := ExtractCardinality(decodeResults(t, answer)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package influxmeta
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// MetricNameLabel is the prometheus label stored as the influxdb measurement
+const MetricNameLabel = labels.MetricName
+
+// ShowMeasurements returns the statement listing all the measurements of database
+func ShowMeasurements(database string) string {
+	return fmt.Sprintf("SHOW MEASUREMENTS ON %s", quoteIdent(database))
+}
+
+// ShowTagKeys returns the statement listing all the tag keys of database within rp
+func ShowTagKeys(database, rp string) string {
+	return fmt.Sprintf("SHOW TAG KEYS ON %s FROM %s./.*/", quoteIdent(database), quoteIdent(rp))
+}
+
+// ShowTagValues returns the statement listing all the values of the key tag of database within rp
+func ShowTagValues(database, rp, key string) string {
+	return fmt.Sprintf("SHOW TAG VALUES ON %s FROM %s./.*/ WITH KEY = %s",
+		quoteIdent(database), quoteIdent(rp), quoteIdent(key))
+}
+
+// ShowSeries returns the statement listing the series of measurements within rp matching matchers.
+// Matchers on the metric name are ignored: measurements must already be resolved.
+func ShowSeries(database, rp string, measurements []string, matchers []*labels.Matcher) string {
+	var buffer strings.Builder
+	buffer.WriteString(fmt.Sprintf("SHOW SERIES ON %s FROM ", quoteIdent(database)))
+	for index, measurement := range measurements {
+		if index > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(fmt.Sprintf("%s.%s", quoteIdent(rp), quoteIdent(measurement)))
+	}
+	first := true
+	for _, matcher := range matchers {
+		if matcher.Name == MetricNameLabel {
+			continue
+		}
+		if first {
+			buffer.WriteString(" WHERE ")
+			first = false
+		} else {
+			buffer.WriteString(" AND ")
+		}
+		buffer.WriteString(whereClause(matcher))
+	}
+	return buffer.String()
+}
+
+// ShowSeriesCardinality returns the statement counting the series of measurements within rp matching matchers.
+// Matchers on the metric name are ignored: measurements must already be resolved.
+func ShowSeriesCardinality(database, rp string, measurements []string, matchers []*labels.Matcher) string {
+	return "SHOW SERIES CARDINALITY" + strings.TrimPrefix(ShowSeries(database, rp, measurements, matchers), "SHOW SERIES")
+}
+
+func whereClause(matcher *labels.Matcher) string {
+	switch matcher.Type {
+	case labels.MatchNotEqual:
+		return fmt.Sprintf("%s != %s", quoteIdent(matcher.Name), quoteString(matcher.Value))
+	case labels.MatchRegexp:
+		return fmt.Sprintf("%s =~ %s", quoteIdent(matcher.Name), quoteRegex(matcher.Value))
+	case labels.MatchNotRegexp:
+		return fmt.Sprintf("%s !~ %s", quoteIdent(matcher.Name), quoteRegex(matcher.Value))
+	default:
+		return fmt.Sprintf("%s = %s", quoteIdent(matcher.Name), quoteString(matcher.Value))
+	}
+}
+
+func quoteIdent(ident string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(ident) + `"`
+}
+
+func quoteString(str string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(str) + `'`
+}
+
+// quoteRegex anchors a prometheus regex (always fully anchored) for influxdb
+func quoteRegex(regex string) string {
+	return `/^(?:` + strings.Replace(regex, `/`, `\/`, -1) + `)$/`
+}
@@ -0,0 +1,101 @@
+package influxquery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Kind classifies influxdb query failures
+type Kind int
+
+const (
+	// KindUnknown is used for failures which could not be classified (malformed answers, etc...)
+	KindUnknown Kind = iota
+	// KindUnauthorized is used when influxdb rejected the credentials
+	KindUnauthorized
+	// KindForbidden is used when the credentials are valid but not allowed to execute the statement
+	KindForbidden
+	// KindNotFound is used when the database does not exist
+	KindNotFound
+	// KindUnavailable is used when influxdb could not be reached or answered a server error
+	KindUnavailable
+	// KindCanceled is used when the caller context ended before influxdb answered
+	KindCanceled
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindUnauthorized:
+		return "unauthorized"
+	case KindForbidden:
+		return "forbidden"
+	case KindNotFound:
+		return "not_found"
+	case KindUnavailable:
+		return "unavailable"
+	case KindCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// Error is returned by Query for every failure happening after the request has been built
+type Error struct {
+	Kind       Kind
+	StatusCode int // 0 if influxdb did not answer
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// KindOf returns the kind of err if it wraps an *Error, KindUnknown otherwise
+func KindOf(err error) Kind {
+	var queryErr *Error
+	if errors.As(err, &queryErr) {
+		return queryErr.Kind
+	}
+	return KindUnknown
+}
+
+// KindOfStatus classifies a non 200 influxdb answer
+func KindOfStatus(statusCode int) Kind {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return KindUnauthorized
+	case statusCode == http.StatusForbidden:
+		return KindForbidden
+	case statusCode == http.StatusNotFound:
+		return KindNotFound
+	case statusCode >= 500:
+		return KindUnavailable
+	default:
+		return KindUnknown
+	}
+}
+
+// KindOfMessage classifies an error returned within a 200 influxdb answer
+func KindOfMessage(message string) Kind {
+	switch {
+	case strings.Contains(message, "database not found"):
+		return KindNotFound
+	case strings.Contains(message, "not authorized"):
+		return KindForbidden
+	case strings.Contains(message, "authorization failed"):
+		return KindUnauthorized
+	default:
+		return KindUnknown
+	}
+}
+
+// KindOfTransport classifies a failure to reach influxdb
+func KindOfTransport(ctx context.Context) Kind {
+	if ctx.Err() != nil {
+		return KindCanceled
+	}
+	return KindUnavailable
+}
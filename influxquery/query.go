@@ -0,0 +1,91 @@
+package influxquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"rrinterceptor/upstream"
+
+	influxcliv2 "github.com/influxdata/influxdb/client/v2"
+)
+
+const userAgent = "Iguane Solutions Sismology RRInterceptor"
+
+// Query executes statement on database at endpoint using user & password as auth.
+// Unlike the influxdb client, failures are returned as *Error carrying their Kind.
+func Query(ctx context.Context, endpoint *url.URL, database, user, password, statement string) (results []influxcliv2.Result, err error) {
+	// Build request
+	queryURL := *endpoint
+	queryURL.Path = "/query"
+	queryURL.RawQuery = url.Values{
+		"q":     []string{statement},
+		"db":    []string{database},
+		"epoch": []string{"ms"},
+	}.Encode()
+	req, err := http.NewRequest(http.MethodGet, queryURL.String(), nil)
+	if err != nil {
+		err = fmt.Errorf("can't create request: %v", err)
+		return
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(user, password)
+	req.Header.Set("User-Agent", userAgent)
+	// Execute it
+	resp, err := upstream.For(endpoint).Client().Do(req)
+	if err != nil {
+		err = &Error{
+			Kind:    KindOfTransport(ctx),
+			Message: fmt.Sprintf("can not execute '%s' on '%s': %v", statement, database, err),
+		}
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = &Error{
+			Kind:       KindOfTransport(ctx),
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("can't read '%s' answer: %v", statement, err),
+		}
+		return
+	}
+	// Decode answer (influxdb also answers json on most errors)
+	var response influxcliv2.Response
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	decodeErr := decoder.Decode(&response)
+	if resp.StatusCode != http.StatusOK {
+		message := string(bytes.TrimSpace(body))
+		if decodeErr == nil && response.Err != "" {
+			message = response.Err
+		}
+		err = &Error{
+			Kind:       KindOfStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("'%s' returned '%s': %s", statement, resp.Status, message),
+		}
+		return
+	}
+	if decodeErr != nil {
+		err = &Error{
+			Kind:       KindUnknown,
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("can't decode '%s' answer: %v", statement, decodeErr),
+		}
+		return
+	}
+	if response.Error() != nil {
+		err = &Error{
+			Kind:       KindOfMessage(response.Error().Error()),
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("'%s' returned an error: %v", statement, response.Error()),
+		}
+		return
+	}
+	return response.Results, nil
+}
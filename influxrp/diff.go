@@ -0,0 +1,49 @@
+package influxrp
+
+import "sort"
+
+// Change describes a retention policy present in both sets with different metadata
+type Change struct {
+	Name string
+	Old  RetentionPolicy
+	New  RetentionPolicy
+}
+
+// Diff contains the differences between two sets of retention policies
+type Diff struct {
+	Added   []string
+	Removed []string
+	Changed []Change
+}
+
+// Empty returns true if both sets were identical
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff returns what changed between rp and newer, sorted by name
+func (rp RetentionPolicies) Diff(newer RetentionPolicies) (diff Diff) {
+	for name, rpdata := range rp {
+		newdata, found := newer[name]
+		if !found {
+			diff.Removed = append(diff.Removed, name)
+			continue
+		}
+		if newdata != rpdata {
+			diff.Changed = append(diff.Changed, Change{
+				Name: name,
+				Old:  rpdata,
+				New:  newdata,
+			})
+		}
+	}
+	for name := range newer {
+		if _, found := rp[name]; !found {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return
+}
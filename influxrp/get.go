@@ -8,6 +8,8 @@ import (
 	"reflect"
 	"time"
 
+	"rrinterceptor/influxquery"
+
 	influxcliv2 "github.com/influxdata/influxdb/client/v2"
 )
 
@@ -15,32 +17,15 @@ const (
 	showRP = "show retention policies;"
 )
 
-// GetRetentionPolicies returns the retention policies of the provided database at addr using user & password as auth
+// GetRetentionPolicies returns the retention policies of the provided database at addr using user & password as auth.
+// Failures can be classified with influxquery.KindOf.
 func GetRetentionPolicies(ctx context.Context, url *url.URL, database, user, password string) (rps RetentionPolicies, err error) {
-	// Spawn influx client
-	infcli, err := influxcliv2.NewHTTPClient(influxcliv2.HTTPConfig{
-		Addr:      url.String(),
-		Username:  user,
-		Password:  password,
-		UserAgent: "Iguane Solutions Sismology RRInterceptor",
-	})
-	if err != nil {
-		err = fmt.Errorf("can't create influxdb client: %v", err)
-		return
-	}
-	defer infcli.Close()
-	// Execute it
-	influxresp, err := infcli.QueryCtx(ctx, influxcliv2.NewQuery(showRP, database, "ms"))
+	results, err := influxquery.Query(ctx, url, database, user, password, showRP)
 	if err != nil {
-		err = fmt.Errorf("can not execute '%s' on '%s': %v", showRP, database, err)
-		return
-	}
-	if influxresp.Error() != nil {
-		err = fmt.Errorf("'%s' returned an error: %v", showRP, influxresp.Error())
 		return
 	}
 	// Extract rps
-	return extractRP(influxresp.Results)
+	return extractRP(results)
 }
 
 func extractRP(results []influxcliv2.Result) (rps RetentionPolicies, err error) {
@@ -1,8 +1,11 @@
 package influxrp
 
 import (
-	"rrinterceptor/promutils"
+	"fmt"
+	"sort"
 	"time"
+
+	"rrinterceptor/promutils"
 )
 
 // RetentionPolicies is a collection of retention policies accesible by name
@@ -10,33 +13,118 @@ type RetentionPolicies map[string]RetentionPolicy
 
 // GetClosest returns the name of smallest retention policy capable of handling StartTimestampMs
 func (rp RetentionPolicies) GetClosest(StartTimestampMs int64) (name string) {
+	return rp.Explain(StartTimestampMs).Winner
+}
+
+// Candidate is a retention policy able to handle a start timestamp
+type Candidate struct {
+	Name string
+	RetentionPolicy
+	Delta      time.Duration // how much older than the start timestamp the retention policy goes
+	Infinite   bool
+	Resolution time.Duration // interval between points, 0 for raw points
+}
+
+// Rejection is a retention policy unable to handle a start timestamp
+type Rejection struct {
+	Name string
+	RetentionPolicy
+	Reason string
+}
+
+// Decision contains the full details of a retention policy selection
+type Decision struct {
+	Start      time.Time
+	Step       time.Duration // 0 if unknown
+	Candidates []Candidate   // closest first, infinite last
+	Rejected   []Rejection
+	Winner     string
+}
+
+// Explain returns the details of the selection of the smallest retention policy capable of handling StartTimestampMs
+func (rp RetentionPolicies) Explain(StartTimestampMs int64) (decision Decision) {
+	return rp.ExplainWithStep(StartTimestampMs, 0, nil)
+}
+
+// ExplainWithStep is Explain for a query evaluated every step: among the retention policies capable of
+// handling StartTimestampMs, the one with the coarsest resolution not exceeding step wins (the closest one
+// on equality). resolutions holds the interval of the downsampled retention policies, others hold raw points.
+func (rp RetentionPolicies) ExplainWithStep(StartTimestampMs int64, step time.Duration, resolutions map[string]time.Duration) (decision Decision) {
 	// Parse timestamp to get date
-	startDate := promutils.GetTimeFromTS(StartTimestampMs)
-	// fmt.Println("Start Date:", startDate)
-	// fmt.Println("Duration from Start Date:", time.Now().Sub(startDate))
+	decision.Start = promutils.GetTimeFromTS(StartTimestampMs)
+	decision.Step = step
 	// Search for RP that contains this date and choose the closest
 	now := time.Now()
-	var delta, bestDelta time.Duration
+	var delta time.Duration
 	for retention, rpdata := range rp {
 		// Special case: infinite is duration 0...
 		if rpdata.Duration == 0 {
-			// ...use it if nothing selected yet
-			if name == "" {
-				name = retention
-			}
+			// ...use it only if nothing else is selectable
+			decision.Candidates = append(decision.Candidates, Candidate{
+				Name:            retention,
+				RetentionPolicy: rpdata,
+				Infinite:        true,
+				Resolution:      resolutions[retention],
+			})
 			continue
 		}
 		// Else compute delta
-		delta = startDate.Sub(now.Add(rpdata.Duration * -1))
-		// fmt.Println("Delta:", retention, delta)
+		delta = decision.Start.Sub(now.Add(rpdata.Duration * -1))
 		// Is this rp selectable ?
 		if delta < 0 {
-			continue // current RP can not have points for this TS
+			// current RP can not have points for this TS
+			decision.Rejected = append(decision.Rejected, Rejection{
+				Name:            retention,
+				RetentionPolicy: rpdata,
+				Reason:          fmt.Sprintf("only covers the last %v: start is %v too old", rpdata.Duration, -delta),
+			})
+			continue
+		}
+		decision.Candidates = append(decision.Candidates, Candidate{
+			Name:            retention,
+			RetentionPolicy: rpdata,
+			Delta:           delta,
+			Resolution:      resolutions[retention],
+		})
+	}
+	// Closest first, infinite ones last
+	sort.Slice(decision.Candidates, func(i, j int) bool {
+		if decision.Candidates[i].Infinite != decision.Candidates[j].Infinite {
+			return !decision.Candidates[i].Infinite
+		}
+		if decision.Candidates[i].Delta != decision.Candidates[j].Delta {
+			return decision.Candidates[i].Delta < decision.Candidates[j].Delta
+		}
+		return decision.Candidates[i].Name < decision.Candidates[j].Name
+	})
+	sort.Slice(decision.Rejected, func(i, j int) bool { return decision.Rejected[i].Name < decision.Rejected[j].Name })
+	if len(decision.Candidates) == 0 {
+		return
+	}
+	// Without a usable step, the closest wins
+	winner := decision.Candidates[0]
+	if step > 0 {
+		for _, candidate := range decision.Candidates[1:] {
+			if candidate.Resolution <= step && (winner.Resolution > step || candidate.Resolution > winner.Resolution) {
+				winner = candidate
+			}
+		}
+	}
+	decision.Winner = winner.Name
+	return
+}
+
+// GetLongest returns the name of the retention policy covering the longest time range
+func (rp RetentionPolicies) GetLongest() (name string) {
+	var longest time.Duration
+	for retention, rpdata := range rp {
+		// Special case: infinite is duration 0
+		if rpdata.Duration == 0 {
+			return retention
 		}
-		if bestDelta == 0 || delta < bestDelta {
-			// either we don't have rp yet or this one is better
+		if rpdata.Duration > longest {
 			name = retention
-			bestDelta = delta
+			longest = rpdata.Duration
 		}
 	}
 	return
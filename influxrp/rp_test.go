@@ -0,0 +1,43 @@
+package influxrp
+
+import (
+	"testing"
+	"time"
+
+	"rrinterceptor/promutils"
+)
+
+func TestExplainWithStep(t *testing.T) {
+	rps := RetentionPolicies{
+		"autogen": {Duration: 168 * time.Hour, Default: true},
+		"month":   {Duration: 720 * time.Hour},
+		"inf":     {},
+	}
+	resolutions := map[string]time.Duration{
+		"month": 5 * time.Minute,
+		"inf":   time.Hour,
+	}
+	twoDaysAgo := promutils.GetTSFromTime(time.Now().Add(-48 * time.Hour))
+	tenDaysAgo := promutils.GetTSFromTime(time.Now().Add(-240 * time.Hour))
+	cases := []struct {
+		start  int64
+		step   time.Duration
+		winner string
+	}{
+		{twoDaysAgo, 0, "autogen"},
+		{twoDaysAgo, 30 * time.Second, "autogen"},
+		{twoDaysAgo, 10 * time.Minute, "month"},
+		{twoDaysAgo, time.Hour, "inf"},
+		{tenDaysAgo, 0, "month"},
+		{tenDaysAgo, time.Minute, "month"}, // too fine for any downsampled rp: closest one
+		{tenDaysAgo, 2 * time.Hour, "inf"},
+	}
+	for index, c := range cases {
+		if winner := rps.ExplainWithStep(c.start, c.step, resolutions).Winner; winner != c.winner {
+			t.Errorf("case #%d (step %v): got '%s', expected '%s'", index, c.step, winner, c.winner)
+		}
+	}
+	if winner := rps.Explain(twoDaysAgo).Winner; winner != "autogen" {
+		t.Errorf("Explain without step: got '%s', expected 'autogen'", winner)
+	}
+}
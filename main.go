@@ -1,43 +1,132 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"rrinterceptor/admission"
 	"rrinterceptor/cacher"
+	"rrinterceptor/coalescer"
+	"rrinterceptor/prefetcher"
+	"rrinterceptor/ratelimit"
+	"rrinterceptor/resultcache"
+	"rrinterceptor/scheduler"
+	"rrinterceptor/upstream"
+	"rrinterceptor/writebuffer"
 
 	"github.com/hekmon/hllogger"
 	systemd "github.com/iguanesolutions/go-systemd"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const (
+	warmUpTimeout        = 30 * time.Second
+	snapshotSecretSuffix = ".secret" // default cache snapshot secret file, next to the snapshot
 )
 
 var (
-	cache      *cacher.Controller
-	influxURL  *url.URL
-	httpServer *http.Server
-	httpProxy  *httputil.ReverseProxy
-	log        *hllogger.HlLogger
-	mainCtx    context.Context
-	mainCancel context.CancelFunc
-	mainLock   sync.Mutex
+	cache        *cacher.Controller
+	writeBuffer  *writebuffer.Controller
+	promqlEngine *promql.Engine
+	influxURL    *url.URL
+	httpServer   *http.Server
+	adminServer  *http.Server
+	httpProxy    *httputil.ReverseProxy
+	log          *hllogger.HlLogger
+	mainCtx      context.Context
+	mainCancel   context.CancelFunc
+	mainLock     sync.Mutex
 )
 
 func main() {
 	// cli flags
 	var (
-		bindAddr        = flag.String("bind-addr", ":9404", "The HTTP server bind address.")
-		influxTarget    = flag.String("influx-url", "http://127.0.0.1:8086", "The influxdb target url.")
-		checkFrequency  = flag.Int("check-frequency", 60, "The cache check frequency in minutes.")
-		expirationLimit = flag.Int("expiration-limit", 1440, "The cache expiration limit.")
-		logLevel        = flag.Int("log-level", 1, "Set the loglevel: Fatal(0) Error(1) Warning(2) Info(3) Debug(4).")
+		bindAddr              = flag.String("bind-addr", ":9404", "The HTTP server bind address.")
+		adminBindAddr         = flag.String("admin-bind-addr", "127.0.0.1:9405", "The admin HTTP server bind address, serving the unauthenticated operator endpoints (disabled if empty).")
+		influxTarget          = flag.String("influx-url", "http://127.0.0.1:8086", "The influxdb target url.")
+		checkFrequency        = flag.Int("check-frequency", 60, "The cache check frequency in minutes.")
+		expirationLimit       = flag.Int("expiration-limit", 1440, "The cache expiration limit in minutes: cached retention policies which could not be refreshed are dropped after it.")
+		refreshAfter          = flag.Int("refresh-after", 60, "The age in minutes after which cached retention policies are refreshed in the background.")
+		refreshFrequency      = flag.Int("refresh-frequency", 1, "The frequency in minutes at which the cache is checked for entries to refresh.")
+		rpResolutionsList     = flag.String("rp-resolutions", "", "The comma separated 'rp=seconds' interval between points of the downsampled retention policies, preferred when a query step allows it (empty if all hold raw points).")
+		rpPollFrequency       = flag.Int("rp-poll-frequency", 0, "The frequency in minutes at which every cached retention policies set is fetched again to detect changes (0 to disable).")
+		metaExpirationLimit   = flag.Int("meta-expiration-limit", 5, "The metadata (series, labels, label values) cache expiration limit in minutes.")
+		metaMaxEntries        = flag.Int("meta-max-entries", 10000, "The maximum number of metadata (series, labels, label values) results held by the cache, least recently used ones being evicted first (0 for unlimited).")
+		authExpirationLimit   = flag.Int("auth-expiration-limit", 5, "The delay in minutes after which client credentials are validated again against influxdb.")
+		failureBackoff        = flag.Int("failure-backoff", 1, "The initial delay in seconds during which a failed retention policies lookup is not tried again (0 to disable).")
+		failureBackoffMax     = flag.Int("failure-backoff-max", 60, "The maximum delay in seconds during which a failed retention policies lookup is not tried again.")
+		failureMaxEntries     = flag.Int("failure-max-entries", 10000, "The maximum number of failed lookups remembered, the ones retried the soonest being forgotten first (0 for unlimited).")
+		cacheSnapshotFile     = flag.String("cache-snapshot-file", "", "The file the retention policies cache is saved to and restored from at startup (empty to disable).")
+		cacheSnapshotSecret   = flag.String("cache-snapshot-secret-file", "", "The file containing the secret keying the credentials hashes saved in the cache snapshot (generated next to the snapshot file if empty).")
+		cacheSnapshotFreq     = flag.Int("cache-snapshot-frequency", 5, "The cache snapshot frequency in minutes.")
+		cacheMaxEntries       = flag.Int("cache-max-entries", 0, "The maximum number of databases held by the retention policies cache, least recently used ones being evicted first (0 for unlimited).")
+		cacheMaxEntriesUser   = flag.Int("cache-max-entries-per-user", 0, "The maximum number of databases a single user can add to the retention policies cache (0 for unlimited).")
+		expirationJitter      = flag.Int("expiration-jitter", 10, "The maximum percentage of the refresh and expiration delays randomly removed for each cache entry.")
+		resultCacheMemory     = flag.Int("result-cache-memory", 0, "The memory in MiB used to cache the immutable blocks of read results (0 to disable the result cache).")
+		resultCacheDir        = flag.String("result-cache-dir", "", "The directory holding the read results evicted from memory (empty to disable the disk tier).")
+		resultCacheDisk       = flag.Int("result-cache-disk", 10240, "The disk space in MiB used by the result cache disk tier (0 for unlimited).")
+		resultCacheBlockSize  = flag.Int("result-cache-block", 60, "The duration in minutes of the aligned blocks read results are cached by.")
+		resultCacheHorizonDur = flag.Int("result-cache-horizon", 60, "The delay in minutes after which data is considered immutable (no more writes expected) and can be cached.")
+		resultCacheRPHorizons = flag.String("result-cache-rp-horizons", "", "The comma separated 'rp=minutes' delay after which the data of a retention policy is considered immutable, '-result-cache-horizon' being used for the others.")
+		prefetch              = flag.Bool("prefetch", false, "Learn the recurring reads and prefetch their immutable blocks in the result cache before they are expected.")
+		prefetchLead          = flag.Int("prefetch-lead", 10, "The number of seconds before the next expected read a recurring read is prefetched.")
+		prefetchOccurrences   = flag.Int("prefetch-min-occurrences", 3, "The number of regular reads needed before a read is considered recurring.")
+		prefetchMaxPatterns   = flag.Int("prefetch-max-patterns", 10000, "The maximum number of read patterns learned by the prefetcher (0 for unlimited).")
+		prefetchConcurrency   = flag.Int("prefetch-concurrency", 4, "The maximum number of prefetches done at the same time.")
+		shardedFetchHours     = flag.Int("sharded-fetch-threshold", 0, "The range in hours from which a read query is split by shard groups fetched concurrently (0 to disable).")
+		shardedFetchPool      = flag.Int("sharded-fetch-workers", 4, "The maximum number of concurrent upstream requests of a sharded read.")
+		shardedFetchParts     = flag.Int("sharded-fetch-max-parts", 64, "The maximum number of sub-ranges a sharded read is split in, adjacent shard groups being merged beyond.")
+		upstreamIdleConns     = flag.Int("upstream-max-idle-conns", 32, "The maximum number of idle connections kept open to influxdb.")
+		upstreamMaxConns      = flag.Int("upstream-max-conns", 0, "The maximum number of connections opened to influxdb (0 for unlimited).")
+		upstreamIdleTimeout   = flag.Int("upstream-idle-timeout", 90, "The delay in seconds after which an idle connection to influxdb is closed.")
+		upstreamHTTP2         = flag.Bool("upstream-http2", false, "Try to use HTTP/2 with influxdb (https only).")
+		readMaxBodySize       = flag.Int("read-max-body", 4096, "The maximum size in KiB of a compressed read request (0 for unlimited).")
+		readMaxDecodedSize    = flag.Int("read-max-decoded", 32768, "The maximum size in KiB of a decompressed read request (0 for unlimited).")
+		readMaxQueriesCount   = flag.Int("read-max-queries", 1000, "The maximum number of queries within a read request (0 for unlimited).")
+		readMaxMatchersCount  = flag.Int("read-max-matchers", 100, "The maximum number of matchers within a query of a read request (0 for unlimited).")
+		admissionMaxRange     = flag.String("admission-max-range", "", "The comma separated 'rp=hours' maximum time range of a read query on each retention policy, '*' for the others (empty for unlimited).")
+		admissionRequireName  = flag.Bool("admission-require-name", false, "Refuse the read queries without an equality or prefix matcher on the metric name.")
+		admissionBanEmptyRe   = flag.Bool("admission-ban-empty-regex", false, "Refuse the read queries with a regex matcher matching the empty string.")
+		admissionMaxSeries    = flag.Int64("admission-max-series", 0, "The maximum number of series a read query can select, estimated with SHOW SERIES CARDINALITY (0 for unlimited).")
+		responseBytesLimits   = flag.String("response-max-bytes", "", "The comma separated 'db=MiB' maximum size of a read response for each database, '*' for the others (empty for unlimited).")
+		responseSeriesLimits  = flag.String("response-max-series", "", "The comma separated 'db=series' maximum number of series of a read response for each database, '*' for the others (empty for unlimited).")
+		responseSamplesLimits = flag.String("response-max-samples", "", "The comma separated 'db=samples' maximum number of samples of a read response for each database, '*' for the others (empty for unlimited).")
+		rateLimitKeyBy        = flag.String("rate-limit-key", "", "What read rate limits apply to: 'user', 'address' or 'database' (empty to disable rate limiting).")
+		rateLimitRequests     = flag.Float64("rate-limit-requests", 0, "The number of reads per second allowed for each rate limit key (0 for unlimited).")
+		rateLimitBurst        = flag.Int("rate-limit-burst", 0, "The number of reads allowed at once for each rate limit key (0 for the number of reads per second).")
+		rateLimitBytes        = flag.Int("rate-limit-bytes", 0, "The MiB of read responses per minute allowed for each rate limit key (0 for unlimited).")
+		schedulerMaxConns     = flag.Int("scheduler-max-concurrency", 0, "The maximum number of concurrent upstream reads on the influxdb backend, the others are queued by priority (0 to disable the scheduler).")
+		schedulerMaxRPConns   = flag.String("scheduler-max-rp-concurrency", "", "The comma separated 'rp=reads' maximum number of concurrent upstream reads on each retention policy, '*' for the others (empty for unlimited).")
+		schedulerQueueTimeout = flag.Int("scheduler-queue-timeout", 30, "The maximum number of seconds an upstream read waits in the scheduler queue (0 for unlimited).")
+		schedulerHighDriftDur = flag.Int("scheduler-high-drift", 3, "The age in hours of the oldest query start under which a read is high priority.")
+		schedulerLowDriftDur  = flag.Int("scheduler-low-drift", 168, "The age in hours of the oldest query start from which a read is low priority.")
+		coalesceReads         = flag.Bool("coalesce-reads", false, "Share a single upstream request between identical concurrent smart reads.")
+		warmupDatabases       = flag.String("warmup-dbs", "", "A comma separated list of databases whose retention policies are loaded before being ready and kept cached.")
+		warmupUser            = flag.String("warmup-user", "", "The influxdb user used to load the warm up databases.")
+		warmupPasswordFile    = flag.String("warmup-password-file", "", "The file containing the password of the warm up user.")
+		logLevel              = flag.Int("log-level", 1, "Set the loglevel: Fatal(0) Error(1) Warning(2) Info(3) Debug(4).")
+		writeMaxBodySize      = flag.Int("write-max-body", 32768, "The maximum size in KiB of a write request (at most 262144).")
+		writeBufferDir        = flag.String("write-buffer-dir", "", "The directory used to buffer write requests while influxdb is unavailable (disabled if empty).")
+		writeBufferMaxSize    = flag.Int("write-buffer-max-size", 1024, "The write buffer max size in MiB (0 for unlimited).")
+		writeBufferSegment    = flag.Int("write-buffer-segment-size", 64, "The write buffer segment size in MiB.")
+		writeBufferReplayFreq = flag.Int("write-buffer-replay-frequency", 10, "The write buffer replay check frequency in seconds.")
+		queryMaxConcurrency   = flag.Int("query-max-concurrency", 20, "The maximum number of PromQL queries executed concurrently.")
+		queryMaxSamples       = flag.Int("query-max-samples", 50000000, "The maximum number of samples a single PromQL query can load in memory.")
+		queryTimeout          = flag.Int("query-timeout", 120, "The maximum time in seconds a PromQL query may take before being aborted.")
 	)
 	flag.Parse()
 
@@ -67,18 +156,213 @@ func main() {
 		log.Warning("[Main] Systemd notifications not supported")
 	}
 
+	// Setup the connections to influxdb
+	upstream.Configure(upstream.Config{
+		MaxIdleConnsPerHost: *upstreamIdleConns,
+		MaxConnsPerHost:     *upstreamMaxConns,
+		IdleConnTimeout:     time.Duration(*upstreamIdleTimeout) * time.Second,
+		HTTP2:               *upstreamHTTP2,
+	})
+	httpProxy = newReadProxy()
+
 	// Create the app main context & lock
 	mainCtx, mainCancel = context.WithCancel(context.Background())
 	defer mainCancel() // make linter happy
 	mainLock.Lock()
 
 	// Create the cache & start the cleaner
+	var credentialSecret []byte
+	if *cacheSnapshotFile != "" || *cacheSnapshotSecret != "" {
+		if credentialSecret, err = loadSnapshotSecret(*cacheSnapshotSecret, *cacheSnapshotFile); err != nil {
+			log.Fatalf(1, "[Main] Can't load the cache snapshot secret: %v", err)
+		}
+	}
 	if cache, err = cacher.New(mainCtx, cacher.Config{
-		CheckFrequency:  time.Duration(*checkFrequency) * time.Minute,
-		ExpirationLimit: time.Duration(*expirationLimit) * time.Minute,
-		Logger:          log,
+		CheckFrequency:      time.Duration(*checkFrequency) * time.Minute,
+		RefreshFrequency:    time.Duration(*refreshFrequency) * time.Minute,
+		RefreshAfter:        time.Duration(*refreshAfter) * time.Minute,
+		PollFrequency:       time.Duration(*rpPollFrequency) * time.Minute,
+		ExpirationLimit:     time.Duration(*expirationLimit) * time.Minute,
+		MetaExpirationLimit: time.Duration(*metaExpirationLimit) * time.Minute,
+		AuthExpirationLimit: time.Duration(*authExpirationLimit) * time.Minute,
+		FailureBackoff:      time.Duration(*failureBackoff) * time.Second,
+		FailureBackoffMax:   time.Duration(*failureBackoffMax) * time.Second,
+		MaxFailures:         *failureMaxEntries,
+		SnapshotFile:        *cacheSnapshotFile,
+		SnapshotFrequency:   time.Duration(*cacheSnapshotFreq) * time.Minute,
+		CredentialSecret:    credentialSecret,
+		MaxEntries:          *cacheMaxEntries,
+		MaxMetaEntries:      *metaMaxEntries,
+		MaxEntriesPerUser:   *cacheMaxEntriesUser,
+		ExpirationJitter:    float64(*expirationJitter) / 100,
+		Logger:              log,
 	}); err != nil {
-		log.Fatal(1, "[Main] Can't spawn cacher: is there a logger ?")
+		log.Fatalf(1, "[Main] Can't spawn cacher: %v", err)
+	}
+
+	// Create the write buffer & start the replayer
+	if *writeMaxBodySize <= 0 || int64(*writeMaxBodySize)*1024 > writebuffer.MaxBodySize {
+		log.Fatalf(1, "[Main] The write max body size must be between 1 and %d KiB", writebuffer.MaxBodySize/1024)
+	}
+	writeMaxBody = int64(*writeMaxBodySize) * 1024
+	if *writeBufferDir != "" {
+		if writeBuffer, err = writebuffer.New(mainCtx, writebuffer.Config{
+			Directory:       *writeBufferDir,
+			SegmentSize:     int64(*writeBufferSegment) * 1024 * 1024,
+			MaxSize:         int64(*writeBufferMaxSize) * 1024 * 1024,
+			ReplayFrequency: time.Duration(*writeBufferReplayFreq) * time.Second,
+			Sender:          replayWrite,
+			HealthCheck:     pingInfluxDB,
+			Logger:          log,
+		}); err != nil {
+			log.Fatalf(1, "[Main] Can't spawn write buffer: %v", err)
+		}
+	}
+
+	// Create the result cache
+	if *resultCacheMemory > 0 {
+		if *resultCacheBlockSize <= 0 {
+			log.Fatal(1, "[Main] The result cache block duration must be positive")
+		}
+		if resultCache, err = resultcache.New(resultcache.Config{
+			MaxMemory: int64(*resultCacheMemory) * 1024 * 1024,
+			Directory: *resultCacheDir,
+			MaxDisk:   int64(*resultCacheDisk) * 1024 * 1024,
+			Logger:    log,
+		}); err != nil {
+			log.Fatalf(1, "[Main] Can't spawn result cache: %v", err)
+		}
+		resultCacheBlock = time.Duration(*resultCacheBlockSize) * time.Minute
+		resultCacheHorizon = time.Duration(*resultCacheHorizonDur) * time.Minute
+		horizons, err := parseNamedLimits(*resultCacheRPHorizons, 1)
+		if err != nil {
+			log.Fatalf(1, "[Main] Invalid retention policies write horizons: %v", err)
+		}
+		resultCacheHorizons = make(map[string]time.Duration, len(horizons))
+		for rp, minutes := range horizons {
+			resultCacheHorizons[rp] = time.Duration(minutes) * time.Minute
+		}
+	}
+
+	// Create the prefetcher
+	if *prefetch {
+		if resultCache == nil {
+			log.Fatal(1, "[Main] The prefetcher needs the result cache to be enabled")
+		}
+		if readPrefetcher, err = prefetcher.New(mainCtx, prefetcher.Config{
+			CheckFrequency: time.Second,
+			Lead:           time.Duration(*prefetchLead) * time.Second,
+			MinOccurrences: *prefetchOccurrences,
+			MaxPatterns:    *prefetchMaxPatterns,
+			MaxConcurrency: *prefetchConcurrency,
+			Fetcher:        prefetchRead,
+			Logger:         log,
+		}); err != nil {
+			log.Fatalf(1, "[Main] Can't spawn prefetcher: %v", err)
+		}
+	}
+
+	// Setup the retention policies resolutions
+	resolutions, err := parseNamedLimits(*rpResolutionsList, 1)
+	if err != nil {
+		log.Fatalf(1, "[Main] Invalid retention policies resolutions: %v", err)
+	}
+	rpResolutions = make(map[string]time.Duration, len(resolutions))
+	for rp, seconds := range resolutions {
+		rpResolutions[rp] = time.Duration(seconds) * time.Second
+	}
+
+	// Setup the read requests limits
+	readMaxBody = int64(*readMaxBodySize) * 1024
+	readMaxDecoded = int64(*readMaxDecodedSize) * 1024
+	readMaxQueries = *readMaxQueriesCount
+	readMaxMatchers = *readMaxMatchersCount
+
+	// Setup the read responses limits
+	if responseMaxBytes, err = parseNamedLimits(*responseBytesLimits, 1024*1024); err != nil {
+		log.Fatalf(1, "[Main] Invalid response max bytes: %v", err)
+	}
+	if responseMaxSeries, err = parseNamedLimits(*responseSeriesLimits, 1); err != nil {
+		log.Fatalf(1, "[Main] Invalid response max series: %v", err)
+	}
+	if responseMaxSamples, err = parseNamedLimits(*responseSamplesLimits, 1); err != nil {
+		log.Fatalf(1, "[Main] Invalid response max samples: %v", err)
+	}
+
+	// Create the rate limiter
+	if *rateLimitKeyBy != "" {
+		switch *rateLimitKeyBy {
+		case rateLimitByUser, rateLimitByAddress, rateLimitByDatabase:
+		default:
+			log.Fatalf(1, "[Main] Invalid rate limit key '%s': must be 'user', 'address' or 'database'", *rateLimitKeyBy)
+		}
+		readLimiterKey = *rateLimitKeyBy
+		if readLimiter, err = ratelimit.New(mainCtx, ratelimit.Config{
+			RequestsPerSecond: *rateLimitRequests,
+			Burst:             *rateLimitBurst,
+			BytesPerMinute:    int64(*rateLimitBytes) * 1024 * 1024,
+			CleanFrequency:    time.Minute,
+			Logger:            log,
+		}); err != nil {
+			log.Fatalf(1, "[Main] Can't spawn rate limiter: %v", err)
+		}
+	}
+
+	// Create the upstream scheduler
+	if *schedulerMaxConns > 0 {
+		rpLimits, err := parseNamedLimits(*schedulerMaxRPConns, 1)
+		if err != nil {
+			log.Fatalf(1, "[Main] Invalid scheduler max rp concurrency: %v", err)
+		}
+		maxPerRP := make(map[string]int, len(rpLimits))
+		for rp, limit := range rpLimits {
+			maxPerRP[rp] = int(limit)
+		}
+		if readScheduler, err = scheduler.New(scheduler.Config{
+			MaxPerBackend: *schedulerMaxConns,
+			MaxPerRP:      maxPerRP,
+			QueueTimeout:  time.Duration(*schedulerQueueTimeout) * time.Second,
+			Logger:        log,
+		}); err != nil {
+			log.Fatalf(1, "[Main] Can't spawn scheduler: %v", err)
+		}
+		schedulerHighDrift = time.Duration(*schedulerHighDriftDur) * time.Hour
+		schedulerLowDrift = time.Duration(*schedulerLowDriftDur) * time.Hour
+	}
+
+	// Create the admission controller
+	if *admissionMaxRange != "" || *admissionRequireName || *admissionBanEmptyRe || *admissionMaxSeries > 0 {
+		maxRange, err := admission.ParseMaxRange(*admissionMaxRange)
+		if err != nil {
+			log.Fatalf(1, "[Main] Invalid admission max range: %v", err)
+		}
+		if readAdmission, err = admission.New(admission.Config{
+			MaxRange:      maxRange,
+			RequireName:   *admissionRequireName,
+			BanEmptyRegex: *admissionBanEmptyRe,
+			MaxSeries:     *admissionMaxSeries,
+			Logger:        log,
+		}); err != nil {
+			log.Fatalf(1, "[Main] Can't spawn admission controller: %v", err)
+		}
+	}
+
+	// Setup sharded fetching
+	if *shardedFetchHours > 0 {
+		if *shardedFetchPool <= 0 {
+			log.Fatal(1, "[Main] The number of sharded fetch workers must be positive")
+		}
+		if *shardedFetchParts <= 0 {
+			log.Fatal(1, "[Main] The sharded fetch max parts must be positive")
+		}
+		shardedFetchMaxParts = *shardedFetchParts
+		shardedFetchThreshold = time.Duration(*shardedFetchHours) * time.Hour
+		shardedFetchWorkers = *shardedFetchPool
+	}
+
+	// Create the read coalescer
+	if *coalesceReads {
+		readCoalescer = coalescer.New()
 	}
 
 	// Init the stats metrics
@@ -86,6 +370,21 @@ func main() {
 		log.Fatalf(1, "[Main] Can't init stats metrics: %v", err)
 	}
 
+	// Create the PromQL engine
+	promqlEngine = promql.NewEngine(promql.EngineOpts{
+		Reg:           promRegistry,
+		MaxConcurrent: *queryMaxConcurrency,
+		MaxSamples:    *queryMaxSamples,
+		Timeout:       time.Duration(*queryTimeout) * time.Second,
+	})
+
+	// Load the warm up databases
+	if *warmupDatabases != "" {
+		if err = warmUp(*warmupDatabases, *warmupUser, *warmupPasswordFile); err != nil {
+			log.Fatalf(1, "[Main] Can't warm up the cache: %v", err)
+		}
+	}
+
 	// Init signal handler
 	term := make(chan os.Signal, 1)
 	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
@@ -93,15 +392,53 @@ func main() {
 		<-term
 		exit()
 	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("[Main] SIGHUP received: invalidating the retention policies and result caches")
+			cache.Invalidate("")
+			if resultCache != nil {
+				resultCache.Purge("")
+			}
+		}
+	}()
 
 	// Launch the web server
 	httpServer = &http.Server{
 		Addr: *bindAddr,
 	}
 	http.HandleFunc("/smartread", wrapHandlerWithLogging(readHandler))
+	http.HandleFunc("/smartread/explain", wrapHandlerWithLogging(explainHandler))
+	http.HandleFunc("/write", wrapHandlerWithLogging(writeHandler))
+	http.HandleFunc("/api/v1/query", wrapHandlerWithLogging(queryHandler))
+	http.HandleFunc("/api/v1/query_range", wrapHandlerWithLogging(queryRangeHandler))
+	http.HandleFunc("/api/v1/series", wrapHandlerWithLogging(seriesHandler))
+	http.HandleFunc("/api/v1/labels", wrapHandlerWithLogging(labelsHandler))
+	http.HandleFunc("/api/v1/label/", wrapHandlerWithLogging(labelValuesHandler))
+	http.HandleFunc("/federate", wrapHandlerWithLogging(federateHandler))
+	http.HandleFunc("/debug/read", wrapHandlerWithLogging(debugReadHandler))
 	http.Handle("/metrics", promHandler())
 	log.Infof("[Main] Starting HTTP server on %s", *bindAddr)
 
+	// Operator endpoints are kept away from the clients listener
+	if *adminBindAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/admin/cache/invalidate", wrapHandlerWithLogging(invalidateHandler))
+		adminMux.HandleFunc("/api/v1/rps", wrapHandlerWithLogging(rpsHandler))
+		adminMux.Handle("/metrics", adminPromHandler())
+		adminServer = &http.Server{
+			Addr:    *adminBindAddr,
+			Handler: adminMux,
+		}
+		log.Infof("[Main] Starting admin HTTP server on %s", *adminBindAddr)
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("[Main] Admin HTTP Server: %v", err)
+			}
+		}()
+	}
+
 	// Ready, start the server
 	if err = systemd.NotifyReady(); err != nil {
 		log.Errorf("[Main] Can't send systemd ready notification: %v", err)
@@ -129,10 +466,107 @@ func exit() {
 	if err = httpServer.Shutdown(stopContext); err != nil {
 		log.Errorf("[Main] HTTP Server shutdown: %v", err)
 	}
+	if adminServer != nil {
+		if err = adminServer.Shutdown(stopContext); err != nil {
+			log.Errorf("[Main] Admin HTTP Server shutdown: %v", err)
+		}
+	}
 	// Then properly the other workers
 	mainCancel()
 	log.Debug("[Main] Stopping the cacher")
 	cache.WaitFullStop()
+	if writeBuffer != nil {
+		log.Debug("[Main] Stopping the write buffer")
+		writeBuffer.WaitFullStop()
+	}
+	if readLimiter != nil {
+		log.Debug("[Main] Stopping the rate limiter")
+		readLimiter.WaitFullStop()
+	}
+	if readPrefetcher != nil {
+		log.Debug("[Main] Stopping the prefetcher")
+		readPrefetcher.WaitFullStop()
+	}
 	// Release the main gorouting to exit
 	mainLock.Unlock()
 }
+
+// loadSnapshotSecret reads the secret keying the snapshotted credentials hashes. Without secretFile, the
+// secret is kept next to snapshotFile and generated at first start: authorizations then survive restarts.
+func loadSnapshotSecret(secretFile, snapshotFile string) (secret []byte, err error) {
+	if secretFile == "" {
+		secretFile = snapshotFile + snapshotSecretSuffix
+		if secret, err = generateSecretFile(secretFile); err != nil {
+			return
+		}
+		if secret != nil {
+			log.Infof("[Main] Cache snapshot secret generated in '%s'", secretFile)
+			return
+		}
+	}
+	if secret, err = ioutil.ReadFile(secretFile); err != nil {
+		return nil, fmt.Errorf("can't read secret file: %v", err)
+	}
+	if secret = bytes.TrimSpace(secret); len(secret) == 0 {
+		return nil, fmt.Errorf("secret file '%s' is empty", secretFile)
+	}
+	return
+}
+
+// generateSecretFile writes a random secret to path (readable by its owner only) if it does not exist yet.
+// secret is nil if the file already exists.
+func generateSecretFile(path string) (secret []byte, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			err = nil
+		} else {
+			err = fmt.Errorf("can't create secret file: %v", err)
+		}
+		return
+	}
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("can't generate secret: %v", err)
+	}
+	secret = []byte(hex.EncodeToString(raw))
+	if _, err = file.Write(append(secret, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("can't write secret file: %v", err)
+	}
+	return
+}
+
+// warmUp loads and pins the retention policies of each database of the comma separated list
+func warmUp(databases, user, passwordFile string) (err error) {
+	var password []byte
+	if passwordFile != "" {
+		if password, err = ioutil.ReadFile(passwordFile); err != nil {
+			return fmt.Errorf("can't read password file: %v", err)
+		}
+	}
+	start := time.Now()
+	var count int
+	for _, database := range strings.Split(databases, ",") {
+		if database = strings.TrimSpace(database); database == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(mainCtx, warmUpTimeout)
+		err = cache.Pin(ctx, influxURL, database, user, string(bytes.TrimSpace(password)))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("can't load '%s' database: %w", database, err)
+		}
+		count++
+	}
+	log.Infof("[Main] %d database(s) loaded in the cache in %v", count, time.Since(start))
+	return
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hekmon/hllogger"
+)
+
+func TestLoadSnapshotSecret(t *testing.T) {
+	log = hllogger.New(ioutil.Discard, nil)
+	dir, err := ioutil.TempDir("", "rrinterceptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "cache.json")
+	// Generated at first start
+	generated, err := loadSnapshotSecret("", snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 64 {
+		t.Errorf("got a %d bytes secret, expected 64 hex characters", len(generated))
+	}
+	info, err := os.Stat(snapshotFile + snapshotSecretSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("secret file mode is %v, expected 0600", info.Mode().Perm())
+	}
+	// Then kept across restarts
+	loaded, err := loadSnapshotSecret("", snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded, generated) {
+		t.Errorf("secret changed after a restart: %q, expected %q", loaded, generated)
+	}
+	// Explicit files are never generated
+	if _, err = loadSnapshotSecret(filepath.Join(dir, "missing"), snapshotFile); err == nil {
+		t.Error("expected an error for a missing secret file")
+	}
+	empty := filepath.Join(dir, "empty")
+	if err = ioutil.WriteFile(empty, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadSnapshotSecret(empty, snapshotFile); err == nil {
+		t.Error("expected an error for an empty secret file")
+	}
+}
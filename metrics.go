@@ -3,9 +3,15 @@ package main
 import (
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"rrinterceptor/admission"
+	"rrinterceptor/influxquery"
 	"rrinterceptor/promutils"
+	"rrinterceptor/ratelimit"
+	"rrinterceptor/scheduler"
+	"rrinterceptor/upstream"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,6 +21,13 @@ import (
 var (
 	promRegistry *prometheus.Registry
 	driftMetric  *prometheus.CounterVec
+	writeMetric  *prometheus.CounterVec
+	// readRejectMetric counts the read requests refused before being served
+	readRejectMetric *prometheus.CounterVec
+	// readTruncationMetric counts the read responses refused for exceeding a limit
+	readTruncationMetric *prometheus.CounterVec
+	// adminRegistry holds the metrics listing the databases of every user, only served by the admin listener
+	adminRegistry *prometheus.Registry
 )
 
 func initMetrics() (err error) {
@@ -28,14 +41,529 @@ func initMetrics() (err error) {
 		"drift",
 		"step",
 	})
+	writeMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rrinterceptor",
+		Subsystem: "writes",
+		Name:      "requests_total",
+		Help:      "Returns the number of write requests splitted by outcome: proxied, buffered, rejected (buffer full or stopped), too_large (body over the limit) or failed (backend unavailable without buffer).",
+	}, []string{
+		"outcome",
+	})
+	readRejectMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rrinterceptor",
+		Subsystem: "reads",
+		Name:      "rejected_total",
+		Help:      "Returns the number of read requests rejected splitted by reason: body_too_large, decoded_too_large, too_many_queries or too_many_matchers.",
+	}, []string{
+		"reason",
+	})
+	readTruncationMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rrinterceptor",
+		Subsystem: "reads",
+		Name:      "truncated_total",
+		Help:      "Returns the number of read responses cut off (replaced by an error) splitted by the exceeded limit: bytes, series or samples.",
+	}, []string{
+		"limit",
+	})
 	promRegistry = prometheus.NewRegistry()
-	return promRegistry.Register(driftMetric)
+	adminRegistry = prometheus.NewRegistry()
+	if err = adminRegistry.Register(rpCatalogCollector{}); err != nil {
+		return
+	}
+	if err = promRegistry.Register(driftMetric); err != nil {
+		return
+	}
+	if err = promRegistry.Register(writeMetric); err != nil {
+		return
+	}
+	if err = promRegistry.Register(readRejectMetric); err != nil {
+		return
+	}
+	if err = promRegistry.Register(readTruncationMetric); err != nil {
+		return
+	}
+	if err = promRegistry.Register(upstreamCollector{}); err != nil {
+		return
+	}
+	if err = registerCacheMetrics(); err != nil {
+		return
+	}
+	if writeBuffer != nil {
+		if err = registerWriteBufferMetrics(); err != nil {
+			return
+		}
+	}
+	if readPrefetcher != nil {
+		if err = registerPrefetcherMetrics(); err != nil {
+			return
+		}
+	}
+	if readScheduler != nil {
+		if err = registerSchedulerMetrics(); err != nil {
+			return
+		}
+	}
+	if readLimiter != nil {
+		if err = registerRateLimitMetrics(); err != nil {
+			return
+		}
+	}
+	if readAdmission != nil {
+		if err = registerAdmissionMetrics(); err != nil {
+			return
+		}
+	}
+	if shardedFetchThreshold > 0 {
+		if err = registerShardedFetchMetrics(); err != nil {
+			return
+		}
+	}
+	if readCoalescer != nil {
+		if err = registerCoalescerMetrics(); err != nil {
+			return
+		}
+	}
+	if resultCache != nil {
+		if err = registerResultCacheMetrics(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerCacheMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rp_cache",
+			Name:        "refreshes_total",
+			Help:        "Returns the number of background refreshes of the retention policies cache splitted by outcome.",
+			ConstLabels: prometheus.Labels{"outcome": "success"},
+		}, func() float64 { return float64(cache.Stats().RefreshSuccesses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rp_cache",
+			Name:        "refreshes_total",
+			Help:        "Returns the number of background refreshes of the retention policies cache splitted by outcome.",
+			ConstLabels: prometheus.Labels{"outcome": "failure"},
+		}, func() float64 { return float64(cache.Stats().RefreshFailures) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rp_cache",
+			Name:        "rp_changes_total",
+			Help:        "Returns the number of retention policies changes detected while refreshing the cache splitted by kind: added, removed or changed.",
+			ConstLabels: prometheus.Labels{"change": "added"},
+		}, func() float64 { return float64(cache.Stats().RPsAdded) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rp_cache",
+			Name:        "rp_changes_total",
+			Help:        "Returns the number of retention policies changes detected while refreshing the cache splitted by kind: added, removed or changed.",
+			ConstLabels: prometheus.Labels{"change": "removed"},
+		}, func() float64 { return float64(cache.Stats().RPsRemoved) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rp_cache",
+			Name:        "rp_changes_total",
+			Help:        "Returns the number of retention policies changes detected while refreshing the cache splitted by kind: added, removed or changed.",
+			ConstLabels: prometheus.Labels{"change": "changed"},
+		}, func() float64 { return float64(cache.Stats().RPsChanged) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "rp_cache",
+			Name:      "invalidations_total",
+			Help:      "Returns the number of cache entries dropped by an invalidation (admin endpoint or SIGHUP).",
+		}, func() float64 { return float64(cache.Stats().Invalidations) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "rp_cache",
+			Name:      "evictions_total",
+			Help:      "Returns the number of cache entries evicted because of the entries limits.",
+		}, func() float64 { return float64(cache.Stats().Evictions) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "rp_cache",
+			Name:      "entries",
+			Help:      "Returns the number of databases currently held by the retention policies cache.",
+		}, func() float64 { return float64(cache.Stats().Entries) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "meta_cache",
+			Name:      "evictions_total",
+			Help:      "Returns the number of metadata results evicted because of the entries limit.",
+		}, func() float64 { return float64(cache.Stats().MetaEvictions) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "meta_cache",
+			Name:      "entries",
+			Help:      "Returns the number of metadata results currently held by the cache.",
+		}, func() float64 { return float64(cache.Stats().MetaEntries) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "rp_cache",
+			Name:      "negative_hits_total",
+			Help:      "Returns the number of lookups answered with a remembered failure without contacting influxdb.",
+		}, func() float64 { return float64(cache.Stats().NegativeHits) }),
+	}
+	for _, kind := range []influxquery.Kind{
+		influxquery.KindUnknown,
+		influxquery.KindUnauthorized,
+		influxquery.KindForbidden,
+		influxquery.KindNotFound,
+		influxquery.KindUnavailable,
+		influxquery.KindCanceled,
+	} {
+		kind := kind
+		collectors = append(collectors, prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rp_cache",
+			Name:        "lookup_failures_total",
+			Help:        "Returns the number of failed retention policies lookups splitted by kind.",
+			ConstLabels: prometheus.Labels{"kind": kind.String()},
+		}, func() float64 { return float64(cache.Stats().LookupFailures[kind]) }))
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerPrefetcherMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "observations_total",
+			Help:      "Returns the number of read queries observed by the prefetcher.",
+		}, func() float64 { return float64(readPrefetcher.Stats().Observations) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "forgotten_total",
+			Help:      "Returns the number of read patterns forgotten because they stopped recurring or to make room.",
+		}, func() float64 { return float64(readPrefetcher.Stats().Forgotten) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "prefetches_total",
+			Help:      "Returns the number of prefetches done ahead of an expected read.",
+		}, func() float64 { return float64(readPrefetcher.Stats().Prefetches) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "prefetch_failures_total",
+			Help:      "Returns the number of prefetches which failed.",
+		}, func() float64 { return float64(readPrefetcher.Stats().PrefetchFailures) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "late_prefetches_total",
+			Help:      "Returns the number of prefetches skipped or aborted because their expected read was due.",
+		}, func() float64 { return float64(readPrefetcher.Stats().LatePrefetches) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "patterns",
+			Help:      "Returns the number of read patterns currently learned.",
+		}, func() float64 { return float64(readPrefetcher.Stats().Patterns) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "prefetcher",
+			Name:      "recurring_patterns",
+			Help:      "Returns the number of learned read patterns considered recurring.",
+		}, func() float64 { return float64(readPrefetcher.Stats().Recurring) }),
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerSchedulerMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "scheduler",
+			Name:      "in_flight",
+			Help:      "Returns the number of upstream reads currently in flight.",
+		}, func() float64 { return float64(readScheduler.Stats().InFlight) }),
+	}
+	for _, class := range scheduler.Classes {
+		class := class
+		collectors = append(collectors,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   "rrinterceptor",
+				Subsystem:   "scheduler",
+				Name:        "queue_depth",
+				Help:        "Returns the number of upstream reads currently waiting for a slot by priority class.",
+				ConstLabels: prometheus.Labels{"class": class.String()},
+			}, func() float64 { return float64(readScheduler.Stats().QueueDepth[class]) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   "rrinterceptor",
+				Subsystem:   "scheduler",
+				Name:        "granted_total",
+				Help:        "Returns the number of upstream reads allowed to be sent by priority class.",
+				ConstLabels: prometheus.Labels{"class": class.String()},
+			}, func() float64 { return float64(readScheduler.Stats().Granted[class]) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   "rrinterceptor",
+				Subsystem:   "scheduler",
+				Name:        "queue_timeouts_total",
+				Help:        "Returns the number of upstream reads which waited too long for a slot by priority class.",
+				ConstLabels: prometheus.Labels{"class": class.String()},
+			}, func() float64 { return float64(readScheduler.Stats().Timeouts[class]) }),
+		)
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerRateLimitMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "rate_limit",
+			Name:      "clients",
+			Help:      "Returns the number of rate limit keys currently tracked (keys with full buckets are forgotten).",
+		}, func() float64 { return float64(readLimiter.Stats().Clients) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "rate_limit",
+			Name:      "throttled_clients",
+			Help:      "Returns the number of rate limit keys currently over one of their limits.",
+		}, func() float64 { return float64(readLimiter.Stats().Throttled) }),
+	}
+	for _, limit := range []string{ratelimit.LimitRequests, ratelimit.LimitBytes} {
+		limit := limit
+		collectors = append(collectors, prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "rate_limit",
+			Name:        "rejections_total",
+			Help:        "Returns the number of reads rejected by each rate limit.",
+			ConstLabels: prometheus.Labels{"limit": limit},
+		}, func() float64 { return float64(readLimiter.Stats().Rejections[limit]) }))
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerAdmissionMetrics() (err error) {
+	var collectors []prometheus.Collector
+	for _, rule := range []string{admission.RuleMaxRange, admission.RuleRequireName, admission.RuleEmptyRegex,
+		admission.RuleMaxSeries, admission.RuleValidMatchers} {
+		rule := rule
+		collectors = append(collectors, prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "rrinterceptor",
+			Subsystem:   "admission",
+			Name:        "rejections_total",
+			Help:        "Returns the number of read requests rejected by each admission rule.",
+			ConstLabels: prometheus.Labels{"rule": rule},
+		}, func() float64 { return float64(readAdmission.Stats().Rejections[rule]) }))
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerShardedFetchMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "sharded_fetch",
+			Name:      "reads_total",
+			Help:      "Returns the number of reads split in concurrent upstream requests.",
+		}, func() float64 { return float64(atomic.LoadUint64(&shardedReads)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "sharded_fetch",
+			Name:      "upstream_requests_total",
+			Help:      "Returns the number of upstream requests sent for the split reads.",
+		}, func() float64 { return float64(atomic.LoadUint64(&shardedSubReads)) }),
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerCoalescerMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "read_coalescing",
+			Name:      "leaders_total",
+			Help:      "Returns the number of upstream reads actually sent to influxdb.",
+		}, func() float64 { return float64(readCoalescer.Stats().Leaders) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "read_coalescing",
+			Name:      "followers_total",
+			Help:      "Returns the number of reads served by an identical in flight upstream read.",
+		}, func() float64 { return float64(readCoalescer.Stats().Followers) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "read_coalescing",
+			Name:      "abandons_total",
+			Help:      "Returns the number of reads whose client went away while waiting for the upstream read.",
+		}, func() float64 { return float64(readCoalescer.Stats().Abandons) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "read_coalescing",
+			Name:      "in_flight",
+			Help:      "Returns the number of upstream reads currently in flight.",
+		}, func() float64 { return float64(readCoalescer.Stats().InFlight) }),
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerResultCacheMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "hits_total",
+			Help:      "Returns the number of result blocks served by the result cache (memory or disk).",
+		}, func() float64 { return float64(resultCache.Stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "disk_hits_total",
+			Help:      "Returns the number of result blocks served by the result cache disk tier.",
+		}, func() float64 { return float64(resultCache.Stats().DiskHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "misses_total",
+			Help:      "Returns the number of immutable result blocks which had to be fetched from influxdb.",
+		}, func() float64 { return float64(resultCache.Stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "served_bytes_total",
+			Help:      "Returns the number of bytes (uncompressed protobuf) of the result blocks served by the result cache.",
+		}, func() float64 { return float64(resultCache.Stats().ServedBytes) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "stored_bytes_total",
+			Help:      "Returns the number of bytes (uncompressed protobuf) of the result blocks stored in the result cache.",
+		}, func() float64 { return float64(resultCache.Stats().StoredBytes) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "evictions_total",
+			Help:      "Returns the number of result blocks evicted from memory.",
+		}, func() float64 { return float64(resultCache.Stats().Evictions) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "memory_bytes",
+			Help:      "Returns the number of bytes held by the result cache memory tier.",
+		}, func() float64 { return float64(resultCache.Stats().MemoryBytes) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "memory_blocks",
+			Help:      "Returns the number of result blocks held by the result cache memory tier.",
+		}, func() float64 { return float64(resultCache.Stats().MemoryEntries) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "disk_bytes",
+			Help:      "Returns the number of bytes held by the result cache disk tier.",
+		}, func() float64 { return float64(resultCache.Stats().DiskBytes) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "result_cache",
+			Name:      "disk_blocks",
+			Help:      "Returns the number of result blocks held by the result cache disk tier.",
+		}, func() float64 { return float64(resultCache.Stats().DiskEntries) }),
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func registerWriteBufferMetrics() (err error) {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "writebuffer",
+			Name:      "size_bytes",
+			Help:      "Returns the number of bytes currently held by the write buffer segments.",
+		}, func() float64 { return float64(writeBuffer.Stats().Size) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "writebuffer",
+			Name:      "segments",
+			Help:      "Returns the number of segments currently held by the write buffer.",
+		}, func() float64 { return float64(writeBuffer.Stats().Segments) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "writebuffer",
+			Name:      "appended_total",
+			Help:      "Returns the number of write requests appended to the write buffer.",
+		}, func() float64 { return float64(writeBuffer.Stats().Appended) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "writebuffer",
+			Name:      "replayed_total",
+			Help:      "Returns the number of buffered write requests successfully replayed to influxdb.",
+		}, func() float64 { return float64(writeBuffer.Stats().Replayed) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "writebuffer",
+			Name:      "dropped_total",
+			Help:      "Returns the number of buffered write requests dropped because influxdb rejected them.",
+		}, func() float64 { return float64(writeBuffer.Stats().Dropped) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "rrinterceptor",
+			Subsystem: "writebuffer",
+			Name:      "replay_errors_total",
+			Help:      "Returns the number of replay attempts interrupted by a transient error.",
+		}, func() float64 { return float64(writeBuffer.Stats().ReplayErrors) }),
+	}
+	for _, collector := range collectors {
+		if err = promRegistry.Register(collector); err != nil {
+			return
+		}
+	}
+	return
 }
 
 func promHandler() http.Handler {
 	return promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})
 }
 
+func adminPromHandler() http.Handler {
+	return promhttp.HandlerFor(adminRegistry, promhttp.HandlerOpts{})
+}
+
 func updateDriftStats(req prompb.ReadRequest) {
 	var (
 		drift, step            time.Duration
@@ -62,3 +590,90 @@ func updateDriftStats(req prompb.ReadRequest) {
 			hourDrift, secondsStep)
 	}
 }
+
+var (
+	rpDurationDesc = prometheus.NewDesc("rrinterceptor_rp_duration_seconds",
+		"Returns the duration of each cached retention policy (0 for infinite).", []string{"backend", "db", "rp"}, nil)
+	rpShardGroupDurationDesc = prometheus.NewDesc("rrinterceptor_rp_shard_group_duration_seconds",
+		"Returns the shard group duration of each cached retention policy.", []string{"backend", "db", "rp"}, nil)
+	rpReplicaNDesc = prometheus.NewDesc("rrinterceptor_rp_replica_n",
+		"Returns the replication factor of each cached retention policy.", []string{"backend", "db", "rp"}, nil)
+	rpDefaultDesc = prometheus.NewDesc("rrinterceptor_rp_default",
+		"Returns 1 if the cached retention policy is the default one of its database, 0 otherwise.", []string{"backend", "db", "rp"}, nil)
+	rpCacheAgeDesc = prometheus.NewDesc("rrinterceptor_rp_cache_age_seconds",
+		"Returns the age of the cached retention policies of each database.", []string{"backend", "db"}, nil)
+	rpCacheStaleDesc = prometheus.NewDesc("rrinterceptor_rp_cache_stale",
+		"Returns 1 if the cached retention policies of the database are waiting for a refresh, 0 otherwise.", []string{"backend", "db"}, nil)
+)
+
+// rpCatalogCollector exports the retention policies catalog held by the cacher
+type rpCatalogCollector struct{}
+
+func (rpCatalogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rpDurationDesc
+	ch <- rpShardGroupDurationDesc
+	ch <- rpReplicaNDesc
+	ch <- rpDefaultDesc
+	ch <- rpCacheAgeDesc
+	ch <- rpCacheStaleDesc
+}
+
+func (rpCatalogCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	var isDefault, isStale float64
+	for _, cached := range cache.Catalog() {
+		if cached.Stale {
+			isStale = 1
+		} else {
+			isStale = 0
+		}
+		ch <- prometheus.MustNewConstMetric(rpCacheAgeDesc, prometheus.GaugeValue, now.Sub(cached.Created).Seconds(), cached.Backend, cached.Database)
+		ch <- prometheus.MustNewConstMetric(rpCacheStaleDesc, prometheus.GaugeValue, isStale, cached.Backend, cached.Database)
+		for name, rp := range cached.RPs {
+			if rp.Default {
+				isDefault = 1
+			} else {
+				isDefault = 0
+			}
+			ch <- prometheus.MustNewConstMetric(rpDurationDesc, prometheus.GaugeValue, rp.Duration.Seconds(), cached.Backend, cached.Database, name)
+			ch <- prometheus.MustNewConstMetric(rpShardGroupDurationDesc, prometheus.GaugeValue, rp.ShardGroupDuration.Seconds(), cached.Backend, cached.Database, name)
+			ch <- prometheus.MustNewConstMetric(rpReplicaNDesc, prometheus.GaugeValue, float64(rp.ReplicaN), cached.Backend, cached.Database, name)
+			ch <- prometheus.MustNewConstMetric(rpDefaultDesc, prometheus.GaugeValue, isDefault, cached.Backend, cached.Database, name)
+		}
+	}
+}
+
+var (
+	upstreamDialsDesc = prometheus.NewDesc("rrinterceptor_upstream_connections_opened_total",
+		"Returns the number of connections opened to each influxdb backend.", []string{"backend"}, nil)
+	upstreamClosesDesc = prometheus.NewDesc("rrinterceptor_upstream_connections_closed_total",
+		"Returns the number of connections to each influxdb backend which have been closed.", []string{"backend"}, nil)
+	upstreamOpenDesc = prometheus.NewDesc("rrinterceptor_upstream_connections_open",
+		"Returns the number of connections (active or idle) currently open to each influxdb backend.", []string{"backend"}, nil)
+	upstreamRequestsDesc = prometheus.NewDesc("rrinterceptor_upstream_requests_total",
+		"Returns the number of requests sent to each influxdb backend.", []string{"backend"}, nil)
+	upstreamReusedDesc = prometheus.NewDesc("rrinterceptor_upstream_reused_connections_total",
+		"Returns the number of requests sent to each influxdb backend over an already open connection.", []string{"backend"}, nil)
+)
+
+// upstreamCollector exports the connections usage of each influxdb backend
+type upstreamCollector struct{}
+
+func (upstreamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamDialsDesc
+	ch <- upstreamClosesDesc
+	ch <- upstreamOpenDesc
+	ch <- upstreamRequestsDesc
+	ch <- upstreamReusedDesc
+}
+
+func (upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, backend := range upstream.All() {
+		stats := backend.Stats()
+		ch <- prometheus.MustNewConstMetric(upstreamDialsDesc, prometheus.CounterValue, float64(stats.Dials), stats.Host)
+		ch <- prometheus.MustNewConstMetric(upstreamClosesDesc, prometheus.CounterValue, float64(stats.Closes), stats.Host)
+		ch <- prometheus.MustNewConstMetric(upstreamOpenDesc, prometheus.GaugeValue, float64(stats.Open), stats.Host)
+		ch <- prometheus.MustNewConstMetric(upstreamRequestsDesc, prometheus.CounterValue, float64(stats.Requests), stats.Host)
+		ch <- prometheus.MustNewConstMetric(upstreamReusedDesc, prometheus.CounterValue, float64(stats.Reused), stats.Host)
+	}
+}
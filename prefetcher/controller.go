@@ -0,0 +1,137 @@
+package prefetcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+// Fetcher reads the series of pattern between start and end in order to populate the result cache
+type Fetcher func(ctx context.Context, pattern Pattern, start, end time.Time) error
+
+// Config allow to pass values to the contructor
+type Config struct {
+	CheckFrequency time.Duration
+	Lead           time.Duration // how long before the next expected read the prefetch is done
+	MinOccurrences int           // regular reads needed before a pattern is considered recurring
+	MaxPatterns    int           // 0 for unlimited
+	MaxConcurrency int           // prefetches done at the same time
+	Fetcher        Fetcher
+	Logger         *hllogger.HlLogger
+}
+
+// New returns an initialized and ready to use prefetcher controller
+func New(ctx context.Context, conf Config) (c *Controller, err error) {
+	if conf.Logger == nil {
+		err = errors.New("logger can't be nil")
+		return
+	}
+	if conf.Fetcher == nil {
+		err = errors.New("fetcher can't be nil")
+		return
+	}
+	if conf.CheckFrequency <= 0 {
+		err = errors.New("check frequency must be positive")
+		return
+	}
+	if conf.MaxConcurrency <= 0 {
+		err = errors.New("max concurrency must be positive")
+		return
+	}
+	if conf.MinOccurrences < 2 {
+		err = errors.New("at least 2 occurrences are needed to learn a refresh cadence")
+		return
+	}
+	// Init controller
+	c = &Controller{
+		patterns:       make(map[string]*learned),
+		lead:           conf.Lead,
+		minOccurrences: conf.MinOccurrences,
+		maxPatterns:    conf.MaxPatterns,
+		fetcher:        conf.Fetcher,
+		slots:          make(chan struct{}, conf.MaxConcurrency),
+		log:            conf.Logger,
+		ctx:            ctx,
+		stopped:        make(chan struct{}),
+	}
+	// Start worker
+	c.workers.Add(1)
+	go c.scheduler(conf.CheckFrequency)
+	// Launch the stop watcher
+	go c.stopWatcher()
+	// All good
+	return
+}
+
+// Controller learns the recurring reads and prefetches them before they are expected
+type Controller struct {
+	// Patterns
+	access         sync.Mutex
+	patterns       map[string]*learned
+	lead           time.Duration
+	minOccurrences int
+	maxPatterns    int
+	fetcher        Fetcher
+	slots          chan struct{} // one per prefetch in progress
+	// Stats
+	observations     uint64
+	forgotten        uint64
+	prefetches       uint64
+	prefetchFailures uint64
+	latePrefetches   uint64
+	// Sub Controllers
+	log *hllogger.HlLogger
+	// Workers
+	ctx     context.Context
+	workers sync.WaitGroup
+	stopped chan struct{}
+}
+
+// Stats contains the prefetcher counters
+type Stats struct {
+	Observations     uint64
+	Forgotten        uint64 // patterns dropped because they stopped recurring or to make room
+	Prefetches       uint64
+	PrefetchFailures uint64
+	LatePrefetches   uint64 // skipped or aborted as their expected read was due
+	Patterns         int
+	Recurring        int
+}
+
+// Stats returns the current counters of the prefetcher
+func (c *Controller) Stats() (stats Stats) {
+	stats = Stats{
+		Observations:     atomic.LoadUint64(&c.observations),
+		Forgotten:        atomic.LoadUint64(&c.forgotten),
+		Prefetches:       atomic.LoadUint64(&c.prefetches),
+		PrefetchFailures: atomic.LoadUint64(&c.prefetchFailures),
+		LatePrefetches:   atomic.LoadUint64(&c.latePrefetches),
+	}
+	c.access.Lock()
+	stats.Patterns = len(c.patterns)
+	for _, l := range c.patterns {
+		if c.recurring(l) {
+			stats.Recurring++
+		}
+	}
+	c.access.Unlock()
+	return
+}
+
+func (c *Controller) stopWatcher() {
+	<-c.ctx.Done()
+	c.log.Debugf("[Prefetcher] Stop signal received: waiting for workers to stop")
+	c.workers.Wait()
+	c.log.Debugf("[Prefetcher] All workers have stopped")
+	close(c.stopped)
+}
+
+// WaitFullStop will block until all workers have ended
+// folowing the cancellation of ctx
+func (c *Controller) WaitFullStop() {
+	<-c.stopped
+}
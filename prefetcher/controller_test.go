@@ -0,0 +1,223 @@
+package prefetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// fakeFetcher records the prefetches, blocking them until release is closed if set
+type fakeFetcher struct {
+	access  sync.Mutex
+	ranges  map[string][2]time.Time // by database
+	current int
+	peak    int
+	release chan struct{}
+}
+
+func (ff *fakeFetcher) fetch(ctx context.Context, pattern Pattern, start, end time.Time) error {
+	ff.access.Lock()
+	ff.ranges[pattern.Database] = [2]time.Time{start, end}
+	if ff.current++; ff.current > ff.peak {
+		ff.peak = ff.current
+	}
+	ff.access.Unlock()
+	var err error
+	if ff.release != nil {
+		select {
+		case <-ff.release:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	ff.access.Lock()
+	ff.current--
+	ff.access.Unlock()
+	return err
+}
+
+func (ff *fakeFetcher) fetched() map[string][2]time.Time {
+	ff.access.Lock()
+	defer ff.access.Unlock()
+	fetched := make(map[string][2]time.Time, len(ff.ranges))
+	for database, timeRange := range ff.ranges {
+		fetched[database] = timeRange
+	}
+	return fetched
+}
+
+func newTestPrefetcher(t *testing.T, ctx context.Context, ff *fakeFetcher, maxPatterns, maxConcurrency int) *Controller {
+	ff.ranges = make(map[string][2]time.Time)
+	c, err := New(ctx, Config{
+		CheckFrequency: time.Hour, // batches are run by the tests
+		Lead:           10 * time.Second,
+		MinOccurrences: 3,
+		MaxPatterns:    maxPatterns,
+		MaxConcurrency: maxConcurrency,
+		Fetcher:        ff.fetch,
+		Logger:         hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testPattern(database string) Pattern {
+	return Pattern{
+		Database:        database,
+		RetentionPolicy: "autogen",
+		User:            "user",
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"},
+		},
+		Range:  time.Hour,
+		StepMs: 60000,
+	}
+}
+
+// observeEvery observes pattern at each of the given offsets (relative to now)
+func observeEvery(c *Controller, pattern Pattern, offsets ...time.Duration) {
+	now := time.Now()
+	for _, offset := range offsets {
+		c.Observe(pattern, now.Add(offset))
+	}
+}
+
+func TestCadenceLearning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestPrefetcher(t, ctx, &fakeFetcher{}, 0, 1)
+	minute := time.Minute
+	// Reads of the same refresh and slightly jittered intervals do not break the cadence
+	observeEvery(c, testPattern("regular"), -3*minute, -3*minute+time.Second, -2*minute+5*time.Second, -minute)
+	// A changing interval starts the learning again
+	observeEvery(c, testPattern("irregular"), -10*minute, -9*minute, -5*minute)
+	// A single read is not a cadence
+	observeEvery(c, testPattern("once"), -minute)
+	stats := c.Stats()
+	if stats.Observations != 8 || stats.Patterns != 3 || stats.Recurring != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	l := c.patterns[testPattern("regular").key()]
+	if l.occurrences != 3 || absDuration(l.cadence-time.Minute) > 5*time.Second {
+		t.Errorf("got %d occurrences every %v, expected 3 every minute", l.occurrences, l.cadence)
+	}
+	// Neither the milliseconds of the range nor the order of the matchers make another pattern
+	jittered := testPattern("regular")
+	jittered.Range += 300 * time.Millisecond
+	jittered.Matchers = []*prompb.LabelMatcher{jittered.Matchers[1], jittered.Matchers[0]}
+	c.Observe(jittered, time.Now())
+	if l.occurrences != 4 || len(c.patterns) != 3 {
+		t.Errorf("jittered read: got %d occurrences and %d patterns, expected 4 and 3", l.occurrences, len(c.patterns))
+	}
+}
+
+func TestForgetPatterns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestPrefetcher(t, ctx, &fakeFetcher{}, 3, 1)
+	minute := time.Minute
+	observeEvery(c, testPattern("missed"), -10*minute, -9*minute, -8*minute) // 3 expected reads missed
+	observeEvery(c, testPattern("alive"), -3*minute, -2*minute, -minute)
+	observeEvery(c, testPattern("once"), -2*time.Hour) // never read again
+	c.schedulerBatch()
+	if _, found := c.patterns[testPattern("alive").key()]; !found || len(c.patterns) != 1 {
+		t.Errorf("expected only the 'alive' pattern to be kept, got %d patterns", len(c.patterns))
+	}
+	if stats := c.Stats(); stats.Forgotten != 2 {
+		t.Errorf("got %d forgotten patterns, expected 2", stats.Forgotten)
+	}
+	// Over the limit, the pattern seen the longest time ago makes room
+	observeEvery(c, testPattern("second"), -30*time.Second)
+	observeEvery(c, testPattern("third"), -20*time.Second)
+	observeEvery(c, testPattern("fourth"), -10*time.Second)
+	if _, found := c.patterns[testPattern("alive").key()]; found || len(c.patterns) != 3 {
+		t.Errorf("expected the oldest pattern to make room, got %d patterns", len(c.patterns))
+	}
+}
+
+func TestPrefetchDue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ff := &fakeFetcher{}
+	c := newTestPrefetcher(t, ctx, ff, 0, 2)
+	minute := time.Minute
+	observeEvery(c, testPattern("due"), -2*minute-55*time.Second, -minute-55*time.Second, -55*time.Second) // expected in 5s
+	observeEvery(c, testPattern("later"), -2*minute, -minute, 0)                                           // expected in 1m
+	c.schedulerBatch()
+	cancel()
+	c.WaitFullStop()
+	fetched := ff.fetched()
+	if len(fetched) != 1 {
+		t.Fatalf("expected only the 'due' pattern to be prefetched, got %v", fetched)
+	}
+	l := c.patterns[testPattern("due").key()]
+	expected := l.lastSeen.Add(l.cadence)
+	if timeRange := fetched["due"]; !timeRange[1].Equal(expected) || !timeRange[0].Equal(expected.Add(-time.Hour)) {
+		t.Errorf("prefetched %v, expected the hour before %v", timeRange, expected)
+	}
+	// Done once per expected read
+	if !l.prefetched {
+		t.Error("pattern not marked as prefetched")
+	}
+	if stats := c.Stats(); stats.Prefetches != 1 || stats.PrefetchFailures != 0 || stats.LatePrefetches != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPrefetchConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ff := &fakeFetcher{release: make(chan struct{})}
+	c := newTestPrefetcher(t, ctx, ff, 0, 2)
+	minute := time.Minute
+	for _, database := range []string{"a", "b", "c", "d"} {
+		observeEvery(c, testPattern(database), -2*minute-55*time.Second, -minute-55*time.Second, -55*time.Second)
+	}
+	batchDone := make(chan struct{})
+	go func() {
+		c.schedulerBatch()
+		close(batchDone)
+	}()
+	// The batch waits for a free slot
+	select {
+	case <-batchDone:
+		t.Fatal("4 prefetches started at once with a max concurrency of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(ff.release)
+	<-batchDone
+	cancel()
+	c.WaitFullStop()
+	if ff.peak != 2 || len(ff.fetched()) != 4 {
+		t.Errorf("got %d prefetches with a peak of %d at a time, expected 4 with 2 at a time", len(ff.fetched()), ff.peak)
+	}
+}
+
+func TestLatePrefetches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Never completes: aborted once its read is expected
+	ff := &fakeFetcher{release: make(chan struct{})}
+	c := newTestPrefetcher(t, ctx, ff, 0, 1)
+	expected := time.Now().Add(50 * time.Millisecond)
+	c.execute(prefetch{pattern: testPattern("slow"), expected: expected})
+	if time.Now().Before(expected) {
+		t.Error("prefetch aborted before its expected read")
+	}
+	// Already expected: skipped
+	c.execute(prefetch{pattern: testPattern("skipped"), expected: time.Now().Add(-time.Second)})
+	if _, found := ff.fetched()["skipped"]; found {
+		t.Error("late prefetch has been done")
+	}
+	if stats := c.Stats(); stats.Prefetches != 1 || stats.LatePrefetches != 2 || stats.PrefetchFailures != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,130 @@
+package prefetcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// reads of the same pattern closer than this are considered part of the same refresh
+	minCadence = 5 * time.Second
+	// relative difference allowed between two intervals of a recurring pattern
+	cadenceTolerance = 0.25
+	// a pattern whose expected reads did not happen this many times is forgotten
+	maxMissedReads = 3
+	// a pattern seen only once is forgotten after this delay
+	singleReadExpiration = time.Hour
+)
+
+// Pattern identifies a read: its credentials, its matchers, its range ending at read time and its step
+type Pattern struct {
+	Database        string
+	RetentionPolicy string
+	User            string
+	Password        string
+	Matchers        []*prompb.LabelMatcher
+	Range           time.Duration
+	StepMs          int64
+}
+
+func (p Pattern) key() string {
+	matchers := make([]string, len(p.Matchers))
+	for index, matcher := range p.Matchers {
+		matchers[index] = matcher.Type.String() + "\x00" + matcher.Name + "\x00" + matcher.Value
+	}
+	sort.Strings(matchers)
+	hash := sha256.New()
+	for _, part := range []string{p.Database, p.RetentionPolicy, p.User,
+		strconv.FormatInt(int64(p.Range/time.Second), 10), strconv.FormatInt(p.StepMs, 10)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	for _, matcher := range matchers {
+		hash.Write([]byte(matcher))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// learned is the observed cadence of a pattern
+type learned struct {
+	pattern     Pattern
+	lastSeen    time.Time
+	cadence     time.Duration // 0 until seen twice
+	occurrences int           // consecutive reads matching the cadence
+	prefetched  bool          // for the next expected read
+}
+
+// Observe records a read of pattern done at the given time
+func (c *Controller) Observe(pattern Pattern, at time.Time) {
+	atomic.AddUint64(&c.observations, 1)
+	// Only the seconds matter for the range: reads are not done at the exact same millisecond
+	pattern.Range = pattern.Range.Round(time.Second)
+	key := pattern.key()
+	c.access.Lock()
+	defer c.access.Unlock()
+	l, found := c.patterns[key]
+	if !found {
+		if c.maxPatterns > 0 && len(c.patterns) >= c.maxPatterns {
+			c.forgetOldest()
+		}
+		c.patterns[key] = &learned{
+			pattern:     pattern,
+			lastSeen:    at,
+			occurrences: 1,
+		}
+		return
+	}
+	interval := at.Sub(l.lastSeen)
+	if interval < minCadence {
+		// same refresh (several panels or several prometheus)
+		return
+	}
+	if l.cadence != 0 && absDuration(interval-l.cadence) <= time.Duration(float64(l.cadence)*cadenceTolerance) {
+		l.occurrences++
+		l.cadence = (3*l.cadence + interval) / 4
+	} else {
+		// first interval or the cadence changed: start learning again
+		l.occurrences = 2
+		l.cadence = interval
+	}
+	// credentials may have been changed since
+	l.pattern.Password = pattern.Password
+	l.lastSeen = at
+	l.prefetched = false
+}
+
+func (c *Controller) recurring(l *learned) bool {
+	return l.cadence != 0 && l.occurrences >= c.minOccurrences
+}
+
+// forgetOldest removes the pattern seen the longest time ago, access must be held
+func (c *Controller) forgetOldest() {
+	var (
+		oldestKey  string
+		oldestSeen time.Time
+	)
+	for key, l := range c.patterns {
+		if oldestKey == "" || l.lastSeen.Before(oldestSeen) {
+			oldestKey = key
+			oldestSeen = l.lastSeen
+		}
+	}
+	if oldestKey != "" {
+		delete(c.patterns, oldestKey)
+		atomic.AddUint64(&c.forgotten, 1)
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,107 @@
+package prefetcher
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+func (c *Controller) scheduler(frequency time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.schedulerBatch()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// prefetch is a fetch planned by a scheduler batch
+type prefetch struct {
+	pattern  Pattern
+	expected time.Time
+}
+
+func (c *Controller) schedulerBatch() {
+	now := time.Now()
+	// Plan the due prefetches and forget the patterns not recurring anymore
+	var due []prefetch
+	c.access.Lock()
+	for key, l := range c.patterns {
+		if l.cadence == 0 {
+			if now.Sub(l.lastSeen) > singleReadExpiration {
+				delete(c.patterns, key)
+				atomic.AddUint64(&c.forgotten, 1)
+			}
+			continue
+		}
+		if now.Sub(l.lastSeen) > maxMissedReads*l.cadence {
+			c.log.Debugf("[Prefetcher] forgetting a '%s' database pattern not read since %v", l.pattern.Database, l.lastSeen)
+			delete(c.patterns, key)
+			atomic.AddUint64(&c.forgotten, 1)
+			continue
+		}
+		if !c.recurring(l) || l.prefetched {
+			continue
+		}
+		expected := l.lastSeen.Add(l.cadence)
+		if now.Before(expected.Add(-c.lead)) {
+			continue
+		}
+		l.prefetched = true
+		due = append(due, prefetch{
+			pattern:  l.pattern,
+			expected: expected,
+		})
+	}
+	c.access.Unlock()
+	// Execute them outside the lock, a few at a time: the batch waits for a free slot, not for the last ones
+	sort.Slice(due, func(i, j int) bool { return due[i].expected.Before(due[j].expected) })
+	for _, p := range due {
+		select {
+		case c.slots <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+		c.workers.Add(1)
+		go func(p prefetch) {
+			defer c.workers.Done()
+			c.execute(p)
+			<-c.slots
+		}(p)
+	}
+}
+
+func (c *Controller) execute(p prefetch) {
+	// A prefetch not done before its expected read is useless: the read fetches the blocks itself
+	if !time.Now().Before(p.expected) {
+		atomic.AddUint64(&c.latePrefetches, 1)
+		c.log.Debugf("[Prefetcher] skipping a read of '%s' database expected at %v: too late",
+			p.pattern.Database, p.expected.Format(time.RFC3339))
+		return
+	}
+	ctx, cancel := context.WithDeadline(c.ctx, p.expected)
+	defer cancel()
+	atomic.AddUint64(&c.prefetches, 1)
+	if err := c.fetcher(ctx, p.pattern, p.expected.Add(-p.pattern.Range), p.expected); err != nil {
+		switch {
+		case c.ctx.Err() != nil:
+		case ctx.Err() == context.DeadlineExceeded:
+			atomic.AddUint64(&c.latePrefetches, 1)
+			c.log.Debugf("[Prefetcher] aborted a read of '%s' database expected at %v: not done in time",
+				p.pattern.Database, p.expected.Format(time.RFC3339))
+		default:
+			atomic.AddUint64(&c.prefetchFailures, 1)
+			c.log.Warningf("[Prefetcher] can't prefetch a read of '%s' database expected at %v: %v",
+				p.pattern.Database, p.expected.Format(time.RFC3339), err)
+		}
+		return
+	}
+	c.log.Debugf("[Prefetcher] prefetched a read of '%s' database expected at %v",
+		p.pattern.Database, p.expected.Format(time.RFC3339))
+}
@@ -0,0 +1,37 @@
+package promutils
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// FromLabelMatchers converts remote read matchers into label matchers (compiling their regexes)
+func FromLabelMatchers(matchers []*prompb.LabelMatcher) (converted []*labels.Matcher, err error) {
+	converted = make([]*labels.Matcher, 0, len(matchers))
+	var (
+		matchType labels.MatchType
+		matcher   *labels.Matcher
+	)
+	for _, remoteMatcher := range matchers {
+		switch remoteMatcher.Type {
+		case prompb.LabelMatcher_EQ:
+			matchType = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			matchType = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			matchType = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			matchType = labels.MatchNotRegexp
+		default:
+			err = fmt.Errorf("invalid type %d for matcher on '%s'", remoteMatcher.Type, remoteMatcher.Name)
+			return
+		}
+		if matcher, err = labels.NewMatcher(matchType, remoteMatcher.Name, remoteMatcher.Value); err != nil {
+			return
+		}
+		converted = append(converted, matcher)
+	}
+	return
+}
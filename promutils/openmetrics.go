@@ -0,0 +1,100 @@
+package promutils
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// OpenMetricsContentType is the content type of the output of WriteOpenMetrics
+const OpenMetricsContentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+
+// WriteOpenMetrics renders the last sample of each series as OpenMetrics text.
+// As remote read does not carry metadata, every family is typed as unknown.
+func WriteOpenMetrics(w io.Writer, series []*prompb.TimeSeries) (err error) {
+	// Group series by metric name
+	families := make(map[string][]*prompb.TimeSeries)
+	for _, ts := range series {
+		if ts == nil || len(ts.Samples) == 0 {
+			continue
+		}
+		name := GetMetricName(ts.Labels)
+		families[name] = append(families[name], ts)
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Render them
+	buffer := bufio.NewWriter(w)
+	for _, name := range names {
+		buffer.WriteString("# TYPE ")
+		buffer.WriteString(name)
+		buffer.WriteString(" unknown\n")
+		for _, ts := range families[name] {
+			sample := ts.Samples[len(ts.Samples)-1]
+			buffer.WriteString(name)
+			writeOpenMetricsLabels(buffer, ts.Labels)
+			buffer.WriteByte(' ')
+			buffer.WriteString(formatOpenMetricsValue(sample.Value))
+			buffer.WriteByte(' ')
+			buffer.WriteString(strconv.FormatFloat(float64(sample.Timestamp)/1000, 'f', -1, 64))
+			buffer.WriteByte('\n')
+		}
+	}
+	buffer.WriteString("# EOF\n")
+	return buffer.Flush()
+}
+
+// GetMetricName returns the value of the __name__ label
+func GetMetricName(labels []prompb.Label) string {
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+var openMetricsLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeOpenMetricsLabels(buffer *bufio.Writer, labels []prompb.Label) {
+	first := true
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			continue
+		}
+		if first {
+			buffer.WriteByte('{')
+			first = false
+		} else {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(label.Name)
+		buffer.WriteString(`="`)
+		openMetricsLabelEscaper.WriteString(buffer, label.Value)
+		buffer.WriteByte('"')
+	}
+	if !first {
+		buffer.WriteByte('}')
+	}
+}
+
+func formatOpenMetricsValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,94 @@
+package promutils
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// MergeQueryResults merges results (typically covering adjacent time ranges) into a single one:
+// samples of series sharing the same labels are concatenated in timestamp order, duplicated
+// timestamps keeping the last value. Series are sorted by labels. Inputs are not modified.
+func MergeQueryResults(results ...*prompb.QueryResult) (merged *prompb.QueryResult) {
+	merged = new(prompb.QueryResult)
+	unique := make(map[string]*prompb.TimeSeries)
+	var keys []string
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		for _, ts := range result.Timeseries {
+			key := GetLabelsKey(ts.Labels)
+			series, found := unique[key]
+			if !found {
+				series = &prompb.TimeSeries{Labels: ts.Labels}
+				unique[key] = series
+				keys = append(keys, key)
+			}
+			series.Samples = append(series.Samples, ts.Samples...)
+		}
+	}
+	sort.Strings(keys)
+	merged.Timeseries = make([]*prompb.TimeSeries, len(keys))
+	for index, key := range keys {
+		series := unique[key]
+		series.Samples = sortSamples(series.Samples)
+		merged.Timeseries[index] = series
+	}
+	return
+}
+
+// sortSamples orders samples by timestamp and removes duplicated timestamps (last one wins)
+func sortSamples(samples []prompb.Sample) []prompb.Sample {
+	if !sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp }) {
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	}
+	deduped := samples[:0]
+	for _, sample := range samples {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Timestamp == sample.Timestamp {
+			deduped[len(deduped)-1] = sample
+			continue
+		}
+		deduped = append(deduped, sample)
+	}
+	return deduped
+}
+
+// TrimQueryResult returns the samples of result within [startMs, endMs] (both included).
+// Series without samples left are dropped. result is not modified.
+func TrimQueryResult(result *prompb.QueryResult, startMs, endMs int64) (trimmed *prompb.QueryResult) {
+	trimmed = &prompb.QueryResult{
+		Timeseries: make([]*prompb.TimeSeries, 0, len(result.Timeseries)),
+	}
+	for _, ts := range result.Timeseries {
+		// Samples are sorted: search the boundaries
+		first := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= startMs })
+		last := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp > endMs })
+		if first >= last {
+			continue
+		}
+		trimmed.Timeseries = append(trimmed.Timeseries, &prompb.TimeSeries{
+			Labels:  ts.Labels,
+			Samples: ts.Samples[first:last:last],
+		})
+	}
+	return
+}
+
+// CloneQueryResult returns a deep copy of result: the copy does not share any array with it,
+// letting the (possibly much larger) arrays result points into be garbage collected.
+func CloneQueryResult(result *prompb.QueryResult) (clone *prompb.QueryResult) {
+	clone = &prompb.QueryResult{
+		Timeseries: make([]*prompb.TimeSeries, len(result.Timeseries)),
+	}
+	for index, ts := range result.Timeseries {
+		series := &prompb.TimeSeries{
+			Labels:  make([]prompb.Label, len(ts.Labels)),
+			Samples: make([]prompb.Sample, len(ts.Samples)),
+		}
+		copy(series.Labels, ts.Labels)
+		copy(series.Samples, ts.Samples)
+		clone.Timeseries[index] = series
+	}
+	return
+}
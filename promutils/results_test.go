@@ -0,0 +1,111 @@
+package promutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func testSeries(instance string, samples ...int64) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: instance}},
+		Samples: make([]prompb.Sample, len(samples)),
+	}
+	for index, timestamp := range samples {
+		ts.Samples[index] = prompb.Sample{Timestamp: timestamp, Value: float64(timestamp)}
+	}
+	return ts
+}
+
+func timestamps(ts *prompb.TimeSeries) (list []int64) {
+	for _, sample := range ts.Samples {
+		list = append(list, sample.Timestamp)
+	}
+	return
+}
+
+func TestMergeQueryResults(t *testing.T) {
+	older := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{testSeries("b", 1, 2, 3), testSeries("a", 1, 2)}}
+	newer := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{testSeries("a", 3, 4), testSeries("c", 5)}}
+	overlap := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{testSeries("b", 0, 3, 4)}}
+	overlap.Timeseries[0].Samples[1].Value = -3
+	olderCopy := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{testSeries("b", 1, 2, 3), testSeries("a", 1, 2)}}
+
+	merged := MergeQueryResults(older, nil, newer, overlap)
+	expected := map[string][]int64{
+		"a": {1, 2, 3, 4},
+		"b": {0, 1, 2, 3, 4},
+		"c": {5},
+	}
+	if len(merged.Timeseries) != len(expected) {
+		t.Fatalf("got %d series, expected %d", len(merged.Timeseries), len(expected))
+	}
+	for index, instance := range []string{"a", "b", "c"} { // sorted by labels
+		ts := merged.Timeseries[index]
+		if ts.Labels[1].Value != instance {
+			t.Errorf("series #%d: got instance '%s', expected '%s'", index, ts.Labels[1].Value, instance)
+			continue
+		}
+		if got := timestamps(ts); !reflect.DeepEqual(got, expected[instance]) {
+			t.Errorf("series '%s': got timestamps %v, expected %v", instance, got, expected[instance])
+		}
+	}
+	// duplicated timestamp: the last result wins
+	if value := merged.Timeseries[1].Samples[3].Value; value != -3 {
+		t.Errorf("duplicated timestamp: got value %v, expected the one of the last result (-3)", value)
+	}
+	if !reflect.DeepEqual(older, olderCopy) {
+		t.Error("inputs have been modified")
+	}
+	if empty := MergeQueryResults(); len(empty.Timeseries) != 0 {
+		t.Errorf("merging nothing: got %d series", len(empty.Timeseries))
+	}
+}
+
+func TestTrimQueryResult(t *testing.T) {
+	result := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{
+		testSeries("a", 10, 20, 30, 40),
+		testSeries("b", 50, 60),
+		testSeries("c"),
+	}}
+	cases := []struct {
+		start, end int64
+		expected   map[string][]int64
+	}{
+		{0, 100, map[string][]int64{"a": {10, 20, 30, 40}, "b": {50, 60}}},
+		{20, 30, map[string][]int64{"a": {20, 30}}}, // boundaries included
+		{21, 29, map[string][]int64{}},
+		{40, 50, map[string][]int64{"a": {40}, "b": {50}}},
+		{70, 80, map[string][]int64{}},
+	}
+	for _, c := range cases {
+		trimmed := TrimQueryResult(result, c.start, c.end)
+		got := make(map[string][]int64, len(trimmed.Timeseries))
+		for _, ts := range trimmed.Timeseries {
+			got[ts.Labels[1].Value] = timestamps(ts)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("[%d, %d]: got %v, expected %v", c.start, c.end, got, c.expected)
+		}
+	}
+	// appending to a trimmed series must not overwrite the source samples
+	trimmed := TrimQueryResult(result, 10, 20)
+	_ = append(trimmed.Timeseries[0].Samples, prompb.Sample{Timestamp: 99})
+	if result.Timeseries[0].Samples[2].Timestamp != 30 {
+		t.Error("trimmed series share their capacity with the source")
+	}
+}
+
+func TestCloneQueryResult(t *testing.T) {
+	result := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{testSeries("a", 10, 20), testSeries("b")}}
+	clone := CloneQueryResult(result)
+	if !reflect.DeepEqual(clone, result) {
+		t.Fatalf("got %v, expected %v", clone, result)
+	}
+	clone.Timeseries[0].Samples[0].Value = -1
+	clone.Timeseries[0].Labels[1].Value = "z"
+	if result.Timeseries[0].Samples[0].Value != 10 || result.Timeseries[0].Labels[1].Value != "a" {
+		t.Error("the clone shares its arrays with the source")
+	}
+}
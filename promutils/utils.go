@@ -2,6 +2,7 @@ package promutils
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -49,6 +50,11 @@ func GetTimeFromTS(ms int64) time.Time {
 	return time.Unix(ms/1000, (ms%1000)*1000000)
 }
 
+// GetTSFromTime returns the ms timestamp of t
+func GetTSFromTime(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/1000000
+}
+
 // BreakdownPromReadRequest returns a multi lines, human readable breakdown of a prometheus read request
 func BreakdownPromReadRequest(req prompb.ReadRequest) (multilines string) {
 	var buffer strings.Builder
@@ -75,3 +81,18 @@ func BreakdownPromReadRequest(req prompb.ReadRequest) (multilines string) {
 	}
 	return buffer.String()
 }
+
+// GetLabelsKey returns a string uniquely identifying a set of labels, whatever their order
+func GetLabelsKey(labels []prompb.Label) string {
+	sorted := make([]prompb.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	var buffer strings.Builder
+	for _, label := range sorted {
+		buffer.WriteString(label.Name)
+		buffer.WriteByte(0xff)
+		buffer.WriteString(label.Value)
+		buffer.WriteByte(0xff)
+	}
+	return buffer.String()
+}
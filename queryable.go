@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"rrinterceptor/promutils"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// smartQueryable is a promql storage backed by the smart read path: each select
+// issued by the engine goes through the same retention policy selection as the
+// remote read requests, its step (carried as hints) allowing downsampled ones.
+// Each select is rate limited as a read of the client r.
+type smartQueryable struct {
+	ci conInfo
+	r  *http.Request
+}
+
+func (sq smartQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &smartQuerier{
+		ctx:  ctx,
+		ci:   sq.ci,
+		r:    sq.r,
+		mint: mint,
+		maxt: maxt,
+	}, nil
+}
+
+// Stages a select can fail at, answered by executeQuery like the other read routes do
+const (
+	selectLookup   = iota // retention policies or meta lookup
+	selectBadData         // read limits exceeded or no retention policy to select
+	selectUpstream        // series read
+)
+
+// selectError is a failed select of the smart queryable
+type selectError struct {
+	stage int
+	err   error
+}
+
+func (se *selectError) Error() string {
+	return se.err.Error()
+}
+
+func (se *selectError) Unwrap() error {
+	return se.err
+}
+
+type smartQuerier struct {
+	ctx        context.Context
+	ci         conInfo
+	r          *http.Request
+	mint, maxt int64
+}
+
+func (sq *smartQuerier) Select(params *storage.SelectParams, matchers ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	query, err := remote.ToQuery(sq.mint, sq.maxt, matchers, params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't convert select to remote read query: %v", err)
+	}
+	req := prompb.ReadRequest{Queries: []*prompb.Query{query}}
+	if reason, err := checkReadLimits(&req); err != nil {
+		readRejectMetric.WithLabelValues(reason).Inc()
+		return nil, nil, &selectError{stage: selectBadData, err: err}
+	}
+	go updateDriftStats(req)
+	rp, rps, err := selectRetentionPolicy(sq.ctx, sq.ci, req.Queries)
+	if err != nil {
+		if rps == nil {
+			return nil, nil, &selectError{stage: selectLookup, err: err}
+		}
+		return nil, nil, &selectError{stage: selectBadData, err: err}
+	}
+	log.Debugf("[Queryable] '%s' database: '%s' retention policy selected for %v", sq.ci.database, rp, matchers)
+	rateKey, err := consumeReadToken(sq.r, sq.ci)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rejection := checkAdmission(sq.ctx, sq.ci, rp, req.Queries); rejection != nil {
+		log.Warningf("[Queryable] '%s' database: rejecting selection of %v: %v", sq.ci.database, matchers, rejection)
+		return nil, nil, rejection
+	}
+	resp, err := readSeries(sq.ctx, sq.ci, rp, &req)
+	if resp != nil {
+		consumeReadBytes(rateKey, int64(resp.Size()))
+	}
+	if err == nil {
+		err = getResponseLimits(sq.ci.database).check(resp)
+	}
+	if limitErr, found := countLimitError(err); found {
+		return nil, nil, limitErr
+	}
+	if err != nil {
+		return nil, nil, &selectError{
+			stage: selectUpstream,
+			err:   fmt.Errorf("can't fetch series from '%s' retention policy: %w", rp, err),
+		}
+	}
+	return remote.FromQueryResult(resp.Results[0]), nil, nil
+}
+
+func (sq *smartQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	rp, err := metaRetentionPolicy(sq.ctx, sq.ci, promutils.GetTimeFromTS(sq.mint))
+	if err != nil {
+		return nil, nil, &selectError{stage: selectLookup, err: err}
+	}
+	values, err := getLabelValues(sq.ctx, sq.ci, rp, name)
+	if err != nil {
+		return nil, nil, &selectError{stage: selectLookup, err: err}
+	}
+	return values, nil, nil
+}
+
+func (sq *smartQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	rp, err := metaRetentionPolicy(sq.ctx, sq.ci, promutils.GetTimeFromTS(sq.mint))
+	if err != nil {
+		return nil, nil, &selectError{stage: selectLookup, err: err}
+	}
+	names, err := getLabelNames(sq.ctx, sq.ci, rp)
+	if err != nil {
+		return nil, nil, &selectError{stage: selectLookup, err: err}
+	}
+	return names, nil, nil
+}
+
+func (sq *smartQuerier) Close() error {
+	return nil
+}
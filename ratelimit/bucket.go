@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// bucket is a token bucket refilled at a constant rate up to its burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate, burst float64, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+}
+
+// waitFor returns how long to wait before the bucket holds more than needed tokens (0 if it already does)
+func (b *bucket) waitFor(needed, rate, burst float64, now time.Time) time.Duration {
+	b.refill(rate, burst, now)
+	if needed == 0 {
+		if b.tokens > 0 {
+			return 0
+		}
+		// in debt: wait to be back above 0
+		return time.Duration((-b.tokens/rate)*float64(time.Second)) + time.Millisecond
+	}
+	if b.tokens >= needed {
+		return 0
+	}
+	return time.Duration(((needed - b.tokens) / rate) * float64(time.Second))
+}
+
+// full returns true if the bucket has been fully refilled: it can be forgotten
+func (b *bucket) full(rate, burst float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.refill(rate, burst, now)
+	return b.tokens >= burst
+}
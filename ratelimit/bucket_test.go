@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	start := time.Now()
+	b := bucket{tokens: 0, last: start}
+	b.refill(2, 5, start.Add(time.Second))
+	if b.tokens != 2 {
+		t.Errorf("after 1s at 2 tokens/s: got %v tokens, expected 2", b.tokens)
+	}
+	b.refill(2, 5, start.Add(10*time.Second))
+	if b.tokens != 5 {
+		t.Errorf("refill must stop at the burst: got %v tokens, expected 5", b.tokens)
+	}
+	b.refill(2, 5, start) // clock going backward
+	if b.tokens != 5 || !b.last.Equal(start.Add(10*time.Second)) {
+		t.Errorf("refill must ignore past times: got %v tokens at %v", b.tokens, b.last)
+	}
+}
+
+func TestBucketWaitFor(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		tokens float64
+		needed float64
+		wait   time.Duration
+	}{
+		{"enough tokens", 1, 1, 0},
+		{"missing half a token", 0.5, 1, 250 * time.Millisecond},
+		{"not in debt", 0.5, 0, 0},
+		{"in debt", -4, 0, 2*time.Second + time.Millisecond},
+		{"empty", 0, 0, time.Millisecond},
+	}
+	for _, c := range cases {
+		b := bucket{tokens: c.tokens, last: now}
+		if wait := b.waitFor(c.needed, 2, 10, now); wait != c.wait {
+			t.Errorf("%s: got %v, expected %v", c.name, wait, c.wait)
+		}
+	}
+}
+
+func TestBucketFull(t *testing.T) {
+	now := time.Now()
+	b := bucket{tokens: 0, last: now}
+	if b.full(1, 3, now.Add(2*time.Second)) {
+		t.Error("bucket with 2 of 3 tokens reported as full")
+	}
+	if !b.full(1, 3, now.Add(3*time.Second)) {
+		t.Error("bucket with 3 of 3 tokens reported as not full")
+	}
+	if !(&bucket{tokens: -10, last: now}).full(0, 0, now) {
+		t.Error("bucket without rate must always be full")
+	}
+}
@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+func (c *Controller) cleaner(frequency time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.cleanerBatch()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// cleanerBatch forgets the clients whose buckets are full again: they would be recreated identical
+func (c *Controller) cleanerBatch() {
+	now := time.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+	var forgotten int
+	for key, cl := range c.clients {
+		if cl.requests.full(c.requestRate, c.requestBurst, now) && cl.bytes.full(c.byteRate, c.byteBurst, now) {
+			delete(c.clients, key)
+			forgotten++
+		}
+	}
+	if forgotten > 0 {
+		c.log.Debugf("[RateLimit] %d idle client(s) forgotten, %d still tracked", forgotten, len(c.clients))
+	}
+}
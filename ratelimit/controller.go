@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+// Limits names, as reported in rejections
+const (
+	LimitRequests = "requests"
+	LimitBytes    = "bytes"
+)
+
+// Config allow to pass values to the contructor
+type Config struct {
+	RequestsPerSecond float64 // 0 for unlimited
+	Burst             int     // requests allowed at once, defaults to RequestsPerSecond (at least 1)
+	BytesPerMinute    int64   // 0 for unlimited
+	CleanFrequency    time.Duration
+	Logger            *hllogger.HlLogger
+}
+
+// New returns an initialized and ready to use rate limiter
+func New(ctx context.Context, conf Config) (c *Controller, err error) {
+	if conf.Logger == nil {
+		err = errors.New("logger can't be nil")
+		return
+	}
+	if conf.RequestsPerSecond <= 0 && conf.BytesPerMinute <= 0 {
+		err = errors.New("at least one of the requests or bytes limits must be set")
+		return
+	}
+	if conf.CleanFrequency <= 0 {
+		err = errors.New("clean frequency must be positive")
+		return
+	}
+	burst := float64(conf.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(conf.RequestsPerSecond))
+	}
+	// Init controller
+	c = &Controller{
+		clients:      make(map[string]*client),
+		requestRate:  conf.RequestsPerSecond,
+		requestBurst: burst,
+		byteRate:     float64(conf.BytesPerMinute) / 60,
+		byteBurst:    float64(conf.BytesPerMinute),
+		rejections:   make(map[string]uint64),
+		log:          conf.Logger,
+		ctx:          ctx,
+		stopped:      make(chan struct{}),
+	}
+	// Start worker
+	c.workers.Add(1)
+	go c.cleaner(conf.CleanFrequency)
+	// Launch the stop watcher
+	go c.stopWatcher()
+	// All good
+	return
+}
+
+// Controller holds a requests and a bytes token buckets for each client key
+type Controller struct {
+	// Buckets
+	access       sync.Mutex
+	clients      map[string]*client
+	requestRate  float64 // tokens per second
+	requestBurst float64
+	byteRate     float64 // tokens per second
+	byteBurst    float64
+	// Stats
+	rejections map[string]uint64 // by limit
+	// Sub Controllers
+	log *hllogger.HlLogger
+	// Workers
+	ctx     context.Context
+	workers sync.WaitGroup
+	stopped chan struct{}
+}
+
+type client struct {
+	requests bucket
+	bytes    bucket
+}
+
+// Allow consumes a request token of key. If the client is over one of the limits,
+// allowed is false and limit tells which one while retryAfter tells when to try again.
+func (c *Controller) Allow(key string) (allowed bool, limit string, retryAfter time.Duration) {
+	now := time.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+	cl := c.getOrCreate(key, now)
+	// Bytes are consumed after the response: the bucket must not be in debt
+	if c.byteRate > 0 {
+		if wait := cl.bytes.waitFor(0, c.byteRate, c.byteBurst, now); wait > 0 {
+			c.rejections[LimitBytes]++
+			return false, LimitBytes, wait
+		}
+	}
+	if c.requestRate > 0 {
+		if wait := cl.requests.waitFor(1, c.requestRate, c.requestBurst, now); wait > 0 {
+			c.rejections[LimitRequests]++
+			return false, LimitRequests, wait
+		}
+		cl.requests.tokens--
+	}
+	return true, "", 0
+}
+
+// Consume removes the bytes sent to key from its bytes bucket, which can go in debt
+func (c *Controller) Consume(key string, bytes int64) {
+	if c.byteRate <= 0 || bytes <= 0 {
+		return
+	}
+	now := time.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+	cl := c.getOrCreate(key, now)
+	cl.bytes.refill(c.byteRate, c.byteBurst, now)
+	cl.bytes.tokens -= float64(bytes)
+}
+
+// getOrCreate returns the buckets of key, access must be held
+func (c *Controller) getOrCreate(key string, now time.Time) (cl *client) {
+	var found bool
+	if cl, found = c.clients[key]; !found {
+		cl = &client{
+			requests: bucket{tokens: c.requestBurst, last: now},
+			bytes:    bucket{tokens: c.byteBurst, last: now},
+		}
+		c.clients[key] = cl
+	}
+	return
+}
+
+// Stats contains the rate limiter counters
+type Stats struct {
+	Rejections map[string]uint64 // by limit
+	Clients    int               // keys currently tracked
+	Throttled  int               // keys currently over a limit
+}
+
+// Stats returns the current counters of the rate limiter
+func (c *Controller) Stats() (stats Stats) {
+	now := time.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+	stats.Rejections = make(map[string]uint64, len(c.rejections))
+	for limit, count := range c.rejections {
+		stats.Rejections[limit] = count
+	}
+	stats.Clients = len(c.clients)
+	for _, cl := range c.clients {
+		if (c.requestRate > 0 && cl.requests.waitFor(1, c.requestRate, c.requestBurst, now) > 0) ||
+			(c.byteRate > 0 && cl.bytes.waitFor(0, c.byteRate, c.byteBurst, now) > 0) {
+			stats.Throttled++
+		}
+	}
+	return
+}
+
+func (c *Controller) stopWatcher() {
+	<-c.ctx.Done()
+	c.log.Debugf("[RateLimit] Stop signal received: waiting for workers to stop")
+	c.workers.Wait()
+	c.log.Debugf("[RateLimit] All workers have stopped")
+	close(c.stopped)
+}
+
+// WaitFullStop will block until all workers have ended
+// folowing the cancellation of ctx
+func (c *Controller) WaitFullStop() {
+	<-c.stopped
+}
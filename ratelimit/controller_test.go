@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+func newTestController(t *testing.T, conf Config) (c *Controller, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conf.CleanFrequency = time.Hour
+	conf.Logger = hllogger.New(ioutil.Discard, nil)
+	c, err := New(ctx, conf)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	return c, func() {
+		cancel()
+		c.WaitFullStop()
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	logger := hllogger.New(ioutil.Discard, nil)
+	for name, conf := range map[string]Config{
+		"no logger":       {RequestsPerSecond: 1, CleanFrequency: time.Minute},
+		"no limit":        {CleanFrequency: time.Minute, Logger: logger},
+		"no clean period": {RequestsPerSecond: 1, Logger: logger},
+	} {
+		if _, err := New(context.Background(), conf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAllowRequests(t *testing.T) {
+	// a slow rate: no token is refilled during the test
+	c, stop := newTestController(t, Config{RequestsPerSecond: 0.01, Burst: 3})
+	defer stop()
+	for index := 0; index < 3; index++ {
+		if allowed, limit, _ := c.Allow("alice"); !allowed {
+			t.Fatalf("request #%d of the burst refused by the %s limit", index, limit)
+		}
+	}
+	allowed, limit, retryAfter := c.Allow("alice")
+	if allowed || limit != LimitRequests {
+		t.Fatalf("request over the burst: got allowed=%v limit='%s'", allowed, limit)
+	}
+	if retryAfter <= 0 || retryAfter > 100*time.Second {
+		t.Errorf("unexpected retry delay %v for a 0.01 request/s rate", retryAfter)
+	}
+	if allowed, _, _ = c.Allow("bob"); !allowed {
+		t.Error("keys must not share their buckets")
+	}
+	stats := c.Stats()
+	if stats.Clients != 2 || stats.Throttled != 1 || stats.Rejections[LimitRequests] != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestAllowDefaultBurst(t *testing.T) {
+	c, stop := newTestController(t, Config{RequestsPerSecond: 0.5})
+	defer stop()
+	if allowed, _, _ := c.Allow("alice"); !allowed {
+		t.Fatal("first request refused")
+	}
+	if allowed, _, _ := c.Allow("alice"); allowed {
+		t.Error("a rate under 1 request/s must default to a burst of 1")
+	}
+}
+
+func TestConsumeBytes(t *testing.T) {
+	c, stop := newTestController(t, Config{BytesPerMinute: 600}) // 10 bytes/s
+	defer stop()
+	if allowed, _, _ := c.Allow("alice"); !allowed {
+		t.Fatal("first request refused")
+	}
+	c.Consume("alice", 1200) // 600 bytes in debt: 60s to pay back
+	allowed, limit, retryAfter := c.Allow("alice")
+	if allowed || limit != LimitBytes {
+		t.Fatalf("client in debt: got allowed=%v limit='%s'", allowed, limit)
+	}
+	if retryAfter < 59*time.Second || retryAfter > 61*time.Second {
+		t.Errorf("got a retry delay of %v, expected about 60s", retryAfter)
+	}
+	if stats := c.Stats(); stats.Throttled != 1 || stats.Rejections[LimitBytes] != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	// requests are unlimited
+	for index := 0; index < 10; index++ {
+		if allowed, _, _ = c.Allow("bob"); !allowed {
+			t.Fatalf("request #%d refused without requests limit", index)
+		}
+	}
+}
+
+func TestCleanerForgetsIdleClients(t *testing.T) {
+	c, stop := newTestController(t, Config{RequestsPerSecond: 1000, Burst: 1, BytesPerMinute: 60})
+	defer stop()
+	c.Allow("idle")
+	c.Allow("debtor")
+	c.Consume("debtor", 600)
+	time.Sleep(10 * time.Millisecond) // the request buckets are full again
+	c.cleanerBatch()
+	if stats := c.Stats(); stats.Clients != 1 {
+		t.Fatalf("expected the debtor only to be tracked, got %d clients", stats.Clients)
+	}
+	if allowed, limit, _ := c.Allow("debtor"); allowed || limit != LimitBytes {
+		t.Errorf("debtor must still be limited after a clean: got allowed=%v limit='%s'", allowed, limit)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"rrinterceptor/admission"
+	"rrinterceptor/influxmeta"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var readAdmission *admission.Controller
+
+// checkAdmission checks queries against the admission rules, every path reading series must call it
+func checkAdmission(ctx context.Context, ci conInfo, rp string, queries []*prompb.Query) *admission.Rejection {
+	if readAdmission == nil {
+		return nil
+	}
+	return readAdmission.Check(ctx, rp, queries, admissionCardinality(ci))
+}
+
+// admitRead checks queries against the admission rules and answers the request if one is rejected
+func admitRead(w http.ResponseWriter, r *http.Request, handlerName string, ci conInfo, rp string, queries []*prompb.Query) (proceed bool) {
+	rejection := checkAdmission(r.Context(), ci, rp, queries)
+	if rejection == nil {
+		return r.Context().Err() == nil
+	}
+	log.Warningf("[%s] rejecting '%s %s' from '%s': %v", handlerName, r.Method, r.URL, r.RemoteAddr, rejection)
+	w.Header().Set("X-RRInterceptor-Rejected-By", rejection.Rule)
+	http.Error(w, rejection.Error(), http.StatusBadRequest)
+	return false
+}
+
+// admitAPIRead is admitRead for the handlers answering with the prometheus API format
+func admitAPIRead(w http.ResponseWriter, r *http.Request, handlerName string, ci conInfo, rp string, queries []*prompb.Query) (proceed bool) {
+	rejection := checkAdmission(r.Context(), ci, rp, queries)
+	if rejection == nil {
+		return r.Context().Err() == nil
+	}
+	log.Warningf("[%s] rejecting '%s %s' from '%s': %v", handlerName, r.Method, r.URL, r.RemoteAddr, rejection)
+	w.Header().Set("X-RRInterceptor-Rejected-By", rejection.Rule)
+	respondAPIError(w, apiErrorBadData, rejection)
+	return false
+}
+
+// admissionCardinality returns the number of series matching matchers within rp for the given credentials
+func admissionCardinality(ci conInfo) admission.CardinalityEstimator {
+	return func(ctx context.Context, rp string, matchers []*labels.Matcher) (series int64, err error) {
+		measurements, err := resolveMeasurements(ctx, ci, matchers)
+		if err != nil || len(measurements) == 0 {
+			return
+		}
+		results, err := cache.GetMeta(ctx, influxURL, ci.database, ci.user, ci.password,
+			influxmeta.ShowSeriesCardinality(ci.database, rp, measurements, matchers))
+		if err != nil {
+			err = fmt.Errorf("can't get series cardinality: %w", err)
+			return
+		}
+		if series, err = influxmeta.ExtractCardinality(results); err != nil {
+			err = fmt.Errorf("can't extract series cardinality: %v", err)
+		}
+		return
+	}
+}
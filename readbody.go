@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// buffers bigger than this are left to the garbage collector in order to not pin memory after a huge request
+const maxPooledBuffer = 4 * 1024 * 1024
+
+var (
+	compressedPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	decodedPool    = sync.Pool{New: func() interface{} { return new([]byte) }}
+)
+
+// readBody is a compressed remote read request held by a pooled buffer. It is restored as the request
+// body in order to be forwarded as is, and its buffer goes back to the pool once closed.
+type readBody struct {
+	*bytes.Reader
+	buf      *bytes.Buffer
+	detached bool
+	once     sync.Once
+}
+
+// newReadBody reads r within a pooled buffer, sizeHint is the expected size (or -1 if unknown).
+// errBodyTooLarge is returned if r is bigger than maxSize (0 for unlimited).
+func newReadBody(r io.Reader, sizeHint, maxSize int64) (body *readBody, err error) {
+	if maxSize > 0 {
+		if sizeHint > maxSize {
+			err = errBodyTooLarge
+			return
+		}
+		r = io.LimitReader(r, maxSize+1)
+	}
+	buf := compressedPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if sizeHint > 0 && sizeHint <= maxPooledBuffer {
+		buf.Grow(int(sizeHint))
+	}
+	if _, err = buf.ReadFrom(r); err != nil {
+		recycleCompressed(buf)
+		return
+	}
+	if maxSize > 0 && int64(buf.Len()) > maxSize {
+		recycleCompressed(buf)
+		err = errBodyTooLarge
+		return
+	}
+	body = &readBody{
+		Reader: bytes.NewReader(buf.Bytes()),
+		buf:    buf,
+	}
+	return
+}
+
+// Bytes returns the compressed request, only valid until the body is closed
+func (b *readBody) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Detach returns the compressed request for a usage outliving the body: its buffer won't be recycled
+func (b *readBody) Detach() []byte {
+	b.detached = true
+	return b.buf.Bytes()
+}
+
+// Close returns the buffer to the pool, it can be called several times
+func (b *readBody) Close() error {
+	b.once.Do(func() {
+		if !b.detached {
+			recycleCompressed(b.buf)
+		}
+	})
+	return nil
+}
+
+func recycleCompressed(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		compressedPool.Put(buf)
+	}
+}
+
+// getDecodedBuffer returns a pooled buffer of size bytes to snappy decode a request into
+func getDecodedBuffer(size int) *[]byte {
+	buf := decodedPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func recycleDecoded(buf *[]byte) {
+	if cap(*buf) <= maxPooledBuffer {
+		decodedPool.Put(buf)
+	}
+}
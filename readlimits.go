@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Read requests limits, 0 for unlimited
+var (
+	readMaxBody     int64
+	readMaxDecoded  int64
+	readMaxQueries  int
+	readMaxMatchers int
+)
+
+// Reasons of the rejected reads (metric label)
+const (
+	rejectBodyTooLarge    = "body_too_large"
+	rejectDecodedTooLarge = "decoded_too_large"
+	rejectTooManyQueries  = "too_many_queries"
+	rejectTooManyMatchers = "too_many_matchers"
+)
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// checkReadLimits verifies the decoded request does not exceed the queries and matchers limits
+func checkReadLimits(req *prompb.ReadRequest) (reason string, err error) {
+	if readMaxQueries > 0 && len(req.Queries) > readMaxQueries {
+		return rejectTooManyQueries, fmt.Errorf("request contains %d queries while the limit is %d", len(req.Queries), readMaxQueries)
+	}
+	if readMaxMatchers > 0 {
+		for index, query := range req.Queries {
+			if query != nil && len(query.Matchers) > readMaxMatchers {
+				return rejectTooManyMatchers, fmt.Errorf("query #%d contains %d matchers while the limit is %d",
+					index, len(query.Matchers), readMaxMatchers)
+			}
+		}
+	}
+	return
+}
+
+// readJSONBody reads the JSON counterpart of a remote read request within the compressed body limit
+func readJSONBody(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if readMaxBody <= 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	if r.ContentLength > readMaxBody {
+		return nil, errBodyTooLarge
+	}
+	if body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readMaxBody)); err != nil && int64(len(body)) >= readMaxBody {
+		err = errBodyTooLarge
+	}
+	return
+}
+
+// rejectRead answers a read request exceeding the limits and counts it
+func rejectRead(w http.ResponseWriter, r *http.Request, reason string, statusCode int, err error) {
+	readRejectMetric.WithLabelValues(reason).Inc()
+	log.Warningf("[ReadHandler] rejecting '%s %s' from '%s': %v", r.Method, r.URL, r.RemoteAddr, err)
+	http.Error(w, err.Error(), statusCode)
+}
+
+// rejectAPIRead is rejectRead for the handlers answering with the prometheus API format
+func rejectAPIRead(w http.ResponseWriter, r *http.Request, reason, errorType string, err error) {
+	readRejectMetric.WithLabelValues(reason).Inc()
+	log.Warningf("[ReadHandler] rejecting '%s %s' from '%s': %v", r.Method, r.URL, r.RemoteAddr, err)
+	respondAPIError(w, errorType, err)
+}
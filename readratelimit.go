@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"rrinterceptor/ratelimit"
+)
+
+// Rate limiting keys
+const (
+	rateLimitByUser     = "user"
+	rateLimitByAddress  = "address"
+	rateLimitByDatabase = "database"
+)
+
+var (
+	readLimiter    *ratelimit.Controller
+	readLimiterKey string
+)
+
+// rateLimitKey returns the client identity the rate limits apply to
+func rateLimitKey(r *http.Request, ci conInfo) string {
+	switch readLimiterKey {
+	case rateLimitByUser:
+		return ci.user
+	case rateLimitByDatabase:
+		return ci.database
+	default:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+// rateLimitError is the refusal of a read whose key is over one of its rate limits
+type rateLimitError struct {
+	key          string
+	limit        string
+	retrySeconds int
+}
+
+func (rle *rateLimitError) Error() string {
+	return fmt.Sprintf("%s '%s' is over its %s rate limit: retry in %ds", readLimiterKey, rle.key, rle.limit, rle.retrySeconds)
+}
+
+// consumeReadToken consumes a request token of the rate limit key of the client. As the user and database
+// keys are client provided, it must only be called once the client credentials have been validated against
+// influxdb (by selecting the retention policy): unauthenticated requests can not drain the tokens of others.
+// The bytes sent to the client must then be reported with consumeReadBytes and the returned key (empty if
+// rate limiting is disabled).
+func consumeReadToken(r *http.Request, ci conInfo) (key string, err error) {
+	if readLimiter == nil {
+		return
+	}
+	key = rateLimitKey(r, ci)
+	allowed, limit, retryAfter := readLimiter.Allow(key)
+	if allowed {
+		return
+	}
+	retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retrySeconds < 1 {
+		retrySeconds = 1
+	}
+	return "", &rateLimitError{key: key, limit: limit, retrySeconds: retrySeconds}
+}
+
+// consumeReadBytes reports the bytes of a read answer allowed by consumeReadToken
+func consumeReadBytes(key string, bytes int64) {
+	if key != "" {
+		readLimiter.Consume(key, bytes)
+	}
+}
+
+// logRateLimited logs the refusal of r and sets its Retry-After header
+func logRateLimited(w http.ResponseWriter, r *http.Request, handlerName string, rle *rateLimitError) {
+	log.Infof("[%s] rate limiting '%s %s' from '%s': %s '%s' is over its %s limit for %ds",
+		handlerName, r.Method, r.URL, r.RemoteAddr, readLimiterKey, rle.key, rle.limit, rle.retrySeconds)
+	w.Header().Set("Retry-After", strconv.Itoa(rle.retrySeconds))
+}
+
+// allowRead consumes a request token of the client (see consumeReadToken) and answers 429 if it is over its limits
+func allowRead(w http.ResponseWriter, r *http.Request, handlerName string, ci conInfo) (key string, proceed bool) {
+	key, err := consumeReadToken(r, ci)
+	if err == nil {
+		return key, true
+	}
+	rle := err.(*rateLimitError)
+	logRateLimited(w, r, handlerName, rle)
+	http.Error(w, rle.Error(), http.StatusTooManyRequests)
+	return "", false
+}
+
+// allowAPIRead is allowRead for the handlers answering with the prometheus API format
+func allowAPIRead(w http.ResponseWriter, r *http.Request, handlerName string, ci conInfo) (key string, proceed bool) {
+	key, err := consumeReadToken(r, ci)
+	if err == nil {
+		return key, true
+	}
+	rle := err.(*rateLimitError)
+	logRateLimited(w, r, handlerName, rle)
+	respondAPIError(w, apiErrorTooMany, rle)
+	return "", false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"rrinterceptor/promutils"
+	"rrinterceptor/scheduler"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	readScheduler      *scheduler.Controller
+	schedulerHighDrift time.Duration // queries starting more recently are high priority
+	schedulerLowDrift  time.Duration // queries starting before are low priority
+)
+
+// readPriority returns the priority class asked by the client with the priority parameter,
+// or derived from how old the oldest query start is
+func readPriority(r *http.Request, queries []*prompb.Query) scheduler.Class {
+	if values, found := r.URL.Query()["priority"]; found && len(values) != 0 {
+		if class, valid := scheduler.ParseClass(values[0]); valid {
+			return class
+		}
+	}
+	var oldestStart int64
+	for index, query := range queries {
+		if query != nil && (index == 0 || query.StartTimestampMs < oldestStart) {
+			oldestStart = query.StartTimestampMs
+		}
+	}
+	drift := time.Since(promutils.GetTimeFromTS(oldestStart))
+	switch {
+	case drift <= schedulerHighDrift:
+		return scheduler.High
+	case drift >= schedulerLowDrift:
+		return scheduler.Low
+	default:
+		return scheduler.Normal
+	}
+}
+
+func withReadPriority(ctx context.Context, class scheduler.Class) context.Context {
+	return context.WithValue(ctx, priorityContextKey, class)
+}
+
+func readPriorityOf(ctx context.Context) scheduler.Class {
+	if class, found := ctx.Value(priorityContextKey).(scheduler.Class); found {
+		return class
+	}
+	return scheduler.Normal
+}
+
+// acquireUpstream waits for the scheduler to allow a request to rp, with the priority of ctx
+func acquireUpstream(ctx context.Context, rp string) (release func(), err error) {
+	if readScheduler == nil {
+		return func() {}, nil
+	}
+	return readScheduler.Acquire(ctx, influxURL.Host, rp, readPriorityOf(ctx))
+}
+
+// upstreamFailureStatus returns the status code of a failed upstream read: 503 (with Retry-After)
+// if it could not be scheduled in time, 502 otherwise
+func upstreamFailureStatus(w http.ResponseWriter, err error) int {
+	if errors.Is(err, scheduler.ErrQueueTimeout) {
+		w.Header().Set("Retry-After", "1")
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
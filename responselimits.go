@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// anyDatabase is the limits key applying to the databases without their own limit
+const anyDatabase = "*"
+
+// maxBufferedResponse bounds the upstream answers read in memory (to be checked, shared or decoded)
+// when no smaller bytes limit applies
+const maxBufferedResponse = 256 * 1024 * 1024
+
+var errMalformedAnswer = errors.New("malformed protobuf answer")
+
+// Read responses limits by database, 0 or absent for unlimited
+var (
+	responseMaxBytes   map[string]int64
+	responseMaxSeries  map[string]int64
+	responseMaxSamples map[string]int64
+)
+
+// Limits names (metric label)
+const (
+	limitBytes   = "bytes"
+	limitSeries  = "series"
+	limitSamples = "samples"
+)
+
+// responseLimits are the limits applying to the read responses of a database
+type responseLimits struct {
+	bytes   int64
+	series  int64
+	samples int64
+}
+
+// responseLimitError is returned when a read response exceeds a limit
+type responseLimitError struct {
+	limit string
+	max   int64
+}
+
+func (e *responseLimitError) Error() string {
+	return fmt.Sprintf("response exceeds the limit of %d %s for this database: narrow the query range or matchers", e.max, e.limit)
+}
+
+func getResponseLimits(database string) (limits responseLimits) {
+	return responseLimits{
+		bytes:   databaseLimit(responseMaxBytes, database),
+		series:  databaseLimit(responseMaxSeries, database),
+		samples: databaseLimit(responseMaxSamples, database),
+	}
+}
+
+func databaseLimit(limits map[string]int64, database string) int64 {
+	if limit, found := limits[database]; found {
+		return limit
+	}
+	return limits[anyDatabase]
+}
+
+func (l responseLimits) enabled() bool {
+	return l.bytes > 0 || l.series > 0 || l.samples > 0
+}
+
+// check verifies the series and samples counts of resp
+func (l responseLimits) check(resp *prompb.ReadResponse) (err error) {
+	var series, samples int64
+	for _, result := range resp.Results {
+		if result == nil {
+			continue
+		}
+		series += int64(len(result.Timeseries))
+		if l.series > 0 && series > l.series {
+			return &responseLimitError{limit: limitSeries, max: l.series}
+		}
+		for _, ts := range result.Timeseries {
+			samples += int64(len(ts.Samples))
+		}
+		if l.samples > 0 && samples > l.samples {
+			return &responseLimitError{limit: limitSamples, max: l.samples}
+		}
+	}
+	return
+}
+
+// readAnswer reads an upstream answer in memory, aborting as soon as it exceeds
+// the bytes limit (or maxBufferedResponse)
+func (l responseLimits) readAnswer(body io.Reader) (raw []byte, err error) {
+	max := int64(maxBufferedResponse)
+	if l.bytes > 0 && l.bytes < max {
+		max = l.bytes
+	}
+	if raw, err = ioutil.ReadAll(io.LimitReader(body, max+1)); err != nil {
+		return nil, fmt.Errorf("can't read influxdb answer: %v", err)
+	}
+	if int64(len(raw)) > max {
+		return nil, &responseLimitError{limit: limitBytes, max: max}
+	}
+	return
+}
+
+// checkEncoded verifies a raw (snappy protobuf) remote read answer. Series and samples are
+// counted on the protobuf encoding: the answer is decoded but never unmarshalled.
+func (l responseLimits) checkEncoded(raw []byte) (err error) {
+	if l.bytes > 0 && int64(len(raw)) > l.bytes {
+		return &responseLimitError{limit: limitBytes, max: l.bytes}
+	}
+	if l.series <= 0 && l.samples <= 0 {
+		return
+	}
+	decodedLen, err := snappy.DecodedLen(raw)
+	if err != nil {
+		return fmt.Errorf("can't decode influxdb answer as snappy: %v", err)
+	}
+	decoded := getDecodedBuffer(decodedLen)
+	defer recycleDecoded(decoded)
+	resp, err := snappy.Decode(*decoded, raw)
+	if err != nil {
+		return fmt.Errorf("can't decode influxdb answer as snappy: %v", err)
+	}
+	if err = l.countEncoded(resp); err == errMalformedAnswer {
+		err = fmt.Errorf("can't walk influxdb answer: %v", err)
+	}
+	return
+}
+
+// countEncoded counts the series (ReadResponse.results.timeseries) and samples (TimeSeries.samples)
+// of a protobuf encoded ReadResponse, stopping as soon as a limit is exceeded
+func (l responseLimits) countEncoded(resp []byte) error {
+	var series, samples int64
+	return walkMessages(resp, 1, func(result []byte) error {
+		return walkMessages(result, 1, func(ts []byte) error {
+			if series++; l.series > 0 && series > l.series {
+				return &responseLimitError{limit: limitSeries, max: l.series}
+			}
+			if l.samples <= 0 {
+				return nil
+			}
+			return walkMessages(ts, 2, func([]byte) error {
+				if samples++; samples > l.samples {
+					return &responseLimitError{limit: limitSamples, max: l.samples}
+				}
+				return nil
+			})
+		})
+	})
+}
+
+// walkMessages calls fn with the encoding of each field number of the protobuf message msg,
+// other fields are skipped
+func walkMessages(msg []byte, number uint64, fn func(value []byte) error) error {
+	for len(msg) > 0 {
+		key, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			return errMalformedAnswer
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case proto.WireVarint:
+			if _, n = proto.DecodeVarint(msg); n == 0 {
+				return errMalformedAnswer
+			}
+			msg = msg[n:]
+		case proto.WireFixed64:
+			if len(msg) < 8 {
+				return errMalformedAnswer
+			}
+			msg = msg[8:]
+		case proto.WireFixed32:
+			if len(msg) < 4 {
+				return errMalformedAnswer
+			}
+			msg = msg[4:]
+		case proto.WireBytes:
+			length, n := proto.DecodeVarint(msg)
+			if n == 0 || length > uint64(len(msg)-n) {
+				return errMalformedAnswer
+			}
+			value := msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+			if key>>3 == number {
+				if err := fn(value); err != nil {
+					return err
+				}
+			}
+		default:
+			return errMalformedAnswer
+		}
+	}
+	return nil
+}
+
+// limitStreamedResponse is the ModifyResponse hook of httpProxy: the upstream answer is read
+// (aborted as soon as it is too big) and verified before anything is sent to the client
+func limitStreamedResponse(resp *http.Response) (err error) {
+	limits, limited := resp.Request.Context().Value(limitsContextKey).(responseLimits)
+	if !limited || resp.StatusCode != http.StatusOK {
+		return
+	}
+	raw, err := limits.readAnswer(resp.Body)
+	if err != nil {
+		return
+	}
+	if err = limits.checkEncoded(raw); err != nil {
+		return
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	resp.ContentLength = int64(len(raw))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(raw)))
+	return
+}
+
+// proxyErrorHandler is the ErrorHandler of httpProxy: limits errors are explicit, others are bad gateways
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if respondLimitError(w, err) {
+		return
+	}
+	if r.Context().Err() == nil {
+		log.Errorf("[ReadHandler] can't proxy '%s %s' from '%s' to influxdb: %v", r.Method, r.URL, r.RemoteAddr, err)
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// countLimitError counts err if it is (or wraps) a *responseLimitError
+func countLimitError(err error) (limitErr *responseLimitError, found bool) {
+	if found = errors.As(err, &limitErr); found {
+		readTruncationMetric.WithLabelValues(limitErr.limit).Inc()
+	}
+	return
+}
+
+// respondLimitError answers and counts err if it is a *responseLimitError
+func respondLimitError(w http.ResponseWriter, err error) (handled bool) {
+	limitErr, handled := countLimitError(err)
+	if handled {
+		http.Error(w, limitErr.Error(), http.StatusUnprocessableEntity)
+	}
+	return
+}
+
+// respondAPILimitError is respondLimitError for the handlers answering with the prometheus API format
+func respondAPILimitError(w http.ResponseWriter, err error) (handled bool) {
+	limitErr, handled := countLimitError(err)
+	if handled {
+		respondAPIError(w, apiErrorExec, limitErr)
+	}
+	return
+}
+
+// parseNamedLimits parses a comma separated list of 'name=limit' items ('*' being the usual name for the others)
+func parseNamedLimits(list string, unit int64) (limits map[string]int64, err error) {
+	limits = make(map[string]int64)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			err = fmt.Errorf("'%s' is not a 'name=limit' item", item)
+			return
+		}
+		var limit int64
+		if limit, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64); err != nil || limit < 0 {
+			err = fmt.Errorf("'%s' is not a valid limit", parts[1])
+			return
+		}
+		limits[strings.TrimSpace(parts[0])] = limit * unit
+	}
+	return
+}
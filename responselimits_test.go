@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// limitsResponse returns a response of nbResults results of nbSeries series of nbSamples samples each
+func limitsResponse(nbResults, nbSeries, nbSamples int) *prompb.ReadResponse {
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, nbResults)}
+	for r := range resp.Results {
+		resp.Results[r] = &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, nbSeries)}
+		for s := range resp.Results[r].Timeseries {
+			ts := &prompb.TimeSeries{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: fmt.Sprintf("host%d", s)}},
+				Samples: make([]prompb.Sample, nbSamples),
+			}
+			for index := range ts.Samples {
+				ts.Samples[index] = prompb.Sample{Value: float64(index), Timestamp: int64(index) * 60000}
+			}
+			resp.Results[r].Timeseries[s] = ts
+		}
+	}
+	return resp
+}
+
+func TestCheckEncoded(t *testing.T) {
+	resp := limitsResponse(2, 3, 10) // 6 series, 60 samples
+	raw, err := proto.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := snappy.Encode(nil, raw)
+	cases := []struct {
+		limits   responseLimits
+		exceeded string
+	}{
+		{responseLimits{}, ""},
+		{responseLimits{series: 6, samples: 60}, ""},
+		{responseLimits{series: 5}, limitSeries},
+		{responseLimits{samples: 59}, limitSamples},
+		{responseLimits{bytes: int64(len(encoded)) - 1}, limitBytes},
+		{responseLimits{bytes: int64(len(encoded)), series: 100}, ""},
+	}
+	for _, c := range cases {
+		for name, err := range map[string]error{"encoded": c.limits.checkEncoded(encoded), "decoded": c.limits.check(resp)} {
+			if c.exceeded == limitBytes && name == "decoded" {
+				continue // the bytes limit applies to encoded answers only
+			}
+			var limitErr *responseLimitError
+			switch {
+			case c.exceeded == "" && err != nil:
+				t.Errorf("%+v %s: unexpected error: %v", c.limits, name, err)
+			case c.exceeded != "" && (!errors.As(err, &limitErr) || limitErr.limit != c.exceeded):
+				t.Errorf("%+v %s: expected the %s limit to be exceeded, got %v", c.limits, name, c.exceeded, err)
+			}
+		}
+	}
+}
+
+func TestCheckEncodedMalformed(t *testing.T) {
+	raw, err := proto.Marshal(limitsResponse(1, 2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := responseLimits{series: 10}
+	for name, encoded := range map[string][]byte{
+		"not snappy": []byte("not snappy"),
+		"truncated":  snappy.Encode(nil, raw[:len(raw)-1]),
+	} {
+		var limitErr *responseLimitError
+		if err := limits.checkEncoded(encoded); err == nil || errors.As(err, &limitErr) {
+			t.Errorf("%s: expected a decoding error, got %v", name, err)
+		}
+	}
+}
+
+func TestReadAnswer(t *testing.T) {
+	limits := responseLimits{bytes: 4}
+	if raw, err := limits.readAnswer(strings.NewReader("1234")); err != nil || string(raw) != "1234" {
+		t.Errorf("expected the whole answer, got %q, %v", raw, err)
+	}
+	var limitErr *responseLimitError
+	if _, err := limits.readAnswer(strings.NewReader("12345")); !errors.As(err, &limitErr) || limitErr.limit != limitBytes {
+		t.Errorf("expected the bytes limit to be exceeded, got %v", err)
+	}
+}
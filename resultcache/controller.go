@@ -0,0 +1,212 @@
+package resultcache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hekmon/hllogger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Config allow to pass values to the contructor
+type Config struct {
+	MaxMemory int64  // bytes
+	Directory string // empty disables the disk tier
+	MaxDisk   int64  // bytes
+	Logger    *hllogger.HlLogger
+}
+
+// New returns an initialized and ready to use result cache
+func New(conf Config) (c *Controller, err error) {
+	if conf.Logger == nil {
+		err = errors.New("logger can't be nil")
+		return
+	}
+	if conf.MaxMemory <= 0 {
+		err = errors.New("max memory must be positive")
+		return
+	}
+	c = &Controller{
+		memory:    make(map[string]*list.Element),
+		memoryLRU: list.New(),
+		maxMemory: conf.MaxMemory,
+		log:       conf.Logger,
+	}
+	if conf.Directory != "" {
+		if c.disk, err = newDiskTier(conf.Directory, conf.MaxDisk, conf.Logger); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Controller holds immutable query results in a memory tier bounded by size,
+// least recently used results being moved to the optional disk tier first.
+type Controller struct {
+	access      sync.Mutex
+	memory      map[string]*list.Element
+	memoryLRU   *list.List // of *memoryEntry, most recently used first
+	memorySize  int64
+	maxMemory   int64
+	disk        *diskTier
+	generation  uint64 // incremented by each purge
+	log         *hllogger.HlLogger
+	hits        uint64
+	diskHits    uint64
+	misses      uint64
+	evictions   uint64
+	storedBytes uint64
+	servedBytes uint64
+}
+
+type memoryEntry struct {
+	key    string
+	result *prompb.QueryResult
+	size   int64
+}
+
+// Stats contains the result cache counters
+type Stats struct {
+	Hits          uint64 // including disk hits
+	DiskHits      uint64
+	Misses        uint64
+	Evictions     uint64 // from memory
+	StoredBytes   uint64
+	ServedBytes   uint64
+	MemoryBytes   int64
+	MemoryEntries int
+	DiskBytes     int64
+	DiskEntries   int
+}
+
+// Stats returns the current counters of the result cache
+func (c *Controller) Stats() (stats Stats) {
+	c.access.Lock()
+	stats = Stats{
+		Hits:          c.hits,
+		DiskHits:      c.diskHits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		StoredBytes:   c.storedBytes,
+		ServedBytes:   c.servedBytes,
+		MemoryBytes:   c.memorySize,
+		MemoryEntries: len(c.memory),
+	}
+	c.access.Unlock()
+	if c.disk != nil {
+		stats.DiskBytes, stats.DiskEntries = c.disk.usage()
+	}
+	return
+}
+
+// Get returns the result stored as key. The returned result is shared and must not be modified.
+func (c *Controller) Get(key string) (result *prompb.QueryResult, found bool) {
+	c.access.Lock()
+	if element, inMemory := c.memory[key]; inMemory {
+		c.memoryLRU.MoveToFront(element)
+		entry := element.Value.(*memoryEntry)
+		c.hits++
+		c.servedBytes += uint64(entry.size)
+		c.access.Unlock()
+		return entry.result, true
+	}
+	c.access.Unlock()
+	// Try the disk tier
+	if c.disk != nil {
+		if result, found = c.disk.get(key); found {
+			c.access.Lock()
+			c.hits++
+			c.diskHits++
+			c.servedBytes += uint64(proto.Size(result))
+			c.access.Unlock()
+			c.promote(key, result)
+			return
+		}
+	}
+	c.access.Lock()
+	c.misses++
+	c.access.Unlock()
+	return
+}
+
+// Set stores result as key. result must not be modified afterwards.
+func (c *Controller) Set(key string, result *prompb.QueryResult) {
+	c.access.Lock()
+	c.storedBytes += uint64(proto.Size(result))
+	c.access.Unlock()
+	c.promote(key, result)
+}
+
+// promote adds result to the memory tier, moving the least recently used results to the disk tier if needed
+func (c *Controller) promote(key string, result *prompb.QueryResult) {
+	entry := &memoryEntry{
+		key:    key,
+		result: result,
+		size:   int64(proto.Size(result)),
+	}
+	var evicted []*memoryEntry
+	c.access.Lock()
+	if element, found := c.memory[key]; found {
+		c.memorySize -= element.Value.(*memoryEntry).size
+		c.memoryLRU.Remove(element)
+	}
+	c.memory[key] = c.memoryLRU.PushFront(entry)
+	c.memorySize += entry.size
+	for c.memorySize > c.maxMemory && c.memoryLRU.Len() > 1 {
+		oldest := c.memoryLRU.Remove(c.memoryLRU.Back()).(*memoryEntry)
+		delete(c.memory, oldest.key)
+		c.memorySize -= oldest.size
+		c.evictions++
+		evicted = append(evicted, oldest)
+	}
+	generation := c.generation
+	c.access.Unlock()
+	// Write evicted results to disk without holding the memory tier
+	if c.disk == nil {
+		return
+	}
+	for _, oldest := range evicted {
+		if c.purgedSince(generation) {
+			return // evicted results may have been purged meanwhile
+		}
+		if c.disk.has(oldest.key) {
+			continue // results are immutable: no need to write them again
+		}
+		if err := c.disk.set(oldest.key, oldest.result); err != nil {
+			c.log.Warningf("[ResultCache] can't move result '%s' to disk: %v", oldest.key, err)
+		}
+	}
+}
+
+func (c *Controller) purgedSince(generation uint64) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.generation != generation
+}
+
+// Purge removes the results of database from both tiers (all of them if database is empty),
+// typically after its data has been rewritten or backfilled. It returns how many have been removed.
+func (c *Controller) Purge(database string) (purged int) {
+	selected := func(key string) bool { return database == "" || inDatabase(key, database) }
+	removed := make(map[string]struct{})
+	c.access.Lock()
+	c.generation++ // results being moved to disk are now outdated
+	for key, element := range c.memory {
+		if !selected(key) {
+			continue
+		}
+		c.memorySize -= element.Value.(*memoryEntry).size
+		c.memoryLRU.Remove(element)
+		delete(c.memory, key)
+		removed[key] = struct{}{}
+	}
+	c.access.Unlock()
+	if c.disk != nil {
+		for _, key := range c.disk.purge(selected) {
+			removed[key] = struct{}{}
+		}
+	}
+	return len(removed)
+}
@@ -0,0 +1,174 @@
+package resultcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/hekmon/hllogger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var testMatchers = []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}
+
+// testResult returns a result of a single series of nbSamples samples
+func testResult(nbSamples int) *prompb.QueryResult {
+	ts := &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: make([]prompb.Sample, nbSamples),
+	}
+	for index := range ts.Samples {
+		ts.Samples[index] = prompb.Sample{Timestamp: int64(index), Value: float64(index)}
+	}
+	return &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{ts}}
+}
+
+func newTestCache(t *testing.T, maxMemory int64, directory string) *Controller {
+	c, err := New(Config{
+		MaxMemory: maxMemory,
+		Directory: directory,
+		Logger:    hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resultcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A single result fits in memory: the others are moved to disk
+	c := newTestCache(t, 1, dir)
+	keys := map[string][]string{}
+	for _, database := range []string{"a", "b"} {
+		for block := int64(0); block < 3; block++ {
+			key := Key(database, "autogen", testMatchers, block*3600000, 3600000)
+			c.Set(key, testResult(10))
+			keys[database] = append(keys[database], key)
+		}
+	}
+	if purged := c.Purge("a"); purged != 3 {
+		t.Errorf("purged %d results of 'a', expected 3", purged)
+	}
+	for database, expected := range map[string]bool{"a": false, "b": true} {
+		for _, key := range keys[database] {
+			if _, found := c.Get(key); found != expected {
+				t.Errorf("'%s': result '%s' found: %v, expected %v", database, key, found, expected)
+			}
+		}
+	}
+	if purged := c.Purge(""); purged != 3 {
+		t.Errorf("purged %d results, expected 3", purged)
+	}
+	if stats := c.Stats(); stats.MemoryEntries != 0 || stats.MemoryBytes != 0 || stats.DiskEntries != 0 || stats.DiskBytes != 0 {
+		t.Errorf("results left after purging everything: %+v", stats)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d file(s) left on disk after purging everything", len(files))
+	}
+}
+
+func TestLegacyKeysDropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resultcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Results of a previous key format can't be purged by database
+	legacy := filepath.Join(dir, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"+resultExt)
+	if err = ioutil.WriteFile(legacy, []byte("whatever"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if stats := newTestCache(t, 1024, dir).Stats(); stats.DiskEntries != 0 {
+		t.Errorf("got %d disk entries, expected the legacy result to be dropped", stats.DiskEntries)
+	}
+	if _, err = os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy result file still exists: %v", err)
+	}
+}
+
+func TestEvictionToDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resultcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	result := testResult(100)
+	// Room for two results in memory
+	c := newTestCache(t, 2*int64(proto.Size(result)), dir)
+	var keys []string
+	for block := int64(0); block < 3; block++ {
+		key := Key("influx", "autogen", testMatchers, block*3600000, 3600000)
+		c.Set(key, testResult(100))
+		keys = append(keys, key)
+	}
+	if stats := c.Stats(); stats.MemoryEntries != 2 || stats.Evictions != 1 || stats.DiskEntries != 1 {
+		t.Fatalf("expected the oldest result to be moved to disk, got %+v", stats)
+	}
+	// Served from disk and promoted back to memory, evicting the least recently used one
+	got, found := c.Get(keys[0])
+	if !found || !reflect.DeepEqual(got, result) {
+		t.Fatalf("got %v (found: %v) from disk, expected %v", got, found, result)
+	}
+	if stats := c.Stats(); stats.DiskHits != 1 || stats.MemoryEntries != 2 || stats.Evictions != 2 || stats.DiskEntries != 2 {
+		t.Errorf("unexpected stats after the disk hit: %+v", stats)
+	}
+	// Promoted results are kept on disk: they are not written again once evicted
+	if _, found = c.Get(keys[1]); !found {
+		t.Error("result moved to disk is missing")
+	}
+	if stats := c.Stats(); stats.DiskHits != 2 || stats.DiskEntries != 3 {
+		t.Errorf("unexpected stats after the second disk hit: %+v", stats)
+	}
+	// Results kept on disk across restarts
+	if stats := newTestCache(t, 1024, dir).Stats(); stats.DiskEntries != 3 {
+		t.Errorf("got %d disk entries after a restart, expected 3", stats.DiskEntries)
+	}
+}
+
+func TestCorruptedResultDropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resultcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestCache(t, 1, dir)
+	key := Key("influx", "autogen", testMatchers, 0, 3600000)
+	c.Set(key, testResult(10))
+	c.Set(Key("influx", "autogen", testMatchers, 3600000, 3600000), testResult(10)) // moves the first one to disk
+	if !c.disk.has(key) {
+		t.Fatal("result has not been moved to disk")
+	}
+	for name, content := range map[string][]byte{
+		"not snappy":      []byte("not snappy"),
+		"not a result":    snappy.Encode(nil, []byte{0xff, 0xff, 0xff}),
+		"missing content": nil,
+	} {
+		if content == nil {
+			err = os.Remove(c.disk.path(key))
+		} else {
+			err = ioutil.WriteFile(c.disk.path(key), content, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, found := c.Get(key); found {
+			t.Errorf("%s: got %v, expected a miss", name, result)
+		}
+		if c.disk.has(key) {
+			t.Errorf("%s: unreadable result still indexed", name)
+		}
+		// Index it again for the next case
+		if err = c.disk.set(key, testResult(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package resultcache
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/hekmon/hllogger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const resultExt = ".res"
+
+// diskTier holds snappy compressed results as one file per key, bounded by size
+type diskTier struct {
+	access    sync.Mutex
+	directory string
+	index     map[string]*list.Element
+	lru       *list.List // of *diskEntry, most recently used first
+	size      int64
+	maxSize   int64
+	log       *hllogger.HlLogger
+}
+
+type diskEntry struct {
+	key  string
+	size int64
+}
+
+func newDiskTier(directory string, maxSize int64, logger *hllogger.HlLogger) (dt *diskTier, err error) {
+	if err = os.MkdirAll(directory, 0700); err != nil {
+		err = fmt.Errorf("can't create result cache directory: %v", err)
+		return
+	}
+	dt = &diskTier{
+		directory: directory,
+		index:     make(map[string]*list.Element),
+		lru:       list.New(),
+		maxSize:   maxSize,
+		log:       logger,
+	}
+	// Index the results of a previous run, oldest last
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		err = fmt.Errorf("can't list result cache directory: %v", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		key := strings.TrimSuffix(file.Name(), resultExt)
+		if !strings.HasSuffix(file.Name(), resultExt) || !validKey(key) {
+			// leftover temporary file or result of a previous key format
+			os.Remove(filepath.Join(directory, file.Name()))
+			continue
+		}
+		dt.index[key] = dt.lru.PushBack(&diskEntry{
+			key:  key,
+			size: file.Size(),
+		})
+		dt.size += file.Size()
+	}
+	dt.evict()
+	logger.Infof("[ResultCache] %d results (%d bytes) found on disk", len(dt.index), dt.size)
+	return
+}
+
+func (dt *diskTier) path(key string) string {
+	return filepath.Join(dt.directory, key+resultExt)
+}
+
+func (dt *diskTier) usage() (size int64, entries int) {
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	return dt.size, len(dt.index)
+}
+
+func (dt *diskTier) has(key string) (found bool) {
+	dt.access.Lock()
+	_, found = dt.index[key]
+	dt.access.Unlock()
+	return
+}
+
+func (dt *diskTier) get(key string) (result *prompb.QueryResult, found bool) {
+	dt.access.Lock()
+	element, found := dt.index[key]
+	if found {
+		dt.lru.MoveToFront(element)
+	}
+	dt.access.Unlock()
+	if !found {
+		return
+	}
+	var err error
+	defer func() {
+		if err != nil {
+			dt.log.Warningf("[ResultCache] can't read result '%s' from disk: dropping it: %v", key, err)
+			dt.remove(key)
+			result, found = nil, false
+		}
+	}()
+	compressed, err := ioutil.ReadFile(dt.path(key))
+	if err != nil {
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return
+	}
+	result = new(prompb.QueryResult)
+	err = proto.Unmarshal(raw, result)
+	return
+}
+
+func (dt *diskTier) set(key string, result *prompb.QueryResult) (err error) {
+	raw, err := proto.Marshal(result)
+	if err != nil {
+		return
+	}
+	compressed := snappy.Encode(nil, raw)
+	// Write it atomically
+	tmp, err := ioutil.TempFile(dt.directory, key+".tmp")
+	if err != nil {
+		return
+	}
+	if _, err = tmp.Write(compressed); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err = os.Rename(tmp.Name(), dt.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	// Index it
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	if element, found := dt.index[key]; found {
+		dt.size -= element.Value.(*diskEntry).size
+		dt.lru.Remove(element)
+	}
+	dt.index[key] = dt.lru.PushFront(&diskEntry{
+		key:  key,
+		size: int64(len(compressed)),
+	})
+	dt.size += int64(len(compressed))
+	dt.evict()
+	return
+}
+
+func (dt *diskTier) remove(key string) {
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	if element, found := dt.index[key]; found {
+		dt.size -= element.Value.(*diskEntry).size
+		dt.lru.Remove(element)
+		delete(dt.index, key)
+		os.Remove(dt.path(key))
+	}
+}
+
+// purge removes the results matching selected and returns their keys
+func (dt *diskTier) purge(selected func(key string) bool) (purged []string) {
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	for key, element := range dt.index {
+		if !selected(key) {
+			continue
+		}
+		dt.size -= element.Value.(*diskEntry).size
+		dt.lru.Remove(element)
+		delete(dt.index, key)
+		if err := os.Remove(dt.path(key)); err != nil && !os.IsNotExist(err) {
+			dt.log.Warningf("[ResultCache] can't remove purged result '%s' from disk: %v", key, err)
+		}
+		purged = append(purged, key)
+	}
+	return
+}
+
+// evict removes the least recently used results until the tier fits. Caller must hold dt.access.
+func (dt *diskTier) evict() {
+	for dt.maxSize > 0 && dt.size > dt.maxSize && dt.lru.Len() > 0 {
+		oldest := dt.lru.Remove(dt.lru.Back()).(*diskEntry)
+		delete(dt.index, oldest.key)
+		dt.size -= oldest.size
+		if err := os.Remove(dt.path(oldest.key)); err != nil && !os.IsNotExist(err) {
+			dt.log.Warningf("[ResultCache] can't remove evicted result '%s' from disk: %v", oldest.key, err)
+		}
+	}
+}
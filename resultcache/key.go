@@ -0,0 +1,63 @@
+package resultcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// keySeparator separates the database tag from the digest of the block within keys
+const keySeparator = "-"
+
+// Key returns the cache key of the block of blockDuration ms starting at blockStart (ms) for matchers
+// on database and rp. Matchers are normalized (their order does not matter). Read hints are not part
+// of the key as influxdb returns raw samples whatever the hints are. Keys start with the tag of
+// database, allowing to purge its results.
+func Key(database, rp string, matchers []*prompb.LabelMatcher, blockStart, blockDuration int64) string {
+	sorted := make([]*prompb.LabelMatcher, len(matchers))
+	copy(sorted, matchers)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type < sorted[j].Type
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	hash := sha256.New()
+	for _, part := range []string{database, rp, strconv.FormatInt(blockStart, 10), strconv.FormatInt(blockDuration, 10)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	for _, matcher := range sorted {
+		hash.Write([]byte(matcher.Name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(matcher.Type.String()))
+		hash.Write([]byte{0})
+		hash.Write([]byte(matcher.Value))
+		hash.Write([]byte{0})
+	}
+	return databaseTag(database) + keySeparator + hex.EncodeToString(hash.Sum(nil))
+}
+
+// databaseTag returns a short digest of database, usable within file names
+func databaseTag(database string) string {
+	digest := sha256.Sum256([]byte(database))
+	return hex.EncodeToString(digest[:8])
+}
+
+// validKey reports whether key has been returned by Key (and not by a previous version of it)
+func validKey(key string) bool {
+	parts := strings.Split(key, keySeparator)
+	return len(parts) == 2 && len(parts[0]) == 16 && len(parts[1]) == 2*sha256.Size
+}
+
+// inDatabase reports whether key is the one of a result of database
+func inDatabase(key, database string) bool {
+	return strings.HasPrefix(key, databaseTag(database)+keySeparator)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"rrinterceptor/prefetcher"
+	"rrinterceptor/promutils"
+	"rrinterceptor/resultcache"
+	"rrinterceptor/scheduler"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	resultCache         *resultcache.Controller
+	resultCacheBlock    time.Duration
+	resultCacheHorizon  time.Duration
+	resultCacheHorizons map[string]time.Duration // by retention policy, resultCacheHorizon for the others
+	readPrefetcher      *prefetcher.Controller
+)
+
+// writeHorizon returns the delay after which the data of rp is considered immutable
+func writeHorizon(rp string) time.Duration {
+	if horizon, found := resultCacheHorizons[rp]; found {
+		return horizon
+	}
+	return resultCacheHorizon
+}
+
+// readSeries returns the series matching req from rp, going through the result cache if enabled
+func readSeries(ctx context.Context, ci conInfo, rp string, req *prompb.ReadRequest) (resp *prompb.ReadResponse, err error) {
+	if resultCache == nil {
+		return fetchRemoteRead(ctx, ci, rp, req)
+	}
+	if readPrefetcher != nil {
+		observeReads(ci, rp, req)
+	}
+	return readSeriesCached(ctx, ci, rp, req)
+}
+
+// observeReads feeds the prefetcher with the queries of req
+func observeReads(ci conInfo, rp string, req *prompb.ReadRequest) {
+	now := time.Now()
+	for _, query := range req.Queries {
+		if query == nil {
+			continue
+		}
+		pattern := prefetcher.Pattern{
+			Database:        ci.database,
+			RetentionPolicy: rp,
+			User:            ci.user,
+			Password:        ci.password,
+			Matchers:        query.Matchers,
+			Range:           time.Duration(query.EndTimestampMs-query.StartTimestampMs) * time.Millisecond,
+		}
+		if query.Hints != nil {
+			pattern.StepMs = query.Hints.StepMs
+		}
+		readPrefetcher.Observe(pattern, now)
+	}
+}
+
+// prefetchRead populates the result cache with the immutable blocks of a read expected between start and end
+func prefetchRead(ctx context.Context, pattern prefetcher.Pattern, start, end time.Time) (err error) {
+	blockMs := int64(resultCacheBlock / time.Millisecond)
+	// Only immutable blocks are cached, the fresh tail will be read anyway
+	lastImmutable := alignDown(promutils.GetTSFromTime(time.Now().Add(-writeHorizon(pattern.RetentionPolicy))), blockMs) - 1
+	query := &prompb.Query{
+		StartTimestampMs: promutils.GetTSFromTime(start),
+		EndTimestampMs:   promutils.GetTSFromTime(end),
+		Matchers:         pattern.Matchers,
+	}
+	if query.EndTimestampMs > lastImmutable {
+		query.EndTimestampMs = lastImmutable
+	}
+	if query.StartTimestampMs > query.EndTimestampMs {
+		return
+	}
+	if pattern.StepMs > 0 {
+		query.Hints = &prompb.ReadHints{StepMs: pattern.StepMs}
+	}
+	ci := conInfo{
+		database: pattern.Database,
+		user:     pattern.User,
+		password: pattern.Password,
+	}
+	// Prefetches must not delay the reads of the clients
+	_, err = readSeriesCached(withReadPriority(ctx, scheduler.Low), ci, pattern.RetentionPolicy, &prompb.ReadRequest{Queries: []*prompb.Query{query}})
+	return
+}
+
+// cachedQuery is the plan of a query served through the result cache: its time range is
+// split in aligned blocks (cached if older than the write horizon) followed by a fresh tail.
+type cachedQuery struct {
+	query   *prompb.Query
+	parts   []*prompb.QueryResult // in time order, nil until fetched
+	fetches []cachedFetch
+}
+
+// cachedFetch is an upstream query filling one or more consecutive parts of a cachedQuery
+type cachedFetch struct {
+	upstreamIndex int
+	firstPart     int
+	blocks        []int64 // start of each immutable block fetched, empty for the tail
+}
+
+// readSeriesCached serves the immutable blocks of each query from the result cache and fetches
+// the missing blocks and the fresh tails from influxdb within a single upstream request
+func readSeriesCached(ctx context.Context, ci conInfo, rp string, req *prompb.ReadRequest) (resp *prompb.ReadResponse, err error) {
+	blockMs := int64(resultCacheBlock / time.Millisecond)
+	horizonMs := promutils.GetTSFromTime(time.Now().Add(-writeHorizon(rp)))
+	plans := make([]cachedQuery, len(req.Queries))
+	var upstream prompb.ReadRequest
+	for queryIndex, query := range req.Queries {
+		plan := &plans[queryIndex]
+		plan.query = query
+		tailStart := query.StartTimestampMs
+		// Immutable blocks
+		inRun := false
+		for blockStart := alignDown(query.StartTimestampMs, blockMs); blockStart <= query.EndTimestampMs && blockStart+blockMs <= horizonMs; blockStart += blockMs {
+			tailStart = blockStart + blockMs
+			if result, found := resultCache.Get(resultcache.Key(ci.database, rp, query.Matchers, blockStart, blockMs)); found {
+				plan.parts = append(plan.parts, result)
+				inRun = false
+				continue
+			}
+			plan.parts = append(plan.parts, nil)
+			if !inRun {
+				// Start a new run of consecutive missing blocks
+				plan.fetches = append(plan.fetches, cachedFetch{
+					upstreamIndex: len(upstream.Queries),
+					firstPart:     len(plan.parts) - 1,
+				})
+				upstream.Queries = append(upstream.Queries, &prompb.Query{
+					StartTimestampMs: blockStart,
+					Matchers:         query.Matchers,
+					Hints:            query.Hints,
+				})
+				inRun = true
+			}
+			run := &plan.fetches[len(plan.fetches)-1]
+			run.blocks = append(run.blocks, blockStart)
+			upstream.Queries[run.upstreamIndex].EndTimestampMs = blockStart + blockMs - 1
+		}
+		// Fresh tail
+		if tailStart < query.StartTimestampMs {
+			tailStart = query.StartTimestampMs
+		}
+		if tailStart <= query.EndTimestampMs {
+			plan.parts = append(plan.parts, nil)
+			plan.fetches = append(plan.fetches, cachedFetch{
+				upstreamIndex: len(upstream.Queries),
+				firstPart:     len(plan.parts) - 1,
+			})
+			upstream.Queries = append(upstream.Queries, &prompb.Query{
+				StartTimestampMs: tailStart,
+				EndTimestampMs:   query.EndTimestampMs,
+				Matchers:         query.Matchers,
+				Hints:            query.Hints,
+			})
+		}
+	}
+	// Fetch what is missing
+	var upstreamResp *prompb.ReadResponse
+	if len(upstream.Queries) > 0 {
+		if upstreamResp, err = fetchRemoteRead(ctx, ci, rp, &upstream); err != nil {
+			return
+		}
+	}
+	// Store the fetched blocks and assemble the answer. Buffered writes may still land in blocks
+	// older than the horizon: don't cache them until the write buffer has been replayed.
+	storable := writeBuffer == nil || !writeBuffer.PendingFor(ci.database)
+	resp = &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(plans))}
+	for queryIndex, plan := range plans {
+		for _, fetch := range plan.fetches {
+			result := upstreamResp.Results[fetch.upstreamIndex]
+			if len(fetch.blocks) == 0 {
+				plan.parts[fetch.firstPart] = result
+				continue
+			}
+			for blockIndex, blockStart := range fetch.blocks {
+				// Copied: a trimmed block still points into the arrays of the whole fetch run
+				block := promutils.CloneQueryResult(promutils.TrimQueryResult(result, blockStart, blockStart+blockMs-1))
+				if storable {
+					resultCache.Set(resultcache.Key(ci.database, rp, plan.query.Matchers, blockStart, blockMs), block)
+				}
+				plan.parts[fetch.firstPart+blockIndex] = block
+			}
+		}
+		resp.Results[queryIndex] = promutils.TrimQueryResult(promutils.MergeQueryResults(plan.parts...),
+			plan.query.StartTimestampMs, plan.query.EndTimestampMs)
+	}
+	log.Debugf("[ResultCache] '%s' database: %d queries on '%s' served with %d upstream queries", ci.database, len(req.Queries), rp, len(upstream.Queries))
+	return
+}
+
+// alignDown returns the start of the block of blockMs containing ts
+func alignDown(ts, blockMs int64) int64 {
+	aligned := ts - ts%blockMs
+	if ts < 0 && ts%blockMs != 0 {
+		aligned -= blockMs
+	}
+	return aligned
+}
@@ -0,0 +1,251 @@
+package scheduler
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+// Class is the priority of an upstream request
+type Class int
+
+// Priority classes, served in this order
+const (
+	High Class = iota
+	Normal
+	Low
+	nbClasses
+)
+
+// Classes lists the priority classes from the highest to the lowest
+var Classes = []Class{High, Normal, Low}
+
+func (c Class) String() string {
+	switch c {
+	case High:
+		return "high"
+	case Normal:
+		return "normal"
+	case Low:
+		return "low"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseClass returns the class named name
+func ParseClass(name string) (class Class, found bool) {
+	for _, class = range Classes {
+		if class.String() == name {
+			return class, true
+		}
+	}
+	return Normal, false
+}
+
+// AnyRetentionPolicy is the MaxPerRP key applying to the retention policies without their own limit
+const AnyRetentionPolicy = "*"
+
+// ErrQueueTimeout is returned by Acquire when no slot could be granted within the queue timeout
+var ErrQueueTimeout = errors.New("timed out while waiting for an upstream slot")
+
+// Config allow to pass values to the contructor
+type Config struct {
+	MaxPerBackend int            // concurrent upstream requests on each backend
+	MaxPerRP      map[string]int // concurrent upstream requests on each retention policy of a backend, 0 or absent for unlimited
+	QueueTimeout  time.Duration  // 0 for unlimited
+	Logger        *hllogger.HlLogger
+}
+
+// New returns an initialized and ready to use scheduler
+func New(conf Config) (c *Controller, err error) {
+	if conf.Logger == nil {
+		err = errors.New("logger can't be nil")
+		return
+	}
+	if conf.MaxPerBackend <= 0 {
+		err = errors.New("max concurrency per backend must be positive")
+		return
+	}
+	c = &Controller{
+		backends:      make(map[string]*backend),
+		maxPerBackend: conf.MaxPerBackend,
+		maxPerRP:      conf.MaxPerRP,
+		queueTimeout:  conf.QueueTimeout,
+		log:           conf.Logger,
+	}
+	return
+}
+
+// Controller bounds the concurrent upstream requests, queueing the others by priority class
+type Controller struct {
+	access        sync.Mutex
+	backends      map[string]*backend
+	maxPerBackend int
+	maxPerRP      map[string]int
+	queueTimeout  time.Duration
+	// Stats
+	granted  [nbClasses]uint64
+	timeouts [nbClasses]uint64
+	// Sub Controllers
+	log *hllogger.HlLogger
+}
+
+type backend struct {
+	inFlight   int
+	rpInFlight map[string]int
+	queues     [nbClasses]*list.List // of *waiter, oldest first
+}
+
+type waiter struct {
+	rp      string
+	class   Class
+	granted chan struct{}
+}
+
+// Acquire waits for a slot to send a request to rp on backend. release must be called once the request is done.
+func (c *Controller) Acquire(ctx context.Context, backendHost, rp string, class Class) (release func(), err error) {
+	if class < High || class >= nbClasses {
+		class = Normal
+	}
+	c.access.Lock()
+	b := c.getOrCreate(backendHost)
+	release = func() { c.release(b, rp) }
+	// Free slot: as every release dispatches what it can, the waiting requests can't use it (saturated rp)
+	if c.available(b, rp) {
+		c.grant(b, rp, class)
+		c.access.Unlock()
+		return
+	}
+	// Wait for one
+	w := &waiter{
+		rp:      rp,
+		class:   class,
+		granted: make(chan struct{}),
+	}
+	element := b.queues[class].PushBack(w)
+	c.access.Unlock()
+	var timeout <-chan time.Time
+	if c.queueTimeout > 0 {
+		timer := time.NewTimer(c.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.granted:
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+	// Leave the queue, unless the slot has been granted meanwhile
+	c.access.Lock()
+	select {
+	case <-w.granted:
+		c.access.Unlock()
+		return release, nil
+	default:
+	}
+	b.queues[class].Remove(element)
+	if err == ErrQueueTimeout {
+		c.timeouts[class]++
+		c.log.Debugf("[Scheduler] %s priority request on '%s' timed out after waiting %v", class, rp, c.queueTimeout)
+	}
+	c.access.Unlock()
+	return nil, err
+}
+
+// getOrCreate returns the state of backendHost, access must be held
+func (c *Controller) getOrCreate(backendHost string) (b *backend) {
+	var found bool
+	if b, found = c.backends[backendHost]; !found {
+		b = &backend{rpInFlight: make(map[string]int)}
+		for class := range b.queues {
+			b.queues[class] = list.New()
+		}
+		c.backends[backendHost] = b
+	}
+	return
+}
+
+// available returns true if a request to rp can be sent on b, access must be held
+func (c *Controller) available(b *backend, rp string) bool {
+	if b.inFlight >= c.maxPerBackend {
+		return false
+	}
+	max, limited := c.maxPerRP[rp]
+	if !limited {
+		max = c.maxPerRP[AnyRetentionPolicy]
+	}
+	return max <= 0 || b.rpInFlight[rp] < max
+}
+
+// grant accounts a new request in flight, access must be held
+func (c *Controller) grant(b *backend, rp string, class Class) {
+	b.inFlight++
+	b.rpInFlight[rp]++
+	c.granted[class]++
+}
+
+// release ends a request and hands the freed slot to the best waiting request
+func (c *Controller) release(b *backend, rp string) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	b.inFlight--
+	if b.rpInFlight[rp]--; b.rpInFlight[rp] <= 0 {
+		delete(b.rpInFlight, rp)
+	}
+	c.dispatch(b)
+}
+
+// dispatch grants the free slots to the waiting requests: highest class first, oldest first within a class.
+// A request whose retention policy is saturated does not block the following ones. access must be held.
+func (c *Controller) dispatch(b *backend) {
+	for _, class := range Classes {
+		for element := b.queues[class].Front(); element != nil && b.inFlight < c.maxPerBackend; {
+			next := element.Next()
+			w := element.Value.(*waiter)
+			if c.available(b, w.rp) {
+				b.queues[class].Remove(element)
+				c.grant(b, w.rp, class)
+				close(w.granted)
+			}
+			element = next
+		}
+	}
+}
+
+// Stats contains the scheduler counters
+type Stats struct {
+	InFlight   int
+	QueueDepth map[Class]int
+	Granted    map[Class]uint64
+	Timeouts   map[Class]uint64
+}
+
+// Stats returns the current counters of the scheduler, summed over the backends
+func (c *Controller) Stats() (stats Stats) {
+	stats = Stats{
+		QueueDepth: make(map[Class]int, nbClasses),
+		Granted:    make(map[Class]uint64, nbClasses),
+		Timeouts:   make(map[Class]uint64, nbClasses),
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	for _, b := range c.backends {
+		stats.InFlight += b.inFlight
+		for _, class := range Classes {
+			stats.QueueDepth[class] += b.queues[class].Len()
+		}
+	}
+	for _, class := range Classes {
+		stats.Granted[class] = c.granted[class]
+		stats.Timeouts[class] = c.timeouts[class]
+	}
+	return
+}
@@ -0,0 +1,220 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+const testBackend = "influxdb:8086"
+
+type acquired struct {
+	name    string
+	release func()
+	err     error
+}
+
+func newTestScheduler(t *testing.T, maxPerBackend int, maxPerRP map[string]int, queueTimeout time.Duration) *Controller {
+	c, err := New(Config{
+		MaxPerBackend: maxPerBackend,
+		MaxPerRP:      maxPerRP,
+		QueueTimeout:  queueTimeout,
+		Logger:        hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// mustAcquire acquires a slot which must be free
+func mustAcquire(t *testing.T, c *Controller, rp string) func() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err := c.Acquire(ctx, testBackend, rp, Normal)
+	if err != nil {
+		t.Fatalf("'%s': can't acquire a free slot: %v", rp, err)
+	}
+	return release
+}
+
+// acquireAsync queues a request and waits for it to be queued. Its outcome is sent to results.
+func acquireAsync(t *testing.T, c *Controller, ctx context.Context, name, rp string, class Class, results chan<- acquired) {
+	queued := queueDepth(c)
+	go func() {
+		release, err := c.Acquire(ctx, testBackend, rp, class)
+		results <- acquired{name: name, release: release, err: err}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for queueDepth(c) != queued+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("'%s' has not been queued", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func queueDepth(c *Controller) (depth int) {
+	for _, classDepth := range c.Stats().QueueDepth {
+		depth += classDepth
+	}
+	return
+}
+
+func receive(t *testing.T, results <-chan acquired) acquired {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("no request has been granted a slot")
+	}
+	return acquired{}
+}
+
+func expectNothing(t *testing.T, results <-chan acquired) {
+	select {
+	case result := <-results:
+		t.Fatalf("'%s' unexpectedly returned (error: %v)", result.name, result.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	c := newTestScheduler(t, 1, nil, 0)
+	release := mustAcquire(t, c, "autogen")
+	results := make(chan acquired, 4)
+	ctx := context.Background()
+	acquireAsync(t, c, ctx, "low", "autogen", Low, results)
+	acquireAsync(t, c, ctx, "normal #1", "autogen", Normal, results)
+	acquireAsync(t, c, ctx, "high", "autogen", High, results)
+	acquireAsync(t, c, ctx, "normal #2", "autogen", Normal, results)
+	// Each release grants the single slot to the best waiting request
+	for _, expected := range []string{"high", "normal #1", "normal #2", "low"} {
+		release()
+		result := receive(t, results)
+		if result.err != nil || result.name != expected {
+			t.Fatalf("got '%s' (error: %v), expected '%s'", result.name, result.err, expected)
+		}
+		expectNothing(t, results)
+		release = result.release
+	}
+	release()
+	if stats := c.Stats(); stats.InFlight != 0 || queueDepth(c) != 0 || stats.Granted[Normal] != 3 || stats.Granted[High] != 1 || stats.Granted[Low] != 1 {
+		t.Errorf("unexpected stats once done: %+v", stats)
+	}
+}
+
+func TestSaturatedRetentionPolicySkipped(t *testing.T) {
+	c := newTestScheduler(t, 2, map[string]int{"month": 1}, 0)
+	releaseMonth := mustAcquire(t, c, "month")
+	releaseAutogen := mustAcquire(t, c, "autogen")
+	results := make(chan acquired, 2)
+	ctx := context.Background()
+	acquireAsync(t, c, ctx, "month", "month", High, results)
+	acquireAsync(t, c, ctx, "autogen", "autogen", Low, results)
+	// The freed slot can't be used by month (saturated): it goes to the following request
+	releaseAutogen()
+	result := receive(t, results)
+	if result.err != nil || result.name != "autogen" {
+		t.Fatalf("got '%s' (error: %v), expected 'autogen'", result.name, result.err)
+	}
+	expectNothing(t, results)
+	releaseMonth()
+	if result = receive(t, results); result.err != nil || result.name != "month" {
+		t.Fatalf("got '%s' (error: %v), expected 'month'", result.name, result.err)
+	}
+}
+
+func TestRetentionPolicyLimits(t *testing.T) {
+	c := newTestScheduler(t, 10, map[string]int{AnyRetentionPolicy: 1, "inf": 2, "raw": 0}, 10*time.Millisecond)
+	for rp, limit := range map[string]int{"autogen": 1, "month": 1, "inf": 2, "raw": 10} {
+		var releases []func()
+		for index := 0; index < limit; index++ {
+			releases = append(releases, mustAcquire(t, c, rp))
+		}
+		if _, err := c.Acquire(context.Background(), testBackend, rp, Normal); err != ErrQueueTimeout {
+			t.Errorf("'%s': expected request #%d to time out, got %v", rp, limit+1, err)
+		}
+		for _, release := range releases {
+			release()
+		}
+	}
+	if stats := c.Stats(); stats.InFlight != 0 || queueDepth(c) != 0 {
+		t.Errorf("unexpected stats once done: %+v", stats)
+	}
+	// Limits are per backend
+	release := mustAcquire(t, c, "autogen")
+	defer release()
+	if other, err := c.Acquire(context.Background(), "other:8086", "autogen", Normal); err != nil {
+		t.Errorf("'autogen' of another backend: %v", err)
+	} else {
+		other()
+	}
+}
+
+// grantWhileLeaving grants a slot to a queued request while it is leaving the queue,
+// leave being called to make it give up (nil to cancel its context)
+func grantWhileLeaving(t *testing.T, c *Controller, leave func()) {
+	mustAcquire(t, c, "autogen") // released by hand below
+	results := make(chan acquired, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	acquireAsync(t, c, ctx, "waiter", "autogen", Normal, results)
+	if leave == nil {
+		leave = cancel
+	}
+	// The waiter gives up and blocks on access while the slot is released (as release does, access being held)
+	c.access.Lock()
+	leave()
+	time.Sleep(50 * time.Millisecond)
+	b := c.backends[testBackend]
+	b.inFlight--
+	delete(b.rpInFlight, "autogen")
+	c.dispatch(b)
+	c.access.Unlock()
+	// The grant wins: the slot must not leak
+	result := receive(t, results)
+	if result.err != nil || result.release == nil {
+		t.Fatalf("expected the slot granted meanwhile to be returned, got error %v", result.err)
+	}
+	if stats := c.Stats(); stats.InFlight != 1 || queueDepth(c) != 0 {
+		t.Errorf("unexpected stats before release: %+v", stats)
+	}
+	result.release()
+	if stats := c.Stats(); stats.InFlight != 0 || stats.Timeouts[Normal] != 0 {
+		t.Errorf("unexpected stats after release: %+v", stats)
+	}
+}
+
+func TestGrantDuringTimeout(t *testing.T) {
+	grantWhileLeaving(t, newTestScheduler(t, 1, nil, 10*time.Millisecond), func() {})
+}
+
+func TestGrantDuringCancel(t *testing.T) {
+	grantWhileLeaving(t, newTestScheduler(t, 1, nil, 0), nil)
+}
+
+func TestLeaveQueue(t *testing.T) {
+	c := newTestScheduler(t, 1, nil, 20*time.Millisecond)
+	release := mustAcquire(t, c, "autogen")
+	// Timed out
+	if _, err := c.Acquire(context.Background(), testBackend, "autogen", Low); err != ErrQueueTimeout {
+		t.Errorf("expected a queue timeout, got %v", err)
+	}
+	// Cancelled
+	results := make(chan acquired, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	acquireAsync(t, c, ctx, "cancelled", "autogen", Normal, results)
+	cancel()
+	if result := receive(t, results); result.err != context.Canceled {
+		t.Errorf("expected the cancellation error, got %v", result.err)
+	}
+	// Requests which left the queue must not be granted the freed slot
+	release()
+	if stats := c.Stats(); stats.InFlight != 0 || queueDepth(c) != 0 || stats.Timeouts[Low] != 1 || stats.Timeouts[Normal] != 0 {
+		t.Errorf("unexpected stats once done: %+v", stats)
+	}
+}
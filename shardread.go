@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rrinterceptor/promutils"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	shardedFetchThreshold time.Duration // 0 disables sharded fetching
+	shardedFetchWorkers   int
+	shardedFetchMaxParts  int // sub-ranges of a read, adjacent shard groups being merged beyond
+	shardedReads          uint64
+	shardedSubReads       uint64
+)
+
+// shardedTask is an upstream request covering a part of the original queries
+type shardedTask struct {
+	req     prompb.ReadRequest
+	targets []shardedTarget
+	resp    *prompb.ReadResponse
+}
+
+// shardedTarget links a query of a task to its original query and its position within it
+type shardedTarget struct {
+	queryIndex int
+	partIndex  int
+}
+
+// fetchRemoteReadSharded splits the queries longer than the sharded fetch threshold on the shard groups of rp
+// and fetches the resulting sub-ranges concurrently. Short queries are fetched together in a single request.
+func fetchRemoteReadSharded(ctx context.Context, ci conInfo, rp string, req *prompb.ReadRequest) (resp *prompb.ReadResponse, err error) {
+	rps, err := cache.GetRPs(ctx, influxURL, ci.database, ci.user, ci.password)
+	if err != nil {
+		return
+	}
+	shardGroup := int64(rps[rp].ShardGroupDuration / time.Millisecond)
+	thresholdMs := int64(shardedFetchThreshold / time.Millisecond)
+	// Share the max parts between the long queries
+	var longQueries int
+	for _, query := range req.Queries {
+		if shardGroup > 0 && query.EndTimestampMs-query.StartTimestampMs >= thresholdMs {
+			longQueries++
+		}
+	}
+	partsPerQuery := int64(1)
+	if longQueries > 0 && shardedFetchMaxParts > longQueries {
+		partsPerQuery = int64(shardedFetchMaxParts / longQueries)
+	}
+	// Plan the tasks
+	var (
+		tasks []*shardedTask
+		short *shardedTask
+	)
+	parts := make([][]*prompb.QueryResult, len(req.Queries))
+	for queryIndex, query := range req.Queries {
+		if shardGroup <= 0 || query.EndTimestampMs-query.StartTimestampMs < thresholdMs {
+			if short == nil {
+				short = new(shardedTask)
+				tasks = append(tasks, short)
+			}
+			short.req.Queries = append(short.req.Queries, query)
+			short.targets = append(short.targets, shardedTarget{queryIndex: queryIndex})
+			parts[queryIndex] = make([]*prompb.QueryResult, 1)
+			continue
+		}
+		// Each sub-range covers as many whole shard groups as needed to stay within partsPerQuery
+		alignedStart := alignDown(query.StartTimestampMs, shardGroup)
+		groups := (query.EndTimestampMs-alignedStart)/shardGroup + 1
+		span := shardGroup * ((groups + partsPerQuery - 1) / partsPerQuery)
+		for subStart := alignedStart; subStart <= query.EndTimestampMs; subStart += span {
+			subQuery := &prompb.Query{
+				StartTimestampMs: subStart,
+				EndTimestampMs:   subStart + span - 1,
+				Matchers:         query.Matchers,
+				Hints:            query.Hints,
+			}
+			if subQuery.StartTimestampMs < query.StartTimestampMs {
+				subQuery.StartTimestampMs = query.StartTimestampMs
+			}
+			if subQuery.EndTimestampMs > query.EndTimestampMs {
+				subQuery.EndTimestampMs = query.EndTimestampMs
+			}
+			tasks = append(tasks, &shardedTask{
+				req: prompb.ReadRequest{Queries: []*prompb.Query{subQuery}},
+				targets: []shardedTarget{{
+					queryIndex: queryIndex,
+					partIndex:  len(parts[queryIndex]),
+				}},
+			})
+			parts[queryIndex] = append(parts[queryIndex], nil)
+		}
+	}
+	if len(tasks) == 1 {
+		return fetchRemoteReadOnce(ctx, ci, rp, req)
+	}
+	atomic.AddUint64(&shardedReads, 1)
+	atomic.AddUint64(&shardedSubReads, uint64(len(tasks)))
+	log.Debugf("[ShardedFetch] '%s' database: %d queries on '%s' split in %d upstream requests", ci.database, len(req.Queries), rp, len(tasks))
+	// Fetch them with a bounded pool, the first error cancels the others
+	if err = runShardedTasks(ctx, ci, rp, tasks); err != nil {
+		return
+	}
+	// Concatenate the parts of each query
+	for _, task := range tasks {
+		for index, target := range task.targets {
+			parts[target.queryIndex][target.partIndex] = task.resp.Results[index]
+		}
+	}
+	resp = &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(req.Queries))}
+	for queryIndex := range req.Queries {
+		if len(parts[queryIndex]) == 1 {
+			resp.Results[queryIndex] = parts[queryIndex][0]
+		} else {
+			resp.Results[queryIndex] = promutils.MergeQueryResults(parts[queryIndex]...)
+		}
+	}
+	return
+}
+
+func runShardedTasks(ctx context.Context, ci conInfo, rp string, tasks []*shardedTask) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		workers  sync.WaitGroup
+		errOnce  sync.Once
+		todo     = make(chan *shardedTask)
+		poolSize = shardedFetchWorkers
+	)
+	if poolSize > len(tasks) {
+		poolSize = len(tasks)
+	}
+	workers.Add(poolSize)
+	for i := 0; i < poolSize; i++ {
+		go func() {
+			defer workers.Done()
+			for task := range todo {
+				var taskErr error
+				if task.resp, taskErr = fetchRemoteReadOnce(ctx, ci, rp, &task.req); taskErr != nil {
+					errOnce.Do(func() {
+						err = taskErr
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for _, task := range tasks {
+		select {
+		case todo <- task:
+		case <-ctx.Done():
+		}
+	}
+	close(todo)
+	workers.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"rrinterceptor/cacher"
+	"rrinterceptor/coalescer"
+	"rrinterceptor/influxquery"
+	"rrinterceptor/influxrp"
+	"rrinterceptor/upstream"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var readCoalescer *coalescer.Group
+
+// rpResolutions holds the interval between points of the downsampled retention policies
+var rpResolutions map[string]time.Duration
+
+type contextKey int
+
+const (
+	// rpContextKey holds the retention policy selected for a read streamed by httpProxy
+	rpContextKey contextKey = iota
+	// limitsContextKey holds the responseLimits of a read streamed by httpProxy, if any
+	limitsContextKey
+	// priorityContextKey holds the scheduler class of the upstream requests of a read
+	priorityContextKey
+)
+
+// newReadProxy returns the long lived reverse proxy streaming reads to influxdb,
+// the retention policy to use must be set in the request context with rpContextKey
+func newReadProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			rp, _ := req.Context().Value(rpContextKey).(string)
+			setUpstreamRead(req.URL, rp)
+		},
+		Transport:      upstream.For(influxURL),
+		ModifyResponse: limitStreamedResponse,
+		ErrorHandler:   proxyErrorHandler,
+	}
+}
+
+// conInfo contains the influxdb connection infos extracted from a client request
+type conInfo struct {
+	database string
+	user     string
+	password string
+}
+
+// selectRetentionPolicy returns the best retention policy for queries. If rps is nil,
+// the retention policies could not be retreived (see lookupErrorStatus), otherwise queries can not be served.
+func selectRetentionPolicy(ctx context.Context, ci conInfo, queries []*prompb.Query) (rp string, rps influxrp.RetentionPolicies, err error) {
+	if rps, err = cache.GetRPs(ctx, influxURL, ci.database, ci.user, ci.password); err != nil {
+		rps = nil
+		err = fmt.Errorf("can't get retention policies for '%s' db: %w", ci.database, err)
+		return
+	}
+	if rp, err = getBestRetentionPolicy(queries, rps); err != nil {
+		err = fmt.Errorf("can't select the best retention policy: %v", err)
+	}
+	return
+}
+
+// lookupErrorStatus maps an influxdb lookup failure (retention policies, credentials validation or
+// meta query) to an HTTP status code and its API error type. Retry-After is set on w if influxdb is unavailable.
+func lookupErrorStatus(w http.ResponseWriter, err error) (statusCode int, errorType string) {
+	var (
+		kind       = influxquery.KindOf(err)
+		lookupErr  *cacher.LookupError
+		retryAfter time.Duration
+	)
+	if errors.As(err, &lookupErr) {
+		kind = lookupErr.Kind
+		retryAfter = lookupErr.RetryAfter
+	}
+	switch kind {
+	case influxquery.KindUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Basic realm="rrinterceptor"`)
+		return http.StatusUnauthorized, apiErrorUnauthorized
+	case influxquery.KindForbidden:
+		return http.StatusForbidden, apiErrorForbidden
+	case influxquery.KindNotFound:
+		return http.StatusNotFound, apiErrorNotFound
+	case influxquery.KindUnavailable:
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		return http.StatusServiceUnavailable, apiErrorUnavaible
+	default:
+		return http.StatusInternalServerError, apiErrorInternal
+	}
+}
+
+// setRoutingHeaders advertises to the client which backend and retention policy served its request
+func setRoutingHeaders(w http.ResponseWriter, rp string) {
+	w.Header().Set("X-RRInterceptor-RP", rp)
+	w.Header().Set("X-RRInterceptor-Backend", influxURL.Host)
+}
+
+// setUpstreamRead rewrites u in order to target the influxdb remote read endpoint with rp
+func setUpstreamRead(u *url.URL, rp string) {
+	u.Scheme = influxURL.Scheme
+	u.Host = influxURL.Host
+	u.Path = "/api/v1/prom/read"
+	urlQuery := u.Query()
+	urlQuery.Set("rp", rp)
+	u.RawQuery = urlQuery.Encode()
+}
+
+// fetchRemoteRead sends req to influxdb using rp and returns its decoded answer.
+// Long queries are split in concurrent sub-ranges if sharded fetching is enabled.
+func fetchRemoteRead(ctx context.Context, ci conInfo, rp string, req *prompb.ReadRequest) (resp *prompb.ReadResponse, err error) {
+	if shardedFetchThreshold > 0 {
+		return fetchRemoteReadSharded(ctx, ci, rp, req)
+	}
+	return fetchRemoteReadOnce(ctx, ci, rp, req)
+}
+
+// fetchRemoteReadOnce sends req to influxdb using rp within a single request and returns its decoded answer
+func fetchRemoteReadOnce(ctx context.Context, ci conInfo, rp string, req *prompb.ReadRequest) (resp *prompb.ReadResponse, err error) {
+	// Encode request
+	rawReq, err := proto.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("can't marshal read request: %v", err)
+		return
+	}
+	// Execute it
+	answer, err := fetchUpstreamRead(ctx, ci, rp, req, snappy.Encode(nil, rawReq))
+	if err != nil {
+		return
+	}
+	if answer.statusCode != http.StatusOK {
+		err = fmt.Errorf("influxdb answered '%s': %s", answer.status, bytes.TrimSpace(answer.body))
+		return
+	}
+	// Decode answer
+	rawResp, err := snappy.Decode(nil, answer.body)
+	if err != nil {
+		err = fmt.Errorf("can't decode influxdb answer as snappy: %v", err)
+		return
+	}
+	resp = new(prompb.ReadResponse)
+	if err = proto.Unmarshal(rawResp, resp); err != nil {
+		err = fmt.Errorf("can't unmarshal influxdb answer as protobuff: %v", err)
+		return
+	}
+	if len(resp.Results) != len(req.Queries) {
+		err = fmt.Errorf("influxdb answered with %d result(s) for %d queries", len(resp.Results), len(req.Queries))
+	}
+	return
+}
+
+// upstreamRead is a raw influxdb remote read answer. It may be shared between coalesced reads: do not modify it.
+type upstreamRead struct {
+	statusCode int
+	status     string
+	header     http.Header
+	body       []byte
+}
+
+// fetchUpstreamRead posts body (req encoded as snappy protobuf) to influxdb using rp.
+// If enabled, identical concurrent reads on the same database and rp share the same upstream request.
+func fetchUpstreamRead(ctx context.Context, ci conInfo, rp string, req *prompb.ReadRequest, body []byte) (answer *upstreamRead, err error) {
+	if readCoalescer == nil {
+		return doUpstreamRead(ctx, ci, rp, body)
+	}
+	key, err := coalescingKey(ci.database, rp, req)
+	if err != nil {
+		return
+	}
+	class := readPriorityOf(ctx)
+	value, shared, err := readCoalescer.Do(ctx, key, func(callCtx context.Context) (interface{}, error) {
+		return doUpstreamRead(withReadPriority(callCtx, class), ci, rp, body)
+	})
+	if err != nil {
+		return
+	}
+	if shared {
+		log.Debugf("[SmartRead] '%s' database: read on '%s' coalesced with an identical in flight one", ci.database, rp)
+	}
+	return value.(*upstreamRead), nil
+}
+
+func doUpstreamRead(ctx context.Context, ci conInfo, rp string, body []byte) (answer *upstreamRead, err error) {
+	release, err := acquireUpstream(ctx, rp)
+	if err != nil {
+		return
+	}
+	defer release()
+	upstreamURL := &url.URL{RawQuery: url.Values{"db": []string{ci.database}}.Encode()}
+	setUpstreamRead(upstreamURL, rp)
+	httpReq, err := http.NewRequest(http.MethodPost, upstreamURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.SetBasicAuth(ci.user, ci.password)
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+	httpResp, err := upstream.For(influxURL).Client().Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	answer = &upstreamRead{
+		statusCode: httpResp.StatusCode,
+		status:     httpResp.Status,
+		header:     httpResp.Header,
+	}
+	answer.body, err = getResponseLimits(ci.database).readAnswer(httpResp.Body)
+	return
+}
+
+// coalescingKey identifies identical reads: queries matchers are sorted as their order does not matter
+func coalescingKey(database, rp string, req *prompb.ReadRequest) (key string, err error) {
+	canonical := prompb.ReadRequest{Queries: make([]*prompb.Query, len(req.Queries))}
+	for index, query := range req.Queries {
+		canonicalQuery := *query
+		canonicalQuery.Matchers = make([]*prompb.LabelMatcher, len(query.Matchers))
+		copy(canonicalQuery.Matchers, query.Matchers)
+		sort.Slice(canonicalQuery.Matchers, func(i, j int) bool {
+			if canonicalQuery.Matchers[i].Name != canonicalQuery.Matchers[j].Name {
+				return canonicalQuery.Matchers[i].Name < canonicalQuery.Matchers[j].Name
+			}
+			if canonicalQuery.Matchers[i].Type != canonicalQuery.Matchers[j].Type {
+				return canonicalQuery.Matchers[i].Type < canonicalQuery.Matchers[j].Type
+			}
+			return canonicalQuery.Matchers[i].Value < canonicalQuery.Matchers[j].Value
+		})
+		canonical.Queries[index] = &canonicalQuery
+	}
+	raw, err := proto.Marshal(&canonical)
+	if err != nil {
+		err = fmt.Errorf("can't marshal canonical read request: %v", err)
+		return
+	}
+	hash := sha256.Sum256(raw)
+	return influxURL.Host + "/" + database + "/" + rp + "/" + hex.EncodeToString(hash[:]), nil
+}
+
+// respondRemoteRead encodes resp as a remote read answer. Nothing is written and a *responseLimitError
+// is returned if the encoded answer is bigger than maxBytes (0 for unlimited).
+func respondRemoteRead(w http.ResponseWriter, resp *prompb.ReadResponse, maxBytes int64) (written int, err error) {
+	raw, err := proto.Marshal(resp)
+	if err != nil {
+		err = fmt.Errorf("can't marshal read response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encoded := snappy.Encode(nil, raw)
+	if maxBytes > 0 && int64(len(encoded)) > maxBytes {
+		err = &responseLimitError{limit: limitBytes, max: maxBytes}
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	return w.Write(encoded)
+}
+
+// respondUpstreamRead forwards a raw influxdb remote read answer
+func respondUpstreamRead(w http.ResponseWriter, answer *upstreamRead) (written int, err error) {
+	for key, values := range answer.header {
+		switch key {
+		case "Content-Length", "Connection", "Keep-Alive", "Transfer-Encoding", "Date":
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(answer.statusCode)
+	return w.Write(answer.body)
+}
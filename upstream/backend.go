@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// Config contains the connection pool settings of the backends
+type Config struct {
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int // 0 for unlimited
+	IdleConnTimeout     time.Duration
+	HTTP2               bool // only negotiated with https backends
+}
+
+var (
+	access   sync.Mutex
+	config   = Config{MaxIdleConnsPerHost: 32, IdleConnTimeout: 90 * time.Second}
+	backends = make(map[string]*Backend)
+)
+
+// Configure sets the pool settings of the backends created afterwards
+func Configure(conf Config) {
+	access.Lock()
+	defer access.Unlock()
+	config = conf
+}
+
+// For returns the long lived backend of endpoint, created at first use
+func For(endpoint *url.URL) *Backend {
+	key := endpoint.Scheme + "://" + endpoint.Host
+	access.Lock()
+	defer access.Unlock()
+	b, found := backends[key]
+	if !found {
+		b = newBackend(endpoint.Host, config)
+		backends[key] = b
+	}
+	return b
+}
+
+// All returns the backends created so far sorted by host
+func All() (list []*Backend) {
+	access.Lock()
+	list = make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		list = append(list, b)
+	}
+	access.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].host < list[j].host })
+	return
+}
+
+// Backend holds the shared transport of an influxdb instance
+type Backend struct {
+	host      string
+	transport *http.Transport
+	client    *http.Client
+	// Stats
+	dials    uint64
+	closes   uint64
+	requests uint64
+	reused   uint64
+}
+
+// Stats contains the connection counters of a backend
+type Stats struct {
+	Host     string
+	Dials    uint64 // connections opened
+	Closes   uint64 // connections closed
+	Open     int64
+	Requests uint64
+	Reused   uint64 // requests sent on an already opened connection
+}
+
+func newBackend(host string, conf Config) (b *Backend) {
+	b = &Backend{host: host}
+	b.transport = cleanhttp.DefaultPooledTransport()
+	b.transport.MaxIdleConns = 0 // limited per host
+	b.transport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	b.transport.MaxConnsPerHost = conf.MaxConnsPerHost
+	b.transport.IdleConnTimeout = conf.IdleConnTimeout
+	b.transport.ForceAttemptHTTP2 = conf.HTTP2
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	b.transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&b.dials, 1)
+		return &countedConn{Conn: conn, backend: b}, nil
+	}
+	b.client = &http.Client{Transport: b}
+	return
+}
+
+// Client returns the http client sharing the backend connections
+func (b *Backend) Client() *http.Client {
+	return b.client
+}
+
+// RoundTrip sends req over the shared transport while counting the connections usage
+func (b *Backend) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddUint64(&b.requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&b.reused, 1)
+			}
+		},
+	}
+	return b.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// Stats returns the current connection counters of the backend
+func (b *Backend) Stats() Stats {
+	dials := atomic.LoadUint64(&b.dials)
+	closes := atomic.LoadUint64(&b.closes)
+	return Stats{
+		Host:     b.host,
+		Dials:    dials,
+		Closes:   closes,
+		Open:     int64(dials) - int64(closes),
+		Requests: atomic.LoadUint64(&b.requests),
+		Reused:   atomic.LoadUint64(&b.reused),
+	}
+}
+
+// countedConn reports its closing to its backend
+type countedConn struct {
+	net.Conn
+	backend   *Backend
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.closeOnce.Do(func() { atomic.AddUint64(&c.backend.closes, 1) })
+	return
+}
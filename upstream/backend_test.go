@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (server *httptest.Server, endpoint *url.URL) {
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func get(t *testing.T, b *Backend, endpoint *url.URL) {
+	resp, err := b.Client().Get(endpoint.String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fully read and closed: the connection goes back to the pool
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestBackendSharing(t *testing.T) {
+	server, endpoint := newTestServer(t)
+	defer server.Close()
+	other, otherEndpoint := newTestServer(t)
+	defer other.Close()
+	b := For(endpoint)
+	withPath := *endpoint
+	withPath.Path = "/query"
+	if For(&withPath) != b {
+		t.Error("requests to the same backend do not share its transport")
+	}
+	if For(otherEndpoint) == b {
+		t.Error("two backends share the same transport")
+	}
+	found := 0
+	for _, listed := range All() {
+		if listed == b || listed.host == otherEndpoint.Host {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("found %d of the 2 backends created", found)
+	}
+}
+
+func TestConnectionCounters(t *testing.T) {
+	server, endpoint := newTestServer(t)
+	defer server.Close()
+	b := For(endpoint)
+	for index := 0; index < 3; index++ {
+		get(t, b, endpoint)
+	}
+	if stats := b.Stats(); stats.Host != endpoint.Host || stats.Dials != 1 || stats.Open != 1 || stats.Requests != 3 || stats.Reused != 2 {
+		t.Errorf("expected 3 requests over a single connection, got %+v", stats)
+	}
+	b.transport.CloseIdleConnections()
+	if stats := b.Stats(); stats.Closes != 1 || stats.Open != 0 {
+		t.Errorf("expected the idle connection to be closed, got %+v", stats)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure(config)
+	server, endpoint := newTestServer(t)
+	defer server.Close()
+	Configure(Config{
+		MaxIdleConnsPerHost: 4,
+		MaxConnsPerHost:     8,
+		IdleConnTimeout:     time.Minute,
+	})
+	b := For(endpoint)
+	if b.transport.MaxIdleConnsPerHost != 4 || b.transport.MaxConnsPerHost != 8 || b.transport.IdleConnTimeout != time.Minute || b.transport.ForceAttemptHTTP2 {
+		t.Errorf("backend created with unexpected settings: %d idle, %d max, %v idle timeout, http2 %v",
+			b.transport.MaxIdleConnsPerHost, b.transport.MaxConnsPerHost, b.transport.IdleConnTimeout, b.transport.ForceAttemptHTTP2)
+	}
+}
@@ -0,0 +1,221 @@
+package writebuffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+var (
+	// ErrFull is returned by Append when the record would exceed the configured max size
+	ErrFull = errors.New("write buffer is full")
+	// ErrStopped is returned by Append once the controller context has been cancelled
+	ErrStopped = errors.New("write buffer is stopped")
+)
+
+// Sender forwards a buffered record to the backend. Returned errors are considered
+// transient (replay will be retried later) unless wrapped with Permanent().
+type Sender func(ctx context.Context, record Record) error
+
+// HealthCheck returns true when the backend is ready to accept writes
+type HealthCheck func(ctx context.Context) bool
+
+// Config allow to pass values to the contructor
+type Config struct {
+	Directory       string
+	SegmentSize     int64
+	MaxSize         int64
+	ReplayFrequency time.Duration
+	Sender          Sender
+	HealthCheck     HealthCheck
+	Logger          *hllogger.HlLogger
+}
+
+// New returns an initialized and ready to use write buffer controller.
+// Segments found in Directory from a previous run are scheduled for replay.
+func New(ctx context.Context, conf Config) (c *Controller, err error) {
+	if conf.Logger == nil {
+		err = errors.New("logger can't be nil")
+		return
+	}
+	if conf.Sender == nil || conf.HealthCheck == nil {
+		err = errors.New("sender and health check can't be nil")
+		return
+	}
+	if conf.SegmentSize <= 0 {
+		err = errors.New("segment size must be positive")
+		return
+	}
+	if conf.ReplayFrequency <= 0 {
+		err = errors.New("replay frequency must be positive")
+		return
+	}
+	if err = os.MkdirAll(conf.Directory, 0700); err != nil {
+		err = fmt.Errorf("can't create write buffer directory: %v", err)
+		return
+	}
+	// Init controller
+	c = &Controller{
+		dir:         conf.Directory,
+		segmentSize: conf.SegmentSize,
+		maxSize:     conf.MaxSize,
+		sender:      conf.Sender,
+		healthCheck: conf.HealthCheck,
+		databases:   make(map[string]int),
+		log:         conf.Logger,
+		ctx:         ctx,
+		stopped:     make(chan struct{}),
+	}
+	// Recover segments from a previous run
+	if err = c.loadSegments(); err != nil {
+		err = fmt.Errorf("can't load existing segments: %v", err)
+		return
+	}
+	if len(c.segments) > 0 {
+		c.log.Warningf("[WriteBuffer] %d segment(s) (%d bytes) found from a previous run: they will be replayed",
+			len(c.segments), c.size)
+	}
+	// Start workers
+	c.workers.Add(1)
+	go c.replayer(conf.ReplayFrequency)
+	// Launch the stop watcher
+	go c.stopWatcher()
+	// All good
+	return
+}
+
+// Controller allows to manage a write ahead segment log. Replay is at-least-once:
+// a segment partially replayed before a restart will be replayed from its beginning.
+type Controller struct {
+	// Segments
+	access      sync.Mutex
+	dir         string
+	segments    []*segment // sealed segments, oldest first
+	active      *segmentWriter
+	nextIndex   uint64
+	size        int64
+	segmentSize int64
+	maxSize     int64
+	databases   map[string]int // records pending by database, recovered segments excepted
+	// Replay
+	sender      Sender
+	healthCheck HealthCheck
+	// Stats
+	appended     uint64
+	replayed     uint64
+	dropped      uint64
+	replayErrors uint64
+	// Sub Controllers
+	log *hllogger.HlLogger
+	// Workers
+	ctx     context.Context
+	workers sync.WaitGroup
+	stopped chan struct{}
+}
+
+// Stats contains a snapshot of the write buffer state and counters
+type Stats struct {
+	Size         int64
+	Segments     int
+	Appended     uint64
+	Replayed     uint64
+	Dropped      uint64
+	ReplayErrors uint64
+}
+
+// Stats returns the current state of the write buffer
+func (c *Controller) Stats() (stats Stats) {
+	c.access.Lock()
+	stats.Size = c.size
+	stats.Segments = len(c.segments)
+	if c.active != nil {
+		stats.Segments++
+	}
+	c.access.Unlock()
+	stats.Appended = atomic.LoadUint64(&c.appended)
+	stats.Replayed = atomic.LoadUint64(&c.replayed)
+	stats.Dropped = atomic.LoadUint64(&c.dropped)
+	stats.ReplayErrors = atomic.LoadUint64(&c.replayErrors)
+	return
+}
+
+// Pending returns true if some records are waiting to be replayed
+func (c *Controller) Pending() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return len(c.segments) > 0 || (c.active != nil && c.active.size > 0)
+}
+
+// PendingFor returns true if some records written to database are waiting to be replayed.
+// As records of a previous run are not indexed, it returns true for any database until they are replayed.
+func (c *Controller) PendingFor(database string) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(c.segments) > 0 && c.segments[0].recovered {
+		return true
+	}
+	return c.databases[database] > 0
+}
+
+// Append durably stores record at the end of the log
+func (c *Controller) Append(record Record) (err error) {
+	if len(record.Query) > math.MaxUint16 || len(record.Authorization) > math.MaxUint16 {
+		return errors.New("record query or authorization is too long")
+	}
+	if len(record.Body) > MaxBodySize {
+		return errors.New("record body is too long")
+	}
+	encoded := record.encode()
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.ctx.Err() != nil {
+		return ErrStopped
+	}
+	if c.maxSize > 0 && c.size+int64(len(encoded)) > c.maxSize {
+		return ErrFull
+	}
+	if c.active == nil || (c.active.size > 0 && c.active.size+int64(len(encoded)) > c.segmentSize) {
+		if err = c.rotate(); err != nil {
+			return fmt.Errorf("can't rotate segment: %v", err)
+		}
+	}
+	if err = c.active.write(encoded); err != nil {
+		return fmt.Errorf("can't write record to segment #%d: %v", c.active.index, err)
+	}
+	c.size += int64(len(encoded))
+	c.databases[record.Database()]++
+	atomic.AddUint64(&c.appended, 1)
+	return
+}
+
+func (c *Controller) stopWatcher() {
+	<-c.ctx.Done()
+	c.log.Debugf("[WriteBuffer] Stop signal received: waiting for workers to stop")
+	c.workers.Wait()
+	c.access.Lock()
+	if c.active != nil {
+		if err := c.active.close(); err != nil {
+			c.log.Errorf("[WriteBuffer] Can't close active segment #%d: %v", c.active.index, err)
+		}
+		c.active = nil
+	}
+	if c.size > 0 {
+		c.log.Warningf("[WriteBuffer] %d bytes are still buffered: they will be replayed at next start", c.size)
+	}
+	c.access.Unlock()
+	c.log.Debugf("[WriteBuffer] All workers have stopped")
+	close(c.stopped)
+}
+
+// WaitFullStop will block until all workers have ended
+// folowing the cancellation of ctx
+func (c *Controller) WaitFullStop() {
+	<-c.stopped
+}
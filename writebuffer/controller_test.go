@@ -0,0 +1,225 @@
+package writebuffer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hekmon/hllogger"
+)
+
+type fakeBackend struct {
+	access   sync.Mutex
+	healthy  bool
+	received []string
+	reject   string // query answered with a permanent error
+}
+
+func (fb *fakeBackend) send(ctx context.Context, record Record) error {
+	fb.access.Lock()
+	defer fb.access.Unlock()
+	if !fb.healthy {
+		return errors.New("backend is down")
+	}
+	if record.Query == fb.reject {
+		return Permanent(errors.New("bad request"))
+	}
+	fb.received = append(fb.received, record.Query)
+	return nil
+}
+
+func (fb *fakeBackend) ping(ctx context.Context) bool {
+	fb.access.Lock()
+	defer fb.access.Unlock()
+	return fb.healthy
+}
+
+func (fb *fakeBackend) setHealthy(healthy bool) {
+	fb.access.Lock()
+	fb.healthy = healthy
+	fb.access.Unlock()
+}
+
+func (fb *fakeBackend) queries() []string {
+	fb.access.Lock()
+	defer fb.access.Unlock()
+	return append([]string(nil), fb.received...)
+}
+
+func newTestBuffer(t *testing.T, ctx context.Context, dir string, fb *fakeBackend) *Controller {
+	c, err := New(ctx, Config{
+		Directory:       dir,
+		SegmentSize:     64, // a few records per segment
+		ReplayFrequency: 10 * time.Millisecond,
+		Sender:          fb.send,
+		HealthCheck:     fb.ping,
+		Logger:          hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatalf("can't create write buffer: %v", err)
+	}
+	return c
+}
+
+func waitReplayed(t *testing.T, c *Controller) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Pending() {
+		if time.Now().After(deadline) {
+			t.Fatal("buffer has not been replayed in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplayInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writebuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	fb := &fakeBackend{reject: "db=3"}
+	c := newTestBuffer(t, ctx, dir, fb)
+	expected := []string{"db=0", "db=1", "db=2", "db=4", "db=5"}
+	for _, query := range []string{"db=0", "db=1", "db=2", "db=3", "db=4", "db=5"} {
+		if err = c.Append(Record{Query: query, Body: []byte("some points")}); err != nil {
+			t.Fatalf("can't append record: %v", err)
+		}
+	}
+	if stats := c.Stats(); stats.Segments < 2 {
+		t.Errorf("expected the records to span several segments, got %d", stats.Segments)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if received := fb.queries(); len(received) != 0 {
+		t.Fatalf("records replayed while the backend is down: %v", received)
+	}
+	fb.setHealthy(true)
+	waitReplayed(t, c)
+	cancel()
+	c.WaitFullStop()
+	received := fb.queries()
+	if len(received) != len(expected) {
+		t.Fatalf("replayed %v, expected %v", received, expected)
+	}
+	for index := range expected {
+		if received[index] != expected[index] {
+			t.Fatalf("replayed %v, expected %v", received, expected)
+		}
+	}
+	if stats := c.Stats(); stats.Replayed != 5 || stats.Dropped != 1 || stats.Size != 0 {
+		t.Errorf("unexpected stats after replay: %+v", stats)
+	}
+}
+
+func TestReplayAfterRestartWithCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writebuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// First run: backend is down, records are buffered
+	ctx, cancel := context.WithCancel(context.Background())
+	fb := &fakeBackend{}
+	c := newTestBuffer(t, ctx, dir, fb)
+	for _, query := range []string{"db=a", "db=b"} {
+		if err = c.Append(Record{Query: query}); err != nil {
+			t.Fatalf("can't append record: %v", err)
+		}
+	}
+	cancel()
+	c.WaitFullStop()
+	// Simulate a crash in the middle of a write: a header announcing a huge payload
+	segmentPath := c.segmentPath(c.nextIndex - 1)
+	file, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	// Second run: the valid records are replayed, the corrupted tail is skipped
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	fb.setHealthy(true)
+	c = newTestBuffer(t, ctx, dir, fb)
+	waitReplayed(t, c)
+	if received := fb.queries(); len(received) != 2 || received[0] != "db=a" || received[1] != "db=b" {
+		t.Errorf("replayed %v, expected [db=a db=b]", received)
+	}
+}
+
+func TestAppendLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writebuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, Config{
+		Directory:       dir,
+		SegmentSize:     1024,
+		MaxSize:         100,
+		ReplayFrequency: time.Hour,
+		Sender:          (&fakeBackend{}).send,
+		HealthCheck:     (&fakeBackend{}).ping,
+		Logger:          hllogger.New(ioutil.Discard, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Append(Record{Body: make([]byte, 50)}); err != nil {
+		t.Fatalf("can't append record: %v", err)
+	}
+	if err = c.Append(Record{Body: make([]byte, 50)}); err != ErrFull {
+		t.Errorf("expected ErrFull, got %v", err)
+	}
+	if err = c.Append(Record{Body: make([]byte, MaxBodySize+1)}); err == nil {
+		t.Error("expected a record bigger than MaxBodySize to be refused")
+	}
+}
+
+func TestPendingFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writebuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	fb := &fakeBackend{}
+	c := newTestBuffer(t, ctx, dir, fb)
+	for _, query := range []string{"db=a&rp=autogen", "db=a", "db=b"} {
+		if err = c.Append(Record{Query: query}); err != nil {
+			t.Fatalf("can't append record: %v", err)
+		}
+	}
+	for database, expected := range map[string]bool{"a": true, "b": true, "c": false} {
+		if pending := c.PendingFor(database); pending != expected {
+			t.Errorf("'%s': got pending %v, expected %v", database, pending, expected)
+		}
+	}
+	// Records of a previous run are not indexed: every database is pending until they are replayed
+	cancel()
+	c.WaitFullStop()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	c = newTestBuffer(t, ctx, dir, fb)
+	if !c.PendingFor("c") {
+		t.Error("'c': expected records of a previous run to be pending for any database")
+	}
+	if err = c.Append(Record{Query: "db=c"}); err != nil {
+		t.Fatalf("can't append record: %v", err)
+	}
+	fb.setHealthy(true)
+	waitReplayed(t, c)
+	for _, database := range []string{"a", "b", "c"} {
+		if c.PendingFor(database) {
+			t.Errorf("'%s': still pending once replayed", database)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package writebuffer
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+type permanentError struct {
+	err error
+}
+
+func (pe permanentError) Error() string {
+	return pe.err.Error()
+}
+
+// Permanent wraps err to indicate the record must be dropped instead of being retried
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+func (c *Controller) replayer(frequency time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.Pending() {
+				c.log.Debug("[WriteBuffer] Replayer: new ticker received and records are pending, launching batch")
+				c.replayBatch()
+			}
+		case <-c.ctx.Done():
+			c.log.Debug("[WriteBuffer] Replayer: cancel signal received")
+			return
+		}
+	}
+}
+
+func (c *Controller) replayBatch() {
+	if !c.healthCheck(c.ctx) {
+		c.log.Debug("[WriteBuffer] Replayer: backend is still unhealthy, postponing replay")
+		return
+	}
+	start := time.Now()
+	before := atomic.LoadUint64(&c.replayed)
+	for {
+		seg, found := c.nextSegment()
+		if !found {
+			c.log.Infof("[WriteBuffer] Replayer: buffer fully replayed (%d record(s) in %v)",
+				atomic.LoadUint64(&c.replayed)-before, time.Since(start))
+			return
+		}
+		if !c.replaySegment(seg) {
+			return
+		}
+		c.removeSegment(seg.index)
+	}
+}
+
+// replaySegment returns true if the segment has been fully consumed
+func (c *Controller) replaySegment(seg segment) (done bool) {
+	file, reader, err := c.openSegment(seg)
+	if err != nil {
+		c.log.Errorf("[WriteBuffer] Replayer: can't open segment #%d: %v", seg.index, err)
+		return
+	}
+	defer file.Close()
+	var (
+		record Record
+		read   int64
+	)
+	offset := seg.offset
+	for {
+		if c.ctx.Err() != nil {
+			return
+		}
+		if record, read, err = readRecord(reader); err != nil {
+			if err != io.EOF {
+				c.log.Errorf("[WriteBuffer] Replayer: segment #%d: %v at offset %d: skipping the rest of the segment",
+					seg.index, err, offset)
+			}
+			return true
+		}
+		if err = c.sender(c.ctx, record); err != nil {
+			if _, permanent := err.(permanentError); !permanent {
+				atomic.AddUint64(&c.replayErrors, 1)
+				c.log.Warningf("[WriteBuffer] Replayer: segment #%d: can't replay record at offset %d: %v: will retry later",
+					seg.index, offset, err)
+				return
+			}
+			atomic.AddUint64(&c.dropped, 1)
+			c.log.Errorf("[WriteBuffer] Replayer: segment #%d: record at offset %d has been rejected by the backend: dropping it: %v",
+				seg.index, offset, err)
+		} else {
+			atomic.AddUint64(&c.replayed, 1)
+		}
+		offset += read
+		c.setOffset(seg.index, offset, record)
+	}
+}
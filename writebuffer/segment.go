@@ -0,0 +1,259 @@
+package writebuffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	segmentExt   = ".seg"
+	headerLength = 8 // payload length (uint32) + payload crc32 (uint32)
+	// MaxBodySize is the biggest record body accepted by Append
+	MaxBodySize = 256 * 1024 * 1024
+	// maxPayloadLength is the biggest valid payload: bigger lengths can only come from a corrupted header
+	maxPayloadLength = 2 + math.MaxUint16 + 2 + math.MaxUint16 + MaxBodySize
+)
+
+var errCorrupted = errors.New("corrupted record")
+
+// Record is a buffered write request. As it will be replayed on behalf of the
+// original client, the authorization header is kept as is: segments are
+// therefore only readable by the process user.
+type Record struct {
+	Query         string
+	Authorization string
+	Body          []byte
+}
+
+// Database returns the database the record is written to
+func (r Record) Database() string {
+	values, _ := url.ParseQuery(r.Query)
+	return values.Get("db")
+}
+
+func (r Record) encode() (encoded []byte) {
+	payloadLen := 2 + len(r.Query) + 2 + len(r.Authorization) + len(r.Body)
+	encoded = make([]byte, headerLength+payloadLen)
+	payload := encoded[headerLength:]
+	offset := 0
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(r.Query)))
+	offset += 2
+	offset += copy(payload[offset:], r.Query)
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(r.Authorization)))
+	offset += 2
+	offset += copy(payload[offset:], r.Authorization)
+	copy(payload[offset:], r.Body)
+	binary.BigEndian.PutUint32(encoded[0:], uint32(payloadLen))
+	binary.BigEndian.PutUint32(encoded[4:], crc32.ChecksumIEEE(payload))
+	return
+}
+
+func readRecord(reader io.Reader) (r Record, read int64, err error) {
+	header := make([]byte, headerLength)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorrupted
+		}
+		return
+	}
+	payloadLen := binary.BigEndian.Uint32(header[0:])
+	if payloadLen > maxPayloadLength {
+		err = errCorrupted
+		return
+	}
+	payload := make([]byte, payloadLen)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		err = errCorrupted
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		err = errCorrupted
+		return
+	}
+	read = int64(headerLength + len(payload))
+	// Decode payload
+	var fieldLen int
+	if len(payload) < 2 {
+		err = errCorrupted
+		return
+	}
+	fieldLen = int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) < fieldLen+2 {
+		err = errCorrupted
+		return
+	}
+	r.Query = string(payload[:fieldLen])
+	payload = payload[fieldLen:]
+	fieldLen = int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) < fieldLen {
+		err = errCorrupted
+		return
+	}
+	r.Authorization = string(payload[:fieldLen])
+	r.Body = payload[fieldLen:]
+	return
+}
+
+type segment struct {
+	index     uint64
+	size      int64
+	offset    int64 // replay progress
+	recovered bool  // from a previous run: its records are not counted by database
+}
+
+type segmentWriter struct {
+	segment
+	file *os.File
+}
+
+func (sw *segmentWriter) write(encoded []byte) (err error) {
+	if _, err = sw.file.Write(encoded); err != nil {
+		return
+	}
+	// Records are acknowledged to the client once written: make sure they survive a crash
+	if err = sw.file.Sync(); err != nil {
+		return
+	}
+	sw.size += int64(len(encoded))
+	return
+}
+
+func (sw *segmentWriter) close() error {
+	return sw.file.Close()
+}
+
+func (c *Controller) segmentPath(index uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%020d%s", index, segmentExt))
+}
+
+func (c *Controller) loadSegments() (err error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var index uint64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentExt) {
+			continue
+		}
+		if index, err = strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentExt), 10, 64); err != nil {
+			c.log.Warningf("[WriteBuffer] Ignoring unexpected file '%s' in buffer directory", file.Name())
+			err = nil
+			continue
+		}
+		if file.Size() == 0 {
+			if err = os.Remove(c.segmentPath(index)); err != nil {
+				return fmt.Errorf("can't remove empty segment #%d: %v", index, err)
+			}
+			continue
+		}
+		c.segments = append(c.segments, &segment{
+			index:     index,
+			size:      file.Size(),
+			recovered: true,
+		})
+		c.size += file.Size()
+		if index >= c.nextIndex {
+			c.nextIndex = index + 1
+		}
+	}
+	sort.Slice(c.segments, func(i, j int) bool { return c.segments[i].index < c.segments[j].index })
+	return
+}
+
+// rotate seals the current active segment (if any) and opens a new one. Caller must hold c.access.
+func (c *Controller) rotate() (err error) {
+	if c.active != nil {
+		if err = c.active.close(); err != nil {
+			return fmt.Errorf("can't close segment #%d: %v", c.active.index, err)
+		}
+		sealed := c.active.segment
+		c.segments = append(c.segments, &sealed)
+		c.active = nil
+	}
+	file, err := os.OpenFile(c.segmentPath(c.nextIndex), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	c.active = &segmentWriter{
+		segment: segment{index: c.nextIndex},
+		file:    file,
+	}
+	c.nextIndex++
+	return
+}
+
+// nextSegment returns the oldest sealed segment, sealing the active one if needed
+func (c *Controller) nextSegment() (seg segment, found bool) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(c.segments) == 0 && c.active != nil && c.active.size > 0 {
+		if err := c.active.close(); err != nil {
+			c.log.Errorf("[WriteBuffer] Can't seal active segment #%d: %v", c.active.index, err)
+			return
+		}
+		sealed := c.active.segment
+		c.segments = append(c.segments, &sealed)
+		c.active = nil
+	}
+	if len(c.segments) == 0 {
+		// Fully replayed: forget the records skipped within corrupted segments
+		c.databases = make(map[string]int)
+		return
+	}
+	return *c.segments[0], true
+}
+
+// setOffset records the replay progress of the segment index, record having been consumed
+func (c *Controller) setOffset(index uint64, offset int64, record Record) {
+	c.access.Lock()
+	if len(c.segments) > 0 && c.segments[0].index == index {
+		c.segments[0].offset = offset
+		if !c.segments[0].recovered {
+			database := record.Database()
+			if c.databases[database]--; c.databases[database] <= 0 {
+				delete(c.databases, database)
+			}
+		}
+	}
+	c.access.Unlock()
+}
+
+func (c *Controller) removeSegment(index uint64) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(c.segments) == 0 || c.segments[0].index != index {
+		return
+	}
+	if err := os.Remove(c.segmentPath(index)); err != nil {
+		c.log.Errorf("[WriteBuffer] Can't remove replayed segment #%d: %v", index, err)
+	}
+	c.size -= c.segments[0].size
+	c.segments = c.segments[1:]
+}
+
+func (c *Controller) openSegment(seg segment) (file *os.File, reader *bufio.Reader, err error) {
+	if file, err = os.Open(c.segmentPath(seg.index)); err != nil {
+		return
+	}
+	if _, err = file.Seek(seg.offset, io.SeekStart); err != nil {
+		file.Close()
+		return
+	}
+	reader = bufio.NewReader(file)
+	return
+}
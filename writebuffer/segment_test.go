@@ -0,0 +1,59 @@
+package writebuffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := []Record{
+		{Query: "db=influx", Authorization: "Basic dXNlcjpwYXNz", Body: []byte("payload")},
+		{Query: "db=other"},
+		{},
+	}
+	var log bytes.Buffer
+	for _, record := range records {
+		log.Write(record.encode())
+	}
+	for index, expected := range records {
+		record, read, err := readRecord(&log)
+		if err != nil {
+			t.Fatalf("record #%d: unexpected error: %v", index, err)
+		}
+		if read != int64(len(expected.encode())) {
+			t.Errorf("record #%d: read %d bytes, expected %d", index, read, len(expected.encode()))
+		}
+		if record.Query != expected.Query || record.Authorization != expected.Authorization || !bytes.Equal(record.Body, expected.Body) {
+			t.Errorf("record #%d: got %+v, expected %+v", index, record, expected)
+		}
+	}
+	if _, _, err := readRecord(&log); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the log, got %v", err)
+	}
+}
+
+func TestReadRecordCorrupted(t *testing.T) {
+	valid := Record{Query: "db=influx", Body: []byte("payload")}.encode()
+	flipped := append([]byte(nil), valid...)
+	flipped[len(flipped)-1] ^= 0xff
+	hugeLength := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint32(hugeLength[0:], 0xffffffff)
+	badField := Record{Query: "db=influx"}.encode()
+	binary.BigEndian.PutUint16(badField[headerLength:], 0xffff) // query longer than the payload, with a valid crc
+	binary.BigEndian.PutUint32(badField[4:], crc32.ChecksumIEEE(badField[headerLength:]))
+	cases := map[string][]byte{
+		"truncated header":  valid[:headerLength-1],
+		"truncated payload": valid[:len(valid)-1],
+		"bad crc":           flipped,
+		"huge length":       hugeLength,
+		"bad field length":  badField,
+	}
+	for name, encoded := range cases {
+		if _, _, err := readRecord(bytes.NewReader(encoded)); err != errCorrupted {
+			t.Errorf("%s: expected errCorrupted, got %v", name, err)
+		}
+	}
+}